@@ -0,0 +1,455 @@
+package fakeledger
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/hyperledger/fabric-chaincode-go/pkg/cid"
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/common"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+	res "github.com/p2eengineering/kalp-sdk-public/response"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	compositeKeyNamespace = "\x00"
+	emptyKeySubstitute    = "\x01"
+)
+
+var _ kalpsdk.TransactionContextInterface = (*TransactionContext)(nil)
+
+// TransactionContext is a single transaction against a Ledger. It implements
+// kalpsdk.TransactionContextInterface.
+type TransactionContext struct {
+	ledger    *Ledger
+	txID      string
+	timestamp *timestamppb.Timestamp
+	identity  *ClientIdentity
+	chaincode string
+	function  string
+	args      []string
+	writes    map[string][]byte
+	reads     *readSet
+	event     *peer.ChaincodeEvent
+	kyc       map[string]bool
+	committed bool
+	paginated bool
+}
+
+// Commit validates the read set against the current state, as a committing
+// peer does, and applies the write set, the event and any KYC records to the
+// ledger. An invalid transaction returns an error wrapping
+// ErrMVCCReadConflict or ErrPhantomReadConflict and leaves the state untouched.
+func (ctx *TransactionContext) Commit() error {
+	if ctx.committed {
+		return fmt.Errorf("transaction %s already committed", ctx.txID)
+	}
+	l := ctx.ledger
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	ctx.committed = true
+	if err := l.validate(ctx.txID, ctx.reads); err != nil {
+		return err
+	}
+	l.height++
+	l.apply(ctx.txID, ctx.timestamp, ctx.writes)
+	if ctx.event != nil {
+		l.events = append(l.events, Event{TxID: ctx.txID, Name: ctx.event.EventName, Payload: copyBytes(ctx.event.Payload)})
+	}
+	for user, done := range ctx.kyc {
+		l.kyc[user] = done
+	}
+	return nil
+}
+
+// SetFunctionAndParameters sets what GetFunctionAndParameters returns.
+func (ctx *TransactionContext) SetFunctionAndParameters(function string, args ...string) {
+	ctx.function = function
+	ctx.args = args
+}
+
+// SetCallingChaincode makes the signed proposal name chaincode as its target,
+// as it does when that chaincode calls into this one.
+func (ctx *TransactionContext) SetCallingChaincode(chaincode string) {
+	ctx.chaincode = chaincode
+}
+
+// Identity returns the client identity of the submitter, e.g. to set attributes.
+func (ctx *TransactionContext) Identity() *ClientIdentity {
+	return ctx.identity
+}
+
+// Event returns the event set by the transaction, or nil.
+func (ctx *TransactionContext) Event() *peer.ChaincodeEvent {
+	return ctx.event
+}
+
+// Writes returns a copy of the pending write set; deletes have a nil value.
+func (ctx *TransactionContext) Writes() map[string][]byte {
+	out := make(map[string][]byte, len(ctx.writes))
+	for k, v := range ctx.writes {
+		out[k] = copyBytes(v)
+	}
+	return out
+}
+
+func (ctx *TransactionContext) checkWritable(key string) error {
+	if ctx.committed {
+		return fmt.Errorf("transaction %s already committed", ctx.txID)
+	}
+	if ctx.paginated {
+		return fmt.Errorf("txid [%s]: transaction has already performed a paginated query. Writes are not allowed", ctx.txID)
+	}
+	if key == "" {
+		return fmt.Errorf("key must not be an empty string")
+	}
+	if !utf8.ValidString(key) {
+		return fmt.Errorf("invalid key. key must be a valid utf8 string: [%x]", key)
+	}
+	return nil
+}
+
+func (ctx *TransactionContext) PutStateWithKYC(key string, value []byte) error {
+	if err := ctx.requireKYC(); err != nil {
+		return err
+	}
+	return ctx.PutStateWithoutKYC(key, value)
+}
+
+func (ctx *TransactionContext) PutStateWithoutKYC(key string, value []byte) error {
+	if err := ctx.checkWritable(key); err != nil {
+		return err
+	}
+	// Fabric records a put of a nil value as a delete.
+	ctx.writes[key] = copyBytes(value)
+	return nil
+}
+
+func (ctx *TransactionContext) DelStateWithKYC(key string) error {
+	if err := ctx.requireKYC(); err != nil {
+		return err
+	}
+	return ctx.DelStateWithoutKYC(key)
+}
+
+func (ctx *TransactionContext) DelStateWithoutKYC(key string) error {
+	if err := ctx.checkWritable(key); err != nil {
+		return err
+	}
+	ctx.writes[key] = nil
+	return nil
+}
+
+func (ctx *TransactionContext) requireKYC() error {
+	userID, err := ctx.GetUserID()
+	if err != nil {
+		return err
+	}
+	done, err := ctx.GetKYC(userID)
+	if err != nil {
+		return fmt.Errorf("failed to perform KYC check for user %s. Error: %v", userID, err)
+	}
+	if !done {
+		return fmt.Errorf("user %s has not completed KYC", userID)
+	}
+	return nil
+}
+
+func (ctx *TransactionContext) GetKYC(userId string) (bool, error) {
+	ctx.ledger.mu.Lock()
+	defer ctx.ledger.mu.Unlock()
+	return ctx.ledger.kyc[userId], nil
+}
+
+func (ctx *TransactionContext) PutKYC(id string, kycId string, kycHash string) error {
+	if id == "" || kycId == "" || kycHash == "" {
+		return fmt.Errorf("id, kycId and kycHash are required")
+	}
+	ctx.kyc[id] = true
+	return nil
+}
+
+// GetState returns the committed value of key and records its version in the
+// read set. Like Fabric, it does not see writes made earlier in the same
+// transaction.
+func (ctx *TransactionContext) GetState(key string) ([]byte, error) {
+	if key == "" {
+		return nil, fmt.Errorf("key must not be an empty string")
+	}
+	l := ctx.ledger
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	ctx.reads.addKey(key, l.versionOf(key))
+	if v, ok := l.state[key]; ok {
+		return copyBytes(v.value), nil
+	}
+	return nil, nil
+}
+
+func (ctx *TransactionContext) SetEvent(name string, payload []byte) error {
+	if name == "" {
+		return fmt.Errorf("event name can not be empty string")
+	}
+	// Only one event per transaction; a later call replaces the earlier one.
+	ctx.event = &peer.ChaincodeEvent{TxId: ctx.txID, ChaincodeId: ctx.ledger.chaincode, EventName: name, Payload: copyBytes(payload)}
+	return nil
+}
+
+func (ctx *TransactionContext) GetTxID() string {
+	return ctx.txID
+}
+
+func (ctx *TransactionContext) GetChannelID() string {
+	return ctx.ledger.channelID
+}
+
+func (ctx *TransactionContext) GetUserID() (string, error) {
+	b64ID, err := ctx.identity.GetID()
+	if err != nil {
+		return "", fmt.Errorf("failed to read clientID: %v", err)
+	}
+	decodeID, err := base64.StdEncoding.DecodeString(b64ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to base64 decode clientID: %v", err)
+	}
+	completeID := string(decodeID)
+	return completeID[(strings.Index(completeID, "x509::CN=") + 9):strings.Index(completeID, ",")], nil
+}
+
+func (ctx *TransactionContext) InvokeChaincode(chaincodeName string, args [][]byte, channel string) res.Response {
+	ctx.ledger.mu.Lock()
+	handler, ok := ctx.ledger.chaincodes[chaincodeName]
+	ctx.ledger.mu.Unlock()
+	if !ok {
+		return res.Response{Response: peer.Response{Status: shim.ERROR, Message: fmt.Sprintf("chaincode %s not found", chaincodeName)}}
+	}
+	return res.Response{Response: handler(args, channel)}
+}
+
+func (ctx *TransactionContext) CreateCompositeKey(objectType string, attributes []string) (string, error) {
+	return shim.CreateCompositeKey(objectType, attributes)
+}
+
+func (ctx *TransactionContext) SplitCompositeKey(compositeKey string) (string, []string, error) {
+	if !strings.HasPrefix(compositeKey, compositeKeyNamespace) {
+		return "", nil, fmt.Errorf("%q is not a composite key", compositeKey)
+	}
+	components := strings.Split(compositeKey[1:], compositeKeyNamespace)
+	if len(components) < 2 {
+		return "", nil, fmt.Errorf("%q is not a composite key", compositeKey)
+	}
+	// Every component, including the last, is terminated by U+0000.
+	components = components[:len(components)-1]
+	return components[0], components[1:], nil
+}
+
+func (ctx *TransactionContext) GetStateByPartialCompositeKey(objectType string, keys []string) (kalpsdk.StateQueryIteratorInterface, error) {
+	startKey, err := ctx.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	return ctx.rangeScan(startKey, startKey+string(utf8.MaxRune)), nil
+}
+
+func (ctx *TransactionContext) GetStateByRange(startKey string, endKey string) (kalpsdk.StateQueryIteratorInterface, error) {
+	if startKey == "" {
+		startKey = emptyKeySubstitute
+	}
+	for _, key := range []string{startKey, endKey} {
+		if strings.HasPrefix(key, compositeKeyNamespace) {
+			return nil, fmt.Errorf("first character of the key [%s] contains a null character which is not allowed", key)
+		}
+	}
+	return ctx.rangeScan(startKey, endKey), nil
+}
+
+func (ctx *TransactionContext) rangeScan(startKey, endKey string) *stateIterator {
+	l := ctx.ledger
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	rr := &rangeRead{start: startKey, end: endKey}
+	ctx.reads.ranges = append(ctx.reads.ranges, rr)
+	it := &stateIterator{rr: rr}
+	keys := l.sortedKeysInRange(startKey, endKey)
+	if len(keys) > l.queryLimit {
+		// The peer silently stops at totalQueryLimit; the range was not read to its end.
+		keys = keys[:l.queryLimit]
+		it.truncated = true
+	}
+	for _, k := range keys {
+		it.results = append(it.results, &queryresult.KV{Namespace: l.chaincode, Key: k, Value: copyBytes(l.state[k].value)})
+		it.versions = append(it.versions, l.state[k].version)
+	}
+	return it
+}
+
+// GetQueryResult evaluates a Mango query against the committed state of a
+// CouchDB ledger and fails on LevelDB. Only
+// values that are JSON objects are visible, as they are in CouchDB, and the
+// key can be matched through the "_id" field.
+func (ctx *TransactionContext) GetQueryResult(query string) (kalpsdk.StateQueryIteratorInterface, error) {
+	results, err := ctx.queryResults(query)
+	if err != nil {
+		return nil, err
+	}
+	if limit := ctx.ledger.queryLimit; len(results) > limit {
+		results = results[:limit]
+	}
+	return &stateIterator{results: results}, nil
+}
+
+// queryResults returns every result of a Mango query.
+func (ctx *TransactionContext) queryResults(query string) ([]*queryresult.KV, error) {
+	if db := ctx.ledger.stateDatabase(); db != CouchDB {
+		return nil, fmt.Errorf("ExecuteQuery not supported for %s", db)
+	}
+	q, err := ParseQuery(query)
+	if err != nil {
+		return nil, err
+	}
+
+	type hit struct {
+		key string
+		doc map[string]interface{}
+		raw []byte
+	}
+	var hits []hit
+
+	l := ctx.ledger
+	l.mu.Lock()
+	for _, k := range l.sortedKeysInRange("", "") {
+		raw := l.state[k].value
+		var doc map[string]interface{}
+		if err := json.Unmarshal(raw, &doc); err != nil || doc == nil {
+			continue
+		}
+		doc["_id"] = k
+		if q.Selector.Matches(doc) {
+			hits = append(hits, hit{key: k, doc: doc, raw: copyBytes(raw)})
+		}
+	}
+	l.mu.Unlock()
+
+	if len(q.Sort) > 0 {
+		sort.SliceStable(hits, func(i, j int) bool {
+			for _, f := range q.Sort {
+				a, _ := lookup(hits[i].doc, splitFieldPath(f.Field))
+				b, _ := lookup(hits[j].doc, splitFieldPath(f.Field))
+				if c := compare(a, b); c != 0 {
+					return (c < 0) != f.Desc
+				}
+			}
+			return false
+		})
+	}
+	if q.Skip >= len(hits) {
+		hits = nil
+	} else {
+		hits = hits[q.Skip:]
+	}
+	if q.Limit > 0 && q.Limit < len(hits) {
+		hits = hits[:q.Limit]
+	}
+
+	var results []*queryresult.KV
+	for _, h := range hits {
+		value := h.raw
+		if len(q.Fields) > 0 {
+			projected := project(h.doc, q.Fields)
+			delete(projected, "_id")
+			if value, err = json.Marshal(projected); err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, &queryresult.KV{Namespace: l.chaincode, Key: h.key, Value: value})
+	}
+	return results, nil
+}
+
+func (ctx *TransactionContext) GetHistoryForKey(key string) (kalpsdk.HistoryQueryIteratorInterface, error) {
+	l := ctx.ledger
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return &historyIterator{results: append([]*queryresult.KeyModification(nil), l.history[key]...)}, nil
+}
+
+func (ctx *TransactionContext) GetTxTimestamp() (*timestamppb.Timestamp, error) {
+	return timestamppb.New(ctx.timestamp.AsTime()), nil
+}
+
+func (ctx *TransactionContext) GetFunctionAndParameters() (string, []string) {
+	return ctx.function, append([]string(nil), ctx.args...)
+}
+
+// ValidateCreateTokenTransaction mirrors the kalpsdk implementation: the
+// submitter must be one of account and no document with id and docType may exist.
+func (ctx *TransactionContext) ValidateCreateTokenTransaction(id string, docType string, account []string) error {
+	operator, err := ctx.GetUserID()
+	if err != nil {
+		return fmt.Errorf("failed to get client id: %v", err)
+	}
+	found := false
+	for _, a := range account {
+		if a == operator {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("only the asset owner is allowed to initiate create transaction")
+	}
+	selector, err := json.Marshal(map[string]interface{}{"selector": map[string]string{"id": id, "docType": docType}})
+	if err != nil {
+		return err
+	}
+	it, err := ctx.GetQueryResult(string(selector))
+	if err != nil {
+		return fmt.Errorf("failed to check if token is already minted: %v", err)
+	}
+	defer it.Close()
+	if it.HasNext() {
+		return fmt.Errorf("the token with ID '%v' is already minted", id)
+	}
+	return nil
+}
+
+func (ctx *TransactionContext) GetClientIdentity() cid.ClientIdentity {
+	return ctx.identity
+}
+
+// GetSignedProposal returns a proposal whose channel header names the target
+// chaincode, which is what IsCallerKalpBridge inspects.
+func (ctx *TransactionContext) GetSignedProposal() (*peer.SignedProposal, error) {
+	extension, err := proto.Marshal(&peer.ChaincodeHeaderExtension{ChaincodeId: &peer.ChaincodeID{Name: ctx.chaincode}})
+	if err != nil {
+		return nil, err
+	}
+	channelHeader, err := proto.Marshal(&common.ChannelHeader{
+		Type:      int32(common.HeaderType_ENDORSER_TRANSACTION),
+		ChannelId: ctx.ledger.channelID,
+		TxId:      ctx.txID,
+		Timestamp: ctx.timestamp,
+		Extension: extension,
+	})
+	if err != nil {
+		return nil, err
+	}
+	payload, err := proto.Marshal(&common.Payload{Header: &common.Header{ChannelHeader: channelHeader}})
+	if err != nil {
+		return nil, err
+	}
+	proposal, err := proto.Marshal(&peer.Proposal{Payload: payload})
+	if err != nil {
+		return nil, err
+	}
+	return &peer.SignedProposal{ProposalBytes: proposal}, nil
+}
@@ -0,0 +1,53 @@
+package fakeledger
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+)
+
+// ClientIdentity is a cid.ClientIdentity for an X.509 user enrolled with a
+// fabric CA. GetID returns the same base64 encoded "x509::CN=..." string a
+// peer would, so GetUserId and GetUserID extract the user name from it.
+type ClientIdentity struct {
+	User       string
+	MSPID      string
+	Attributes map[string]string
+}
+
+// NewClientIdentity returns the identity of user in the default MSP.
+func NewClientIdentity(user string) *ClientIdentity {
+	return &ClientIdentity{User: user, MSPID: DefaultMSPID, Attributes: map[string]string{}}
+}
+
+func (c *ClientIdentity) GetID() (string, error) {
+	if c.User == "" {
+		return "", fmt.Errorf("no client identity")
+	}
+	id := fmt.Sprintf("x509::CN=%s,OU=client::CN=fabric-ca-server,O=Kalp", c.User)
+	return base64.StdEncoding.EncodeToString([]byte(id)), nil
+}
+
+func (c *ClientIdentity) GetMSPID() (string, error) {
+	return c.MSPID, nil
+}
+
+func (c *ClientIdentity) GetAttributeValue(attrName string) (string, bool, error) {
+	value, found := c.Attributes[attrName]
+	return value, found, nil
+}
+
+func (c *ClientIdentity) AssertAttributeValue(attrName, attrValue string) error {
+	value, found := c.Attributes[attrName]
+	if !found {
+		return fmt.Errorf("attribute '%s' was not found", attrName)
+	}
+	if value != attrValue {
+		return fmt.Errorf("attribute '%s' equals '%s', not '%s'", attrName, value, attrValue)
+	}
+	return nil
+}
+
+func (c *ClientIdentity) GetX509Certificate() (*x509.Certificate, error) {
+	return nil, nil
+}
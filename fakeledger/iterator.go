@@ -0,0 +1,83 @@
+package fakeledger
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+)
+
+// stateIterator is a StateQueryIteratorInterface over a snapshot of results.
+// For range queries it records every consumed result in the read set.
+type stateIterator struct {
+	results   []*queryresult.KV
+	versions  []uint64
+	rr        *rangeRead
+	pos       int
+	closed    bool
+	truncated bool
+}
+
+func (it *stateIterator) HasNext() bool {
+	if it.closed {
+		return false
+	}
+	if it.pos >= len(it.results) {
+		if it.rr != nil && !it.truncated {
+			it.rr.exhausted = true
+		}
+		return false
+	}
+	return true
+}
+
+func (it *stateIterator) Next() (*queryresult.KV, error) {
+	if it.closed {
+		return nil, fmt.Errorf("iterator is closed")
+	}
+	if it.pos >= len(it.results) {
+		return nil, fmt.Errorf("no more results")
+	}
+	kv := it.results[it.pos]
+	if it.rr != nil {
+		it.rr.reads = append(it.rr.reads, keyVersion{key: kv.Key, version: it.versions[it.pos]})
+	}
+	it.pos++
+	if it.rr != nil && !it.truncated && it.pos == len(it.results) {
+		it.rr.exhausted = true
+	}
+	return kv, nil
+}
+
+func (it *stateIterator) Close() error {
+	it.closed = true
+	return nil
+}
+
+// historyIterator is a HistoryQueryIteratorInterface over a snapshot of key
+// modifications, newest first.
+type historyIterator struct {
+	results []*queryresult.KeyModification
+	pos     int
+	closed  bool
+}
+
+func (it *historyIterator) HasNext() bool {
+	return !it.closed && it.pos < len(it.results)
+}
+
+func (it *historyIterator) Next() (*queryresult.KeyModification, error) {
+	if it.closed {
+		return nil, fmt.Errorf("iterator is closed")
+	}
+	if it.pos >= len(it.results) {
+		return nil, fmt.Errorf("no more results")
+	}
+	km := it.results[it.pos]
+	it.pos++
+	return km, nil
+}
+
+func (it *historyIterator) Close() error {
+	it.closed = true
+	return nil
+}
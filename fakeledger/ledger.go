@@ -0,0 +1,267 @@
+// Package fakeledger is an in-memory world state for testing chaincode written
+// against kalpsdk.TransactionContextInterface. It follows Fabric semantics:
+// reads see only committed state, writes are buffered in a per-transaction
+// write set and applied on Commit, every committed write is kept in the key
+// history, and GetQueryResult evaluates CouchDB Mango selectors.
+package fakeledger
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"google.golang.org/protobuf/types/known/timestamppb"
+)
+
+const (
+	// DefaultChannelID is the channel transactions are submitted on.
+	DefaultChannelID = "kalp"
+	// DefaultChaincodeName is the name of the chaincode under test.
+	DefaultChaincodeName = "klp-accounting-cc"
+	// DefaultMSPID is the MSP of identities created by NewClientIdentity.
+	DefaultMSPID = "KalpMSP"
+	// DefaultTotalQueryLimit is the default ledger.state.totalQueryLimit of a peer.
+	DefaultTotalQueryLimit = 100000
+)
+
+// StateDatabase is the state database a peer is configured with.
+type StateDatabase string
+
+const (
+	// CouchDB supports rich queries through GetQueryResult.
+	CouchDB StateDatabase = "CouchDB"
+	// LevelDB only supports key, range and partial composite key reads.
+	LevelDB StateDatabase = "goleveldb"
+)
+
+// ChaincodeHandler answers InvokeChaincode calls to another chaincode.
+type ChaincodeHandler func(args [][]byte, channel string) peer.Response
+
+// Event is a chaincode event emitted by a committed transaction.
+type Event struct {
+	TxID    string
+	Name    string
+	Payload []byte
+}
+
+type versionedValue struct {
+	value   []byte
+	version uint64
+}
+
+// Ledger is an in-memory world state shared by the transactions created from it.
+type Ledger struct {
+	mu         sync.Mutex
+	channelID  string
+	chaincode  string
+	database   StateDatabase
+	state      map[string]*versionedValue
+	history    map[string][]*queryresult.KeyModification
+	events     []Event
+	kyc        map[string]bool
+	chaincodes map[string]ChaincodeHandler
+	clock      time.Time
+	txCount    uint64
+	height     uint64
+	queryLimit int
+}
+
+// New returns an empty CouchDB backed ledger whose clock starts at
+// 2024-01-01T00:00:00Z.
+func New() *Ledger {
+	return &Ledger{
+		channelID:  DefaultChannelID,
+		chaincode:  DefaultChaincodeName,
+		database:   CouchDB,
+		state:      map[string]*versionedValue{},
+		history:    map[string][]*queryresult.KeyModification{},
+		kyc:        map[string]bool{},
+		chaincodes: map[string]ChaincodeHandler{},
+		clock:      time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC),
+		queryLimit: DefaultTotalQueryLimit,
+	}
+}
+
+// NewTransaction starts a transaction submitted by user. Its timestamp is the
+// current ledger time, and the ledger clock then moves forward one second.
+func (l *Ledger) NewTransaction(user string) *TransactionContext {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.txCount++
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s/%d", l.channelID, l.txCount)))
+	ts := timestamppb.New(l.clock)
+	l.clock = l.clock.Add(time.Second)
+
+	return &TransactionContext{
+		ledger:    l,
+		txID:      hex.EncodeToString(sum[:]),
+		timestamp: ts,
+		identity:  NewClientIdentity(user),
+		chaincode: l.chaincode,
+		writes:    map[string][]byte{},
+		reads:     newReadSet(),
+		kyc:       map[string]bool{},
+	}
+}
+
+// Submit runs fn in a new transaction of user and commits it when fn
+// succeeds. The error of an invalid commit is returned as is.
+func (l *Ledger) Submit(user string, fn func(ctx *TransactionContext) error) error {
+	ctx := l.NewTransaction(user)
+	if err := fn(ctx); err != nil {
+		return err
+	}
+	return ctx.Commit()
+}
+
+// SetTotalQueryLimit sets the peer's ledger.state.totalQueryLimit: unpaginated
+// range and rich queries silently stop after limit results.
+func (l *Ledger) SetTotalQueryLimit(limit int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.queryLimit = limit
+}
+
+// Now returns the timestamp the next transaction will get.
+func (l *Ledger) Now() time.Time {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.clock
+}
+
+// SetTime moves the ledger clock to t.
+func (l *Ledger) SetTime(t time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = t
+}
+
+// Advance moves the ledger clock forward by d.
+func (l *Ledger) Advance(d time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.clock = l.clock.Add(d)
+}
+
+// SetStateDatabase switches the state database. On LevelDB GetQueryResult
+// fails the way a LevelDB peer rejects rich queries.
+func (l *Ledger) SetStateDatabase(db StateDatabase) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.database = db
+}
+
+// SetKYC records whether user has completed KYC.
+func (l *Ledger) SetKYC(user string, done bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.kyc[user] = done
+}
+
+// RegisterChaincode installs the handler InvokeChaincode uses for name.
+func (l *Ledger) RegisterChaincode(name string, handler ChaincodeHandler) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.chaincodes[name] = handler
+}
+
+// GetState returns the committed value of key, or nil when it does not exist.
+func (l *Ledger) GetState(key string) []byte {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if v, ok := l.state[key]; ok {
+		return copyBytes(v.value)
+	}
+	return nil
+}
+
+// PutState writes key directly to the committed state, outside of any
+// transaction. It is meant for seeding fixtures.
+func (l *Ledger) PutState(key string, value []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.height++
+	l.apply("", timestamppb.New(l.clock), map[string][]byte{key: value})
+}
+
+// Keys returns the committed keys starting with prefix in lexical order.
+func (l *Ledger) Keys(prefix string) []string {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var keys []string
+	for k := range l.state {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Events returns the events of all committed transactions in commit order.
+func (l *Ledger) Events() []Event {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return append([]Event(nil), l.events...)
+}
+
+// Height returns the number of committed transactions.
+func (l *Ledger) Height() uint64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.height
+}
+
+func (l *Ledger) stateDatabase() StateDatabase {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.database
+}
+
+// apply writes a write set to the state and the key history. A nil value is
+// a delete. The caller must hold l.mu.
+func (l *Ledger) apply(txID string, ts *timestamppb.Timestamp, writes map[string][]byte) {
+	keys := make([]string, 0, len(writes))
+	for k := range writes {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		v := writes[k]
+		if v == nil {
+			delete(l.state, k)
+		} else {
+			l.state[k] = &versionedValue{value: copyBytes(v), version: l.height}
+		}
+		mod := &queryresult.KeyModification{TxId: txID, Value: copyBytes(v), Timestamp: ts, IsDelete: v == nil}
+		// History is kept newest first, as Fabric v2 returns it.
+		l.history[k] = append([]*queryresult.KeyModification{mod}, l.history[k]...)
+	}
+}
+
+// sortedKeysInRange returns committed keys in [start, end); an empty end is
+// unbounded. The caller must hold l.mu.
+func (l *Ledger) sortedKeysInRange(start, end string) []string {
+	var keys []string
+	for k := range l.state {
+		if k >= start && (end == "" || k < end) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
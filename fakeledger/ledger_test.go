@@ -0,0 +1,204 @@
+package fakeledger
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func readAll(t *testing.T, it interface {
+	HasNext() bool
+	Close() error
+}, next func() (string, error)) []string {
+	t.Helper()
+	defer it.Close()
+	var keys []string
+	for it.HasNext() {
+		k, err := next()
+		require.NoError(t, err)
+		keys = append(keys, k)
+	}
+	return keys
+}
+
+func TestReadsSeeOnlyCommittedState(t *testing.T) {
+	l := New()
+	ctx := l.NewTransaction("alice")
+	require.NoError(t, ctx.PutStateWithoutKYC("k", []byte("v1")))
+
+	v, err := ctx.GetState("k")
+	require.NoError(t, err)
+	require.Nil(t, v, "uncommitted writes must not be visible")
+
+	require.NoError(t, ctx.Commit())
+	require.Error(t, ctx.Commit())
+	require.Equal(t, []byte("v1"), l.GetState("k"))
+
+	ctx = l.NewTransaction("alice")
+	require.NoError(t, ctx.DelStateWithoutKYC("k"))
+	require.NoError(t, ctx.Commit())
+	require.Nil(t, l.GetState("k"))
+}
+
+func TestCompositeKeysAndPartialScans(t *testing.T) {
+	l := New()
+	ctx := l.NewTransaction("alice")
+	for _, attrs := range [][]string{{"alice", "tx1"}, {"alice", "tx2"}, {"alicea", "tx1"}, {"bob", "tx1"}} {
+		key, err := ctx.CreateCompositeKey("UTXO", attrs)
+		require.NoError(t, err)
+		require.NoError(t, ctx.PutStateWithoutKYC(key, []byte(`{}`)))
+	}
+	require.NoError(t, ctx.PutStateWithoutKYC("plain", []byte("x")))
+	require.NoError(t, ctx.Commit())
+
+	ctx = l.NewTransaction("alice")
+	it, err := ctx.GetStateByPartialCompositeKey("UTXO", []string{"alice"})
+	require.NoError(t, err)
+	keys := readAll(t, it, func() (string, error) {
+		kv, err := it.Next()
+		if err != nil {
+			return "", err
+		}
+		_, attrs, err := ctx.SplitCompositeKey(kv.Key)
+		return attrs[0] + "/" + attrs[1], err
+	})
+	require.Equal(t, []string{"alice/tx1", "alice/tx2"}, keys)
+
+	rangeIt, err := ctx.GetStateByRange("", "")
+	require.NoError(t, err)
+	keys = readAll(t, rangeIt, func() (string, error) {
+		kv, err := rangeIt.Next()
+		if err != nil {
+			return "", err
+		}
+		return kv.Key, nil
+	})
+	require.Equal(t, []string{"plain"}, keys, "range scans exclude composite keys")
+
+	_, err = ctx.GetStateByRange("\x00UTXO", "")
+	require.Error(t, err)
+}
+
+func TestQueryResult(t *testing.T) {
+	l := New()
+	l.PutState("u1", []byte(`{"account":"alice","docType":"UTXO","amount":"5"}`))
+	l.PutState("u2", []byte(`{"account":"alice","docType":"UTXO","amount":"7"}`))
+	l.PutState("u3", []byte(`{"account":"bob","docType":"UTXO","amount":"9"}`))
+	l.PutState("gasFees", []byte(`1000`))
+
+	ctx := l.NewTransaction("alice")
+	it, err := ctx.GetQueryResult(`{"selector":{"account":"alice","docType":"UTXO"},"sort":[{"amount":"desc"}],"use_index":"indexIdDocType"}`)
+	require.NoError(t, err)
+	keys := readAll(t, it, func() (string, error) {
+		kv, err := it.Next()
+		if err != nil {
+			return "", err
+		}
+		return kv.Key, nil
+	})
+	require.Equal(t, []string{"u2", "u1"}, keys)
+
+	it, err = ctx.GetQueryResult(`{"selector":{"_id":{"$gt":"u1"}},"fields":["amount"],"limit":1}`)
+	require.NoError(t, err)
+	require.True(t, it.HasNext())
+	kv, err := it.Next()
+	require.NoError(t, err)
+	require.Equal(t, "u2", kv.Key)
+	require.JSONEq(t, `{"amount":"7"}`, string(kv.Value))
+	require.False(t, it.HasNext())
+
+	l.SetStateDatabase(LevelDB)
+	_, err = l.NewTransaction("alice").GetQueryResult(`{"selector":{}}`)
+	require.Error(t, err)
+}
+
+func TestHistoryEventsAndIdentity(t *testing.T) {
+	l := New()
+	first := l.NewTransaction("alice")
+	second := l.NewTransaction("bob")
+	require.NotEqual(t, first.GetTxID(), second.GetTxID())
+
+	ts1, _ := first.GetTxTimestamp()
+	ts2, _ := second.GetTxTimestamp()
+	require.True(t, ts2.AsTime().After(ts1.AsTime()))
+
+	require.NoError(t, first.PutStateWithoutKYC("k", []byte("1")))
+	require.NoError(t, first.SetEvent("Ignored", []byte("x")))
+	require.NoError(t, first.SetEvent("Put", []byte("1")))
+	require.NoError(t, first.Commit())
+	require.NoError(t, second.DelStateWithoutKYC("k"))
+	require.NoError(t, second.Commit())
+
+	it, err := l.NewTransaction("alice").GetHistoryForKey("k")
+	require.NoError(t, err)
+	var mods []bool
+	for it.HasNext() {
+		km, err := it.Next()
+		require.NoError(t, err)
+		mods = append(mods, km.IsDelete)
+	}
+	require.Equal(t, []bool{true, false}, mods, "history is newest first")
+
+	events := l.Events()
+	require.Len(t, events, 1)
+	require.Equal(t, "Put", events[0].Name)
+
+	user, err := second.GetUserID()
+	require.NoError(t, err)
+	require.Equal(t, "bob", user)
+
+	err = l.NewTransaction("carol").PutStateWithKYC("k", []byte("x"))
+	require.Error(t, err)
+	l.SetKYC("carol", true)
+	require.NoError(t, l.NewTransaction("carol").PutStateWithKYC("k", []byte("x")))
+}
+
+func TestPaginatedQueries(t *testing.T) {
+	l := New()
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		l.PutState(k, []byte(`{"docType":"x"}`))
+	}
+	ctx := l.NewTransaction("alice")
+	var keys []string
+	bookmark := ""
+	for {
+		it, metadata, err := ctx.GetStateByRangeWithPagination("", "", 2, bookmark)
+		require.NoError(t, err)
+		for it.HasNext() {
+			kv, err := it.Next()
+			require.NoError(t, err)
+			keys = append(keys, kv.Key)
+		}
+		if bookmark = metadata.Bookmark; bookmark == "" {
+			break
+		}
+	}
+	require.Equal(t, []string{"a", "b", "c", "d", "e"}, keys)
+
+	it, metadata, err := ctx.GetQueryResultWithPagination(`{"selector":{"docType":"x"}}`, 3, "")
+	require.NoError(t, err)
+	require.EqualValues(t, 3, metadata.FetchedRecordsCount)
+	require.NoError(t, it.Close())
+	_, metadata, err = ctx.GetQueryResultWithPagination(`{"selector":{"docType":"x"}}`, 3, metadata.Bookmark)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, metadata.FetchedRecordsCount)
+	require.Empty(t, metadata.Bookmark)
+
+	require.Error(t, ctx.PutStateWithoutKYC("f", []byte("x")), "no writes after a paginated query")
+	writer := l.NewTransaction("alice")
+	require.NoError(t, writer.PutStateWithoutKYC("f", []byte("x")))
+	_, _, err = writer.GetStateByRangeWithPagination("", "", 2, "")
+	require.Error(t, err, "no paginated query after a write")
+
+	l.SetTotalQueryLimit(2)
+	rangeIt, err := l.NewTransaction("alice").GetStateByRange("", "")
+	require.NoError(t, err)
+	keys = readAll(t, rangeIt, func() (string, error) {
+		kv, err := rangeIt.Next()
+		if err != nil {
+			return "", err
+		}
+		return kv.Key, nil
+	})
+	require.Equal(t, []string{"a", "b"}, keys, "unpaginated queries stop at the limit")
+}
@@ -0,0 +1,89 @@
+package fakeledger
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrMVCCReadConflict is returned by Commit when a key read by the
+	// transaction was changed by a transaction committed after the read.
+	ErrMVCCReadConflict = errors.New("MVCC_READ_CONFLICT")
+	// ErrPhantomReadConflict is returned by Commit when re-executing a range
+	// or partial composite key query gives a different result set.
+	ErrPhantomReadConflict = errors.New("PHANTOM_READ_CONFLICT")
+)
+
+type keyVersion struct {
+	key     string
+	version uint64
+}
+
+// rangeRead records a range query and the results the transaction consumed.
+// Like Fabric, only the part of the range up to the last consumed key is
+// validated unless the iterator was exhausted.
+type rangeRead struct {
+	start     string
+	end       string
+	reads     []keyVersion
+	exhausted bool
+}
+
+// readSet is what Commit validates. Rich queries and history queries are not
+// recorded, as Fabric does not re-execute them at validation time.
+type readSet struct {
+	keys   map[string]uint64
+	ranges []*rangeRead
+}
+
+func newReadSet() *readSet {
+	return &readSet{keys: map[string]uint64{}}
+}
+
+// addKey records the version of key seen by GetState; 0 means absent. Only
+// the first read counts.
+func (rs *readSet) addKey(key string, version uint64) {
+	if _, ok := rs.keys[key]; !ok {
+		rs.keys[key] = version
+	}
+}
+
+// validate checks the read set against the current state. The caller must
+// hold l.mu.
+func (l *Ledger) validate(txID string, rs *readSet) error {
+	for key, version := range rs.keys {
+		if l.versionOf(key) != version {
+			return fmt.Errorf("transaction %s is invalid: %w on key %q", txID, ErrMVCCReadConflict, key)
+		}
+	}
+	for _, rr := range rs.ranges {
+		if len(rr.reads) == 0 && !rr.exhausted {
+			continue
+		}
+		var current []string
+		for _, k := range l.sortedKeysInRange(rr.start, rr.end) {
+			if !rr.exhausted && k > rr.reads[len(rr.reads)-1].key {
+				break
+			}
+			current = append(current, k)
+		}
+		if len(current) != len(rr.reads) {
+			return fmt.Errorf("transaction %s is invalid: %w in range [%q, %q)", txID, ErrPhantomReadConflict, rr.start, rr.end)
+		}
+		for i, kv := range rr.reads {
+			if current[i] != kv.key || l.versionOf(kv.key) != kv.version {
+				return fmt.Errorf("transaction %s is invalid: %w in range [%q, %q)", txID, ErrPhantomReadConflict, rr.start, rr.end)
+			}
+		}
+	}
+	return nil
+}
+
+// versionOf returns the committed version of key, or 0 when it does not
+// exist. The caller must hold l.mu.
+func (l *Ledger) versionOf(key string) uint64 {
+	if v, ok := l.state[key]; ok {
+		return v.version
+	}
+	return 0
+}
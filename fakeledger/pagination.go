@@ -0,0 +1,108 @@
+package fakeledger
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+// Paginated queries are only supported in read-only transactions: the peer
+// refuses them after a write, and refuses writes after them. Their results are
+// not part of the read set.
+
+func (ctx *TransactionContext) startPaginatedQuery(pageSize int32) error {
+	if len(ctx.writes) > 0 {
+		return fmt.Errorf("txid [%s]: transaction has already performed writes. Performing paginated query is not allowed", ctx.txID)
+	}
+	if pageSize <= 0 {
+		return fmt.Errorf("page size must be greater than zero")
+	}
+	ctx.paginated = true
+	return nil
+}
+
+// GetStateByRangeWithPagination returns up to pageSize keys of the range,
+// starting at bookmark if it is set. The returned bookmark is the next key of
+// the range, or empty after the last page.
+func (ctx *TransactionContext) GetStateByRangeWithPagination(startKey, endKey string, pageSize int32, bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	if startKey == "" {
+		startKey = emptyKeySubstitute
+	}
+	for _, key := range []string{startKey, endKey} {
+		if strings.HasPrefix(key, compositeKeyNamespace) {
+			return nil, nil, fmt.Errorf("first character of the key [%s] contains a null character which is not allowed", key)
+		}
+	}
+	return ctx.rangePage(startKey, endKey, pageSize, bookmark)
+}
+
+func (ctx *TransactionContext) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	startKey, err := ctx.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return ctx.rangePage(startKey, startKey+string(utf8.MaxRune), pageSize, bookmark)
+}
+
+func (ctx *TransactionContext) rangePage(startKey, endKey string, pageSize int32, bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	if err := ctx.startPaginatedQuery(pageSize); err != nil {
+		return nil, nil, err
+	}
+	if bookmark != "" {
+		if bookmark < startKey || (endKey != "" && bookmark >= endKey) {
+			return nil, nil, fmt.Errorf("invalid bookmark %q", bookmark)
+		}
+		startKey = bookmark
+	}
+	l := ctx.ledger
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	keys := l.sortedKeysInRange(startKey, endKey)
+	metadata := &peer.QueryResponseMetadata{}
+	if len(keys) > int(pageSize) {
+		metadata.Bookmark = keys[pageSize]
+		keys = keys[:pageSize]
+	}
+	it := &stateIterator{}
+	for _, k := range keys {
+		it.results = append(it.results, &queryresult.KV{Namespace: l.chaincode, Key: k, Value: copyBytes(l.state[k].value)})
+	}
+	metadata.FetchedRecordsCount = int32(len(it.results))
+	return it, metadata, nil
+}
+
+// GetQueryResultWithPagination returns up to pageSize results of a Mango
+// query. The bookmark is opaque, as it is on CouchDB, and empty after the last
+// page.
+func (ctx *TransactionContext) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	if err := ctx.startPaginatedQuery(pageSize); err != nil {
+		return nil, nil, err
+	}
+	offset := 0
+	if bookmark != "" {
+		var err error
+		if offset, err = strconv.Atoi(bookmark); err != nil || offset < 0 {
+			return nil, nil, fmt.Errorf("invalid bookmark %q", bookmark)
+		}
+	}
+	results, err := ctx.queryResults(query)
+	if err != nil {
+		return nil, nil, err
+	}
+	if offset > len(results) {
+		offset = len(results)
+	}
+	results = results[offset:]
+	metadata := &peer.QueryResponseMetadata{}
+	if len(results) > int(pageSize) {
+		results = results[:pageSize]
+		metadata.Bookmark = strconv.Itoa(offset + int(pageSize))
+	}
+	metadata.FetchedRecordsCount = int32(len(results))
+	return &stateIterator{results: results}, metadata, nil
+}
@@ -0,0 +1,543 @@
+package fakeledger
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Query is a parsed CouchDB Mango query as accepted by GetQueryResult.
+type Query struct {
+	Selector Selector
+	Sort     []SortField
+	Fields   []string
+	Limit    int
+	Skip     int
+}
+
+// SortField is one entry of the "sort" array of a Mango query.
+type SortField struct {
+	Field string
+	Desc  bool
+}
+
+// Selector evaluates a Mango selector against a decoded JSON document.
+type Selector struct {
+	match matcher
+}
+
+// matcher reports whether a value satisfies a condition. present is false when
+// the value is missing from the document, which only $exists can match.
+type matcher func(value interface{}, present bool) bool
+
+// ParseQuery parses a Mango query such as
+// {"selector":{"account":"abc","docType":"UTXO"},"sort":[{"amount":"desc"}],"limit":10}.
+// "use_index", "bookmark" and the other CouchDB hints are accepted and ignored.
+func ParseQuery(query string) (*Query, error) {
+	var raw map[string]interface{}
+	if err := json.Unmarshal([]byte(query), &raw); err != nil {
+		return nil, fmt.Errorf("invalid query %q: %v", query, err)
+	}
+	rawSelector, ok := raw["selector"]
+	if !ok {
+		return nil, fmt.Errorf("invalid query %q: selector is required", query)
+	}
+	selector, err := compileSelectorValue(rawSelector)
+	if err != nil {
+		return nil, err
+	}
+	q := &Query{Selector: selector}
+
+	if rawSort, ok := raw["sort"]; ok {
+		if q.Sort, err = parseSort(rawSort); err != nil {
+			return nil, err
+		}
+	}
+	if rawFields, ok := raw["fields"]; ok {
+		fields, ok := rawFields.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid query: fields must be an array")
+		}
+		for _, f := range fields {
+			name, ok := f.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid query: field names must be strings")
+			}
+			q.Fields = append(q.Fields, name)
+		}
+	}
+	if q.Limit, err = parseCount(raw, "limit"); err != nil {
+		return nil, err
+	}
+	if q.Skip, err = parseCount(raw, "skip"); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// ParseSelector compiles a bare Mango selector object.
+func ParseSelector(selector string) (Selector, error) {
+	var raw interface{}
+	if err := json.Unmarshal([]byte(selector), &raw); err != nil {
+		return Selector{}, fmt.Errorf("invalid selector %q: %v", selector, err)
+	}
+	return compileSelectorValue(raw)
+}
+
+// Matches reports whether doc satisfies the selector.
+func (s Selector) Matches(doc interface{}) bool {
+	if s.match == nil {
+		return true
+	}
+	return s.match(doc, true)
+}
+
+func compileSelectorValue(raw interface{}) (Selector, error) {
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return Selector{}, fmt.Errorf("invalid selector: expected a JSON object, got %v", raw)
+	}
+	m, err := compileObject(obj)
+	if err != nil {
+		return Selector{}, err
+	}
+	return Selector{match: m}, nil
+}
+
+func parseCount(raw map[string]interface{}, name string) (int, error) {
+	v, ok := raw[name]
+	if !ok {
+		return 0, nil
+	}
+	n, ok := v.(float64)
+	if !ok || n < 0 || n != math.Trunc(n) {
+		return 0, fmt.Errorf("invalid query: %s must be a non-negative integer", name)
+	}
+	return int(n), nil
+}
+
+func parseSort(raw interface{}) ([]SortField, error) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid query: sort must be an array")
+	}
+	var fields []SortField
+	for _, item := range list {
+		switch v := item.(type) {
+		case string:
+			fields = append(fields, SortField{Field: v})
+		case map[string]interface{}:
+			if len(v) != 1 {
+				return nil, fmt.Errorf("invalid query: each sort object must have exactly one field")
+			}
+			for name, dir := range v {
+				switch dir {
+				case "asc":
+					fields = append(fields, SortField{Field: name})
+				case "desc":
+					fields = append(fields, SortField{Field: name, Desc: true})
+				default:
+					return nil, fmt.Errorf("invalid query: sort direction for %s must be asc or desc", name)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("invalid query: unsupported sort entry %v", item)
+		}
+	}
+	return fields, nil
+}
+
+// compileObject compiles an object whose keys are field names, combination
+// operators or condition operators. Every clause must hold.
+func compileObject(obj map[string]interface{}) (matcher, error) {
+	keys := make([]string, 0, len(obj))
+	for k := range obj {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var clauses []matcher
+	for _, k := range keys {
+		arg := obj[k]
+		var m matcher
+		var err error
+		if strings.HasPrefix(k, "$") {
+			m, err = compileOperator(k, arg)
+		} else {
+			m, err = compileField(k, arg)
+		}
+		if err != nil {
+			return nil, err
+		}
+		clauses = append(clauses, m)
+	}
+	return func(v interface{}, present bool) bool {
+		for _, m := range clauses {
+			if !m(v, present) {
+				return false
+			}
+		}
+		return true
+	}, nil
+}
+
+// compileCondition compiles the right-hand side of a field clause. Objects are
+// operator lists or nested selectors; anything else is an implicit $eq.
+func compileCondition(arg interface{}) (matcher, error) {
+	if obj, ok := arg.(map[string]interface{}); ok && len(obj) > 0 {
+		return compileObject(obj)
+	}
+	return equalTo(arg), nil
+}
+
+func compileField(name string, arg interface{}) (matcher, error) {
+	path := splitFieldPath(name)
+	cond, err := compileCondition(arg)
+	if err != nil {
+		return nil, err
+	}
+	return func(v interface{}, present bool) bool {
+		if !present {
+			return cond(nil, false)
+		}
+		fv, ok := lookup(v, path)
+		return cond(fv, ok)
+	}, nil
+}
+
+func compileList(op string, arg interface{}) ([]matcher, error) {
+	list, ok := arg.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid selector: %s requires an array", op)
+	}
+	matchers := make([]matcher, 0, len(list))
+	for _, item := range list {
+		m, err := compileCondition(item)
+		if err != nil {
+			return nil, err
+		}
+		matchers = append(matchers, m)
+	}
+	return matchers, nil
+}
+
+func compileOperator(op string, arg interface{}) (matcher, error) {
+	switch op {
+	case "$and", "$or", "$nor":
+		clauses, err := compileList(op, arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(v interface{}, present bool) bool {
+			for _, m := range clauses {
+				ok := m(v, present)
+				if op == "$and" && !ok {
+					return false
+				}
+				if op == "$or" && ok {
+					return true
+				}
+				if op == "$nor" && ok {
+					return false
+				}
+			}
+			return op != "$or"
+		}, nil
+	case "$not":
+		m, err := compileCondition(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(v interface{}, present bool) bool { return present && !m(v, present) }, nil
+	case "$eq":
+		return equalTo(arg), nil
+	case "$ne":
+		return func(v interface{}, present bool) bool { return present && compare(v, arg) != 0 }, nil
+	case "$gt":
+		return ordered(arg, func(c int) bool { return c > 0 }), nil
+	case "$gte":
+		return ordered(arg, func(c int) bool { return c >= 0 }), nil
+	case "$lt":
+		return ordered(arg, func(c int) bool { return c < 0 }), nil
+	case "$lte":
+		return ordered(arg, func(c int) bool { return c <= 0 }), nil
+	case "$exists":
+		want, ok := arg.(bool)
+		if !ok {
+			return nil, fmt.Errorf("invalid selector: $exists requires a boolean")
+		}
+		return func(_ interface{}, present bool) bool { return present == want }, nil
+	case "$type":
+		want, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid selector: $type requires a string")
+		}
+		return func(v interface{}, present bool) bool { return present && typeName(v) == want }, nil
+	case "$in", "$nin":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid selector: %s requires an array", op)
+		}
+		return func(v interface{}, present bool) bool {
+			if !present {
+				return false
+			}
+			for _, item := range list {
+				if compare(v, item) == 0 {
+					return op == "$in"
+				}
+			}
+			return op == "$nin"
+		}, nil
+	case "$size":
+		n, ok := arg.(float64)
+		if !ok {
+			return nil, fmt.Errorf("invalid selector: $size requires a number")
+		}
+		return func(v interface{}, present bool) bool {
+			arr, ok := v.([]interface{})
+			return present && ok && float64(len(arr)) == n
+		}, nil
+	case "$mod":
+		pair, ok := arg.([]interface{})
+		if !ok || len(pair) != 2 {
+			return nil, fmt.Errorf("invalid selector: $mod requires [divisor, remainder]")
+		}
+		divisor, ok1 := pair[0].(float64)
+		remainder, ok2 := pair[1].(float64)
+		if !ok1 || !ok2 || divisor == 0 || divisor != math.Trunc(divisor) || remainder != math.Trunc(remainder) {
+			return nil, fmt.Errorf("invalid selector: $mod requires non-zero integer divisor and integer remainder")
+		}
+		return func(v interface{}, present bool) bool {
+			n, ok := v.(float64)
+			return present && ok && n == math.Trunc(n) && int64(n)%int64(divisor) == int64(remainder)
+		}, nil
+	case "$regex":
+		pattern, ok := arg.(string)
+		if !ok {
+			return nil, fmt.Errorf("invalid selector: $regex requires a string")
+		}
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector: bad $regex %q: %v", pattern, err)
+		}
+		return func(v interface{}, present bool) bool {
+			s, ok := v.(string)
+			return present && ok && re.MatchString(s)
+		}, nil
+	case "$all":
+		list, ok := arg.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid selector: $all requires an array")
+		}
+		return func(v interface{}, present bool) bool {
+			arr, ok := v.([]interface{})
+			if !present || !ok {
+				return false
+			}
+			for _, want := range list {
+				found := false
+				for _, have := range arr {
+					if compare(have, want) == 0 {
+						found = true
+						break
+					}
+				}
+				if !found {
+					return false
+				}
+			}
+			return true
+		}, nil
+	case "$elemMatch", "$allMatch":
+		m, err := compileCondition(arg)
+		if err != nil {
+			return nil, err
+		}
+		return func(v interface{}, present bool) bool {
+			arr, ok := v.([]interface{})
+			if !present || !ok {
+				return false
+			}
+			if op == "$allMatch" && len(arr) == 0 {
+				return false
+			}
+			for _, item := range arr {
+				ok := m(item, true)
+				if op == "$elemMatch" && ok {
+					return true
+				}
+				if op == "$allMatch" && !ok {
+					return false
+				}
+			}
+			return op == "$allMatch"
+		}, nil
+	default:
+		return nil, fmt.Errorf("invalid selector: unsupported operator %s", op)
+	}
+}
+
+func equalTo(arg interface{}) matcher {
+	return func(v interface{}, present bool) bool { return present && compare(v, arg) == 0 }
+}
+
+func ordered(arg interface{}, accept func(int) bool) matcher {
+	return func(v interface{}, present bool) bool { return present && accept(compare(v, arg)) }
+}
+
+// splitFieldPath splits a dotted field name, honouring "\." escapes.
+func splitFieldPath(name string) []string {
+	var parts []string
+	var cur strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch {
+		case name[i] == '\\' && i+1 < len(name) && name[i+1] == '.':
+			cur.WriteByte('.')
+			i++
+		case name[i] == '.':
+			parts = append(parts, cur.String())
+			cur.Reset()
+		default:
+			cur.WriteByte(name[i])
+		}
+	}
+	return append(parts, cur.String())
+}
+
+func lookup(v interface{}, path []string) (interface{}, bool) {
+	for _, p := range path {
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+		if v, ok = obj[p]; !ok {
+			return nil, false
+		}
+	}
+	return v, true
+}
+
+func typeName(v interface{}) string {
+	switch v.(type) {
+	case nil:
+		return "null"
+	case bool:
+		return "boolean"
+	case float64:
+		return "number"
+	case string:
+		return "string"
+	case []interface{}:
+		return "array"
+	default:
+		return "object"
+	}
+}
+
+// typeRank follows CouchDB view collation: null < false < true < numbers <
+// strings < arrays < objects.
+func typeRank(v interface{}) int {
+	switch t := v.(type) {
+	case nil:
+		return 0
+	case bool:
+		if t {
+			return 2
+		}
+		return 1
+	case float64:
+		return 3
+	case string:
+		return 4
+	case []interface{}:
+		return 5
+	default:
+		return 6
+	}
+}
+
+// compare orders two decoded JSON values using CouchDB collation. Strings are
+// compared byte-wise rather than with ICU rules.
+func compare(a, b interface{}) int {
+	ra, rb := typeRank(a), typeRank(b)
+	if ra != rb {
+		return ra - rb
+	}
+	switch x := a.(type) {
+	case float64:
+		y := b.(float64)
+		switch {
+		case x < y:
+			return -1
+		case x > y:
+			return 1
+		}
+		return 0
+	case string:
+		return strings.Compare(x, b.(string))
+	case []interface{}:
+		y := b.([]interface{})
+		for i := 0; i < len(x) && i < len(y); i++ {
+			if c := compare(x[i], y[i]); c != 0 {
+				return c
+			}
+		}
+		return len(x) - len(y)
+	case map[string]interface{}:
+		if reflect.DeepEqual(a, b) {
+			return 0
+		}
+		y := b.(map[string]interface{})
+		if len(x) != len(y) {
+			return len(x) - len(y)
+		}
+		ka, kb := sortedKeys(x), sortedKeys(y)
+		for i := range ka {
+			if c := strings.Compare(ka[i], kb[i]); c != 0 {
+				return c
+			}
+			if c := compare(x[ka[i]], y[kb[i]]); c != 0 {
+				return c
+			}
+		}
+		return 0
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// project keeps only the requested fields of doc.
+func project(doc map[string]interface{}, fields []string) map[string]interface{} {
+	out := map[string]interface{}{}
+	for _, f := range fields {
+		path := splitFieldPath(f)
+		v, ok := lookup(doc, path)
+		if !ok {
+			continue
+		}
+		dst := out
+		for _, p := range path[:len(path)-1] {
+			next, ok := dst[p].(map[string]interface{})
+			if !ok {
+				next = map[string]interface{}{}
+				dst[p] = next
+			}
+			dst = next
+		}
+		dst[path[len(path)-1]] = v
+	}
+	return out
+}
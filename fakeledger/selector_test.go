@@ -0,0 +1,76 @@
+package fakeledger
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectorMatches(t *testing.T) {
+	var doc interface{}
+	require.NoError(t, json.Unmarshal([]byte(`{
+		"account": "alice",
+		"docType": "UTXO",
+		"amount": "100",
+		"height": 7,
+		"tags": ["fee", "change"],
+		"meta": {"tx": "abc", "index": 2},
+		"outputs": [{"to": "bob", "value": 3}, {"to": "carol", "value": 9}]
+	}`), &doc))
+
+	tests := []struct {
+		selector string
+		want     bool
+	}{
+		{`{}`, true},
+		{`{"account":"alice","docType":"UTXO"}`, true},
+		{`{"account":"bob"}`, false},
+		{`{"missing":"x"}`, false},
+		{`{"height":{"$gt":6,"$lte":7}}`, true},
+		{`{"height":{"$lt":7}}`, false},
+		{`{"amount":{"$gt":5}}`, true}, // strings collate after numbers
+		{`{"account":{"$ne":"bob"}}`, true},
+		{`{"missing":{"$ne":"bob"}}`, false},
+		{`{"missing":{"$exists":false}}`, true},
+		{`{"account":{"$exists":false}}`, false},
+		{`{"account":{"$in":["bob","alice"]}}`, true},
+		{`{"account":{"$nin":["bob","alice"]}}`, false},
+		{`{"tags":{"$size":2}}`, true},
+		{`{"tags":{"$all":["change","fee"]}}`, true},
+		{`{"tags":{"$all":["change","burn"]}}`, false},
+		{`{"meta.tx":"abc"}`, true},
+		{`{"meta":{"index":{"$gte":2}}}`, true},
+		{`{"outputs":{"$elemMatch":{"to":"carol","value":{"$gt":5}}}}`, true},
+		{`{"outputs":{"$elemMatch":{"to":"bob","value":{"$gt":5}}}}`, false},
+		{`{"outputs":{"$allMatch":{"value":{"$gt":1}}}}`, true},
+		{`{"$or":[{"account":"bob"},{"height":7}]}`, true},
+		{`{"$and":[{"account":"alice"},{"height":8}]}`, false},
+		{`{"$nor":[{"account":"bob"},{"height":8}]}`, true},
+		{`{"$not":{"account":"alice"}}`, false},
+		{`{"account":{"$regex":"^al"}}`, true},
+		{`{"height":{"$mod":[2,1]}}`, true},
+		{`{"meta":{"$type":"object"},"tags":{"$type":"array"}}`, true},
+		{`{"height":{"$eq":7.0}}`, true},
+	}
+	for _, tt := range tests {
+		s, err := ParseSelector(tt.selector)
+		require.NoError(t, err, tt.selector)
+		require.Equal(t, tt.want, s.Matches(doc), tt.selector)
+	}
+}
+
+func TestParseQueryErrors(t *testing.T) {
+	for _, q := range []string{
+		`not json`,
+		`{"limit":1}`,
+		`{"selector":[]}`,
+		`{"selector":{"a":{"$bogus":1}}}`,
+		`{"selector":{"a":{"$in":"x"}}}`,
+		`{"selector":{},"sort":[{"a":"up"}]}`,
+		`{"selector":{},"limit":-1}`,
+	} {
+		_, err := ParseQuery(q)
+		require.Error(t, err, q)
+	}
+}
@@ -0,0 +1,167 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const AdminAuditDocType = "AdminAudit"
+const adminAuditByOperator = "AdminAuditByOperator"
+const adminAuditByFunction = "AdminAuditByFunction"
+
+// AdminAudit is the record of a privileged call. Previous is the state the call replaced, in the JSON
+// it is stored as, and is empty if there was none. Records are never overwritten or deleted. Gateway fees
+// are recorded in their receipts instead.
+type AdminAudit struct {
+	DocType   string          `json:"docType"`
+	Operator  string          `json:"operator"`
+	Function  string          `json:"function"`
+	Args      []string        `json:"args"`
+	Previous  json.RawMessage `json:"previous,omitempty"`
+	TxID      string          `json:"txId"`
+	Timestamp int64           `json:"timestamp"`
+}
+
+// recordAdminAudit appends the record of a privileged call by the caller. The record is stored in
+// timestamp order, and indexed by operator and by function with the same order. It must be called on
+// the UnitOfWork of the call, which numbers the records of the transaction.
+func recordAdminAudit(sdk kalpsdk.TransactionContextInterface, function string, args []string, previous []byte) error {
+	uow, ok := sdk.(*UnitOfWork)
+	if !ok {
+		return fmt.Errorf("admin audit of %s must be recorded in a unit of work", function)
+	}
+	operator, err := GetUserId(uow)
+	if err != nil {
+		return fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
+	}
+	now, err := txTime(uow)
+	if err != nil {
+		return err
+	}
+	audit := AdminAudit{
+		DocType:   AdminAuditDocType,
+		Operator:  operator,
+		Function:  function,
+		Args:      args,
+		TxID:      uow.GetTxID(),
+		Timestamp: now,
+	}
+	if previous != nil {
+		if !json.Valid(previous) {
+			// Settings stored as plain strings.
+			if previous, err = json.Marshal(string(previous)); err != nil {
+				return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+			}
+		}
+		audit.Previous = previous
+	}
+	attributes := []string{fmt.Sprintf("%020d", now), audit.TxID, fmt.Sprintf("%05d", uow.nextAudit())}
+	key, err := uow.CreateCompositeKey(AdminAuditDocType, attributes)
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for admin audit: %v", err)
+	}
+	existing, err := uow.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read admin audit: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("admin audit %s already exists", key)
+	}
+	operatorKey, err := uow.CreateCompositeKey(adminAuditByOperator, append([]string{operator}, attributes...))
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for admin audit: %v", err)
+	}
+	functionKey, err := uow.CreateCompositeKey(adminAuditByFunction, append([]string{function}, attributes...))
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for admin audit: %v", err)
+	}
+	auditJSON, err := json.Marshal(audit)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := uow.PutStateWithoutKYC(key, auditJSON); err != nil {
+		return fmt.Errorf("failed to record admin audit: %v", err)
+	}
+	// The indexes only point at the record, which is read back from its key.
+	for _, k := range []string{operatorKey, functionKey} {
+		if err := uow.PutStateWithoutKYC(k, []byte{0x00}); err != nil {
+			return fmt.Errorf("failed to index admin audit: %v", err)
+		}
+	}
+	return nil
+}
+
+// auditKeyChange records a privileged call that is about to replace the state stored under key.
+func auditKeyChange(sdk kalpsdk.TransactionContextInterface, function string, args []string, key string) error {
+	previous, err := sdk.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read from world state: %v", err)
+	}
+	return recordAdminAudit(sdk, function, args, previous)
+}
+
+// GetAdminAudit is a smart contract function which returns the privileged calls made between from and
+// to, in seconds since the epoch, in the order they were made. An operator or function that isn't empty
+// restricts the records to the calls by that operator or of that function.
+func (s *SmartContract) GetAdminAudit(ctx kalpsdk.TransactionContextInterface, operator string, function string, from int64, to int64) ([]AdminAudit, error) {
+	ctx = NewQueryContext(ctx)
+	if from > to {
+		return nil, fmt.Errorf("error with status code %v, from %d is after to %d", http.StatusBadRequest, from, to)
+	}
+	objectType, index := AdminAuditDocType, []string{}
+	switch {
+	case operator != "":
+		objectType, index = adminAuditByOperator, []string{operator}
+	case function != "":
+		objectType, index = adminAuditByFunction, []string{function}
+	}
+	// The keys are in timestamp order after the index attribute, so only the records between from and to
+	// are read.
+	startKey, err := ctx.CreateCompositeKey(objectType, append(index, fmt.Sprintf("%020d", from)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for admin audit: %v", err)
+	}
+	endKey, err := ctx.CreateCompositeKey(objectType, append(index, fmt.Sprintf("%020d", to)))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for admin audit: %v", err)
+	}
+	resultsIterator, err := scanPartialCompositeKeyRange(ctx, objectType, index, startKey, endKey+string(utf8.MaxRune))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer resultsIterator.Close()
+	audits := []AdminAudit{}
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		auditJSON := queryResult.Value
+		if objectType != AdminAuditDocType {
+			_, attributes, err := ctx.SplitCompositeKey(queryResult.Key)
+			if err != nil {
+				return nil, fmt.Errorf("failed to split admin audit key %s: %v", queryResult.Key, err)
+			}
+			key, err := ctx.CreateCompositeKey(AdminAuditDocType, attributes[len(index):])
+			if err != nil {
+				return nil, fmt.Errorf("failed to create the composite key for admin audit: %v", err)
+			}
+			if auditJSON, err = ctx.GetState(key); err != nil {
+				return nil, fmt.Errorf("failed to read admin audit: %v", err)
+			}
+		}
+		var audit AdminAudit
+		if err := json.Unmarshal(auditJSON, &audit); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal value %v", err)
+		}
+		if function != "" && audit.Function != function {
+			continue
+		}
+		audits = append(audits, audit)
+	}
+	return audits, nil
+}
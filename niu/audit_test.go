@@ -0,0 +1,107 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func adminAudit(t *testing.T, l *fakeledger.Ledger, s *SmartContract, operator, function string, from, to int64) []AdminAudit {
+	t.Helper()
+	audits, err := s.GetAdminAudit(l.NewTransaction(alice), operator, function, from, to)
+	require.NoError(t, err)
+	return audits
+}
+
+func auditedFunctions(audits []AdminAudit) []string {
+	functions := []string{}
+	for _, audit := range audits {
+		functions = append(functions, audit.Function)
+	}
+	return functions
+}
+
+func TestAdminAudit(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	initializedAt := l.Now().Unix()
+	l.Advance(time.Minute)
+	require.NoError(t, setGasFees(l, s, "5"))
+	l.Advance(time.Minute)
+	setCoinSelection := func(strategy string) error {
+		return l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+			return s.SetCoinSelection(ctx, strategy)
+		})
+	}
+	require.NoError(t, setCoinSelection(LargestFirstSelection))
+	require.NoError(t, setCoinSelection(SmallestFirstSelection))
+	require.NoError(t, setUserRole(l, s, kalpFoundation, alice, kalpGateWayAdmin))
+	require.Error(t, setUserRole(l, s, alice, bob, kalpGateWayAdmin), "failed calls aren't recorded")
+	end := l.Now().Unix()
+
+	all := adminAudit(t, l, s, "", "", 0, end)
+	require.Equal(t, []string{"Initialize", "SetGasFees", "SetCoinSelection", "SetCoinSelection", "SetUserRoles"}, auditedFunctions(all))
+	require.Equal(t, kalpFoundation, all[0].Operator)
+	require.Equal(t, []string{"GINI", "GINI", kalpFoundation, intialgasfeesadmin, intialkalpGateWayadmin}, all[0].Args)
+	require.Empty(t, all[0].Previous)
+
+	fees := all[1]
+	require.Equal(t, intialgasfeesadmin, fees.Operator)
+	require.Equal(t, []string{"5"}, fees.Args)
+	require.Equal(t, initializedAt+60, fees.Timestamp)
+	var previous GasFeePolicy
+	require.NoError(t, json.Unmarshal(fees.Previous, &previous))
+	require.Equal(t, initialGasFees, previous.Flat)
+	require.Empty(t, all[2].Previous)
+	require.JSONEq(t, `"`+LargestFirstSelection+`"`, string(all[3].Previous))
+
+	require.Equal(t, []string{"Initialize", "SetCoinSelection", "SetCoinSelection", "SetUserRoles"}, auditedFunctions(adminAudit(t, l, s, kalpFoundation, "", 0, end)))
+	require.Len(t, adminAudit(t, l, s, kalpFoundation, "SetCoinSelection", 0, end), 2)
+	require.Len(t, adminAudit(t, l, s, "", "SetCoinSelection", 0, end), 2)
+	require.Empty(t, adminAudit(t, l, s, intialgasfeesadmin, "SetCoinSelection", 0, end))
+	require.Equal(t, []string{"SetGasFees"}, auditedFunctions(adminAudit(t, l, s, "", "", initializedAt+1, initializedAt+60)))
+	_, err := s.GetAdminAudit(l.NewTransaction(alice), "", "", end, 0)
+	require.Error(t, err)
+}
+
+func TestAdminAuditOfMultisigAction(t *testing.T) {
+	l, s := newMultisigLedger(t)
+	proposal, err := proposeAction(l, s, alice, ActionTransfer, dapp, "2000000000000000000000")
+	require.NoError(t, err)
+	_, err = approveProposal(l, s, bob, proposal.ID)
+	require.NoError(t, err)
+
+	audits := adminAudit(t, l, s, "", ActionTransfer, 0, l.Now().Unix())
+	require.Len(t, audits, 1)
+	require.Equal(t, bob, audits[0].Operator)
+	require.Equal(t, []string{dapp, "2000000000000000000000"}, audits[0].Args)
+	require.Equal(t, []string{"SetMultisig"}, auditedFunctions(adminAudit(t, l, s, "", "SetMultisig", 0, l.Now().Unix())))
+}
+
+func TestAdminAuditOfRepeatedCalls(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		uow := NewUnitOfWork(ctx)
+		for _, strategy := range []string{LargestFirstSelection, SmallestFirstSelection} {
+			if err := s.SetCoinSelection(uow, strategy); err != nil {
+				return err
+			}
+		}
+		return nil
+	}))
+	audits := adminAudit(t, l, s, kalpFoundation, "SetCoinSelection", 0, l.Now().Unix())
+	require.Len(t, audits, 2, "every call of a transaction is recorded")
+	require.Equal(t, audits[0].TxID, audits[1].TxID)
+	require.Equal(t, []string{SmallestFirstSelection}, audits[1].Args)
+	require.Len(t, l.Keys("\x00"+AdminAuditDocType+"\x00"), 3, "the record is stored once")
+	for _, key := range l.Keys("\x00" + adminAuditByFunction + "\x00SetCoinSelection\x00") {
+		require.Equal(t, []byte{0x00}, l.GetState(key), "the indexes only point at the record")
+	}
+
+	require.Error(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		return recordAdminAudit(ctx, "SetCoinSelection", []string{LargestFirstSelection}, nil)
+	}), "records are numbered by the unit of work")
+}
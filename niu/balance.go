@@ -0,0 +1,325 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const BalanceDocType = "Balance"
+const BalanceDeltaDocType = "BalanceDelta"
+
+// balanceShards is the number of BalanceDelta records the changes to the balance of an account are
+// spread over.
+const balanceShards = 16
+
+// AccountBalance is the balance record kept next to the UTXOs of an account. It is created once from
+// the UTXOs of the account, and AddUtxo and RemoveUtxo then add what each transaction changed to one of
+// balanceShards BalanceDelta records of the account, picked by the transaction ID, so credits to the same
+// account in one block, like the gas fees paid to the foundation, rarely conflict with each other.
+// Reading a balance reads the record and its deltas by key, which takes the same number of reads
+// however many transactions changed it. RebuildBalance folds the deltas back into the record.
+type AccountBalance struct {
+	Account   string `json:"account"`
+	DocType   string `json:"docType"`
+	Amount    string `json:"amount"`
+	UtxoCount int    `json:"utxoCount"`
+}
+
+// BalanceDelta is the sum of the changes to the balance of an account kept in one shard.
+type BalanceDelta struct {
+	Account   string `json:"account"`
+	DocType   string `json:"docType"`
+	Amount    string `json:"amount"`
+	UtxoCount int    `json:"utxoCount"`
+}
+
+// BalanceCheck compares the balance record of an account with the sum of its UTXOs.
+type BalanceCheck struct {
+	Account       string `json:"account"`
+	Recorded      string `json:"recorded"`
+	RecordedCount int    `json:"recordedCount"`
+	UtxoTotal     string `json:"utxoTotal"`
+	UtxoCount     int    `json:"utxoCount"`
+	RecordExists  bool   `json:"recordExists"`
+	Consistent    bool   `json:"consistent"`
+}
+
+func balanceKey(sdk kalpsdk.TransactionContextInterface, account string) (string, error) {
+	key, err := sdk.CreateCompositeKey(BalanceDocType, []string{account})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for balance of %s: %v", account, err)
+	}
+	return key, nil
+}
+
+func balanceDeltaKey(sdk kalpsdk.TransactionContextInterface, account string, shard uint32) (string, error) {
+	key, err := sdk.CreateCompositeKey(BalanceDeltaDocType, []string{account, fmt.Sprintf("%02d", shard)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for balance delta of %s: %v", account, err)
+	}
+	return key, nil
+}
+
+// balanceShard returns the shard of the balance deltas the transaction writes to.
+func balanceShard(sdk kalpsdk.TransactionContextInterface) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(sdk.GetTxID()))
+	return h.Sum32() % balanceShards
+}
+
+func readBalanceDelta(sdk kalpsdk.TransactionContextInterface, key string) (*BalanceDelta, error) {
+	deltaJSON, err := sdk.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read balance delta %s: %v", key, err)
+	}
+	if deltaJSON == nil {
+		return nil, nil
+	}
+	var delta BalanceDelta
+	if err := json.Unmarshal(deltaJSON, &delta); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal balance delta %s: %v", key, err)
+	}
+	return &delta, nil
+}
+
+// readBalanceRecord returns the balance record of account without its deltas, or nil if the account
+// has none yet.
+func readBalanceRecord(sdk kalpsdk.TransactionContextInterface, account string) (*AccountBalance, error) {
+	key, err := balanceKey(sdk, account)
+	if err != nil {
+		return nil, err
+	}
+	balanceJSON, err := sdk.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read balance of %s: %v", account, err)
+	}
+	if balanceJSON == nil {
+		return nil, nil
+	}
+	var balance AccountBalance
+	if err := json.Unmarshal(balanceJSON, &balance); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal balance of %s: %v", account, err)
+	}
+	return &balance, nil
+}
+
+// readBalance returns the balance record of account with its deltas added, and the keys of the
+// deltas, or nil if the account has no record yet.
+func readBalance(sdk kalpsdk.TransactionContextInterface, account string) (*AccountBalance, []string, error) {
+	balance, err := readBalanceRecord(sdk, account)
+	if err != nil || balance == nil {
+		return nil, nil, err
+	}
+	amount, ok := big.NewInt(0).SetString(balance.Amount, 10)
+	if !ok {
+		return nil, nil, fmt.Errorf("invalid balance %s recorded for %s", balance.Amount, account)
+	}
+	var deltaKeys []string
+	for shard := uint32(0); shard < balanceShards; shard++ {
+		key, err := balanceDeltaKey(sdk, account, shard)
+		if err != nil {
+			return nil, nil, err
+		}
+		delta, err := readBalanceDelta(sdk, key)
+		if err != nil {
+			return nil, nil, err
+		}
+		if delta == nil {
+			continue
+		}
+		deltaAmount, ok := big.NewInt(0).SetString(delta.Amount, 10)
+		if !ok {
+			return nil, nil, fmt.Errorf("invalid amount %s in balance delta %s", delta.Amount, key)
+		}
+		amount.Add(amount, deltaAmount)
+		balance.UtxoCount += delta.UtxoCount
+		deltaKeys = append(deltaKeys, key)
+	}
+	balance.Amount = amount.String()
+	return balance, deltaKeys, nil
+}
+
+func writeBalance(sdk kalpsdk.TransactionContextInterface, balance *AccountBalance) error {
+	key, err := balanceKey(sdk, balance.Account)
+	if err != nil {
+		return err
+	}
+	balance.DocType = BalanceDocType
+	balanceJSON, err := json.Marshal(balance)
+	if err != nil {
+		return fmt.Errorf("failed to marshal balance of %s: %v", balance.Account, err)
+	}
+	if err := sdk.PutStateWithoutKYC(key, balanceJSON); err != nil {
+		return fmt.Errorf("failed to put balance of %s to world state: %v", balance.Account, err)
+	}
+	return nil
+}
+
+// sumUtxos walks the UTXOs of account with a range scan and returns their total and count.
+func sumUtxos(sdk kalpsdk.TransactionContextInterface, account string) (*big.Int, int, error) {
+	resultsIterator, err := RangeUtxoStore{}.Utxos(sdk, account)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer resultsIterator.Close()
+	total := big.NewInt(0)
+	count := 0
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, 0, err
+		}
+		var u Utxo
+		if err := json.Unmarshal(queryResult.Value, &u); err != nil {
+			return nil, 0, fmt.Errorf("failed to unmarshal value %v", err)
+		}
+		amount, ok := big.NewInt(0).SetString(u.Amount, 10)
+		if !ok {
+			return nil, 0, fmt.Errorf("invalid amount %s in utxo %s", u.Amount, queryResult.Key)
+		}
+		total.Add(total, amount)
+		count++
+	}
+	return total, count, nil
+}
+
+// adjustBalance adds delta to the balance of account and count to its UTXO count. The change is added
+// to the delta of the transaction's shard, so only the record and that delta are read, and the record is
+// only written when an account without a record, e.g. one that predates balance records, is seeded from
+// its UTXOs. It must therefore be called before the UTXOs are written. Callers that change the same
+// account more than once in a transaction must pass a UnitOfWork so that later calls see the earlier
+// change.
+func adjustBalance(sdk kalpsdk.TransactionContextInterface, account string, delta *big.Int, count int) error {
+	balance, err := readBalanceRecord(sdk, account)
+	if err != nil {
+		return err
+	}
+	if balance == nil {
+		total, utxoCount, err := sumUtxos(sdk, account)
+		if err != nil {
+			return err
+		}
+		if err := writeBalance(sdk, &AccountBalance{Account: account, Amount: total.String(), UtxoCount: utxoCount}); err != nil {
+			return err
+		}
+	}
+	key, err := balanceDeltaKey(sdk, account, balanceShard(sdk))
+	if err != nil {
+		return err
+	}
+	shardDelta, err := readBalanceDelta(sdk, key)
+	if err != nil {
+		return err
+	}
+	if shardDelta == nil {
+		shardDelta = &BalanceDelta{Account: account, DocType: BalanceDeltaDocType, Amount: "0"}
+	}
+	amount, ok := big.NewInt(0).SetString(shardDelta.Amount, 10)
+	if !ok {
+		return fmt.Errorf("invalid amount %s in balance delta %s", shardDelta.Amount, key)
+	}
+	shardDelta.Amount = amount.Add(amount, delta).String()
+	shardDelta.UtxoCount += count
+	deltaJSON, err := json.Marshal(shardDelta)
+	if err != nil {
+		return fmt.Errorf("failed to marshal balance delta of %s: %v", account, err)
+	}
+	if err := sdk.PutStateWithoutKYC(key, deltaJSON); err != nil {
+		return fmt.Errorf("failed to put balance delta of %s to world state: %v", account, err)
+	}
+	return nil
+}
+
+// GetBalance returns the balance of account from its balance record, falling back to the UTXO sum
+// for accounts that don't have a record yet.
+func GetBalance(sdk kalpsdk.TransactionContextInterface, account string) (string, error) {
+	balance, _, err := readBalance(sdk, account)
+	if err != nil {
+		return "", err
+	}
+	if balance == nil {
+		return GetTotalUTXO(sdk, account)
+	}
+	return balance.Amount, nil
+}
+
+func checkBalance(sdk kalpsdk.TransactionContextInterface, account string) (*BalanceCheck, []string, *big.Int, int, error) {
+	total, count, err := sumUtxos(sdk, account)
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+	balance, deltaKeys, err := readBalance(sdk, account)
+	if err != nil {
+		return nil, nil, nil, 0, err
+	}
+	check := &BalanceCheck{Account: account, UtxoTotal: total.String(), UtxoCount: count}
+	if balance != nil {
+		check.RecordExists = true
+		check.Recorded = balance.Amount
+		check.RecordedCount = balance.UtxoCount
+		check.Consistent = balance.Amount == check.UtxoTotal && balance.UtxoCount == count
+	}
+	return check, deltaKeys, total, count, nil
+}
+
+// VerifyBalance is a smart contract function which compares the balance record of an account with
+// the sum of its UTXOs.
+func (s *SmartContract) VerifyBalance(ctx kalpsdk.TransactionContextInterface, account string) (*BalanceCheck, error) {
+	ctx = NewQueryContext(ctx)
+	account = strings.Trim(account, " ")
+	if account == "" {
+		return nil, fmt.Errorf("invalid input account is required")
+	}
+	check, _, _, _, err := checkBalance(ctx, account)
+	if err != nil {
+		return nil, fmt.Errorf("error with status code %v, failed to check balance: %v", http.StatusInternalServerError, err)
+	}
+	return check, nil
+}
+
+// RebuildBalance is a smart contract function which rewrites the balance record of an account from
+// its UTXOs and removes its deltas. It is used to create the records of accounts on existing ledgers
+// and to repair a record that VerifyBalance reports as inconsistent.
+func (s *SmartContract) RebuildBalance(ctx kalpsdk.TransactionContextInterface, account string) (*BalanceCheck, error) {
+	ctx = NewUnitOfWork(ctx)
+	userValid, err := s.HasPermission(ctx, PermissionRebuildBalance)
+	if err != nil {
+		return nil, fmt.Errorf("error in validating the role %v", err)
+	}
+	if !userValid {
+		return nil, fmt.Errorf("error with status code %v, only %s can rebuild balances", http.StatusBadRequest, kalpFoundationRole)
+	}
+	account = strings.Trim(account, " ")
+	if account == "" {
+		return nil, fmt.Errorf("invalid input account is required")
+	}
+	check, deltaKeys, total, count, err := checkBalance(ctx, account)
+	if err != nil {
+		return nil, fmt.Errorf("error with status code %v, failed to check balance: %v", http.StatusInternalServerError, err)
+	}
+	key, err := balanceKey(ctx, account)
+	if err != nil {
+		return nil, err
+	}
+	if err := auditKeyChange(ctx, "RebuildBalance", []string{account}, key); err != nil {
+		return nil, err
+	}
+	if check.Consistent && len(deltaKeys) == 0 {
+		return check, nil
+	}
+	if err := writeBalance(ctx, &AccountBalance{Account: account, Amount: total.String(), UtxoCount: count}); err != nil {
+		return nil, fmt.Errorf("error with status code %v, failed to rebuild balance: %v", http.StatusInternalServerError, err)
+	}
+	for _, key := range deltaKeys {
+		if err := ctx.DelStateWithoutKYC(key); err != nil {
+			return nil, fmt.Errorf("error with status code %v, failed to delete balance delta %s: %v", http.StatusInternalServerError, key, err)
+		}
+	}
+	return check, nil
+}
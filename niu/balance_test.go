@@ -0,0 +1,112 @@
+package kalpAccounting
+
+import (
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func verifyBalance(t *testing.T, l *fakeledger.Ledger, s *SmartContract, account string) *BalanceCheck {
+	t.Helper()
+	check, err := s.VerifyBalance(l.NewTransaction(account), account)
+	require.NoError(t, err)
+	return check
+}
+
+func TestBalanceRecordFollowsUtxos(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	require.NoError(t, transfer(l, s, alice, bob, "3000000000000000000"))
+
+	for _, account := range []string{kalpFoundation, BridgeContractAddress, alice, bob} {
+		check := verifyBalance(t, l, s, account)
+		require.True(t, check.RecordExists, account)
+		require.True(t, check.Consistent, "%s: %+v", account, check)
+		require.Equal(t, check.UtxoTotal, balanceOf(t, l, s, account))
+	}
+	require.Equal(t, "2000000000000000000", balanceOf(t, l, s, alice))
+	require.Equal(t, 1, verifyBalance(t, l, s, alice).UtxoCount, "the change output replaces the spent utxo")
+}
+
+func TestBalanceRecordOfLegacyAccount(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	ctx := l.NewTransaction(alice)
+	legacyKey, err := ctx.CreateCompositeKey(UTXO, []string{alice, "legacytx", "0"})
+	require.NoError(t, err)
+	l.PutState(legacyKey, []byte(`{"account":"`+alice+`","docType":"UTXO","amount":"70"}`))
+
+	check := verifyBalance(t, l, s, alice)
+	require.False(t, check.RecordExists)
+	require.Equal(t, "70", balanceOf(t, l, s, alice), "accounts without a record fall back to their utxos")
+
+	// The first credit seeds the record from the existing UTXOs.
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "30"))
+	check = verifyBalance(t, l, s, alice)
+	require.True(t, check.Consistent, "%+v", check)
+	require.Equal(t, "100", check.Recorded)
+	require.Equal(t, 2, check.RecordedCount)
+
+	// A UTXO written around the contract is reported and repaired by RebuildBalance.
+	strayKey, err := ctx.CreateCompositeKey(UTXO, []string{alice, "straytx", "0"})
+	require.NoError(t, err)
+	l.PutState(strayKey, []byte(`{"account":"`+alice+`","docType":"UTXO","amount":"5"}`))
+	require.False(t, verifyBalance(t, l, s, alice).Consistent)
+
+	err = l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.RebuildBalance(ctx, alice)
+		return err
+	})
+	require.Error(t, err, "only the foundation can rebuild balances")
+	require.NoError(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.RebuildBalance(ctx, alice)
+		return err
+	}))
+	check = verifyBalance(t, l, s, alice)
+	require.True(t, check.Consistent)
+	require.Equal(t, "105", balanceOf(t, l, s, alice))
+}
+
+func TestConcurrentFeePayersDoNotConflict(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	require.NoError(t, transfer(l, s, kalpFoundation, bob, "5000000000000000000"))
+	// Only the credit that creates the balance record of an account reads and writes the same key.
+	require.NoError(t, transfer(l, s, kalpFoundation, carol, "1"))
+
+	// Both transfers pay the foundation and credit carol, and are endorsed before either is committed.
+	first := l.NewTransaction(alice)
+	_, err := s.Transfer(first, carol, "1000000000000000000")
+	require.NoError(t, err)
+	second := l.NewTransaction(bob)
+	_, err = s.Transfer(second, carol, "1000000000000000000")
+	require.NoError(t, err)
+	require.NoError(t, first.Commit())
+	require.NoError(t, second.Commit())
+
+	require.Equal(t, "1998000000000000001", balanceOf(t, l, s, carol))
+	require.Equal(t, sum(intialFoundationBalance, "-10000000000000000001", initialGasFees, initialGasFees), balanceOf(t, l, s, kalpFoundation))
+	for _, account := range []string{kalpFoundation, carol} {
+		require.True(t, verifyBalance(t, l, s, account).Consistent, account)
+	}
+
+	// However many fees the foundation receives, its balance is kept in a fixed number of deltas.
+	for i := 0; i < 3*balanceShards; i++ {
+		require.NoError(t, transfer(l, s, alice, bob, "50000000000000000"))
+	}
+	deltaPrefix := "\x00" + BalanceDeltaDocType + "\x00" + kalpFoundation + "\x00"
+	require.NotEmpty(t, l.Keys(deltaPrefix))
+	require.LessOrEqual(t, len(l.Keys(deltaPrefix)), balanceShards)
+	require.True(t, verifyBalance(t, l, s, kalpFoundation).Consistent)
+
+	// Rebuilding the foundation's balance folds its deltas into the record.
+	require.NoError(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.RebuildBalance(ctx, kalpFoundation)
+		return err
+	}))
+	require.Empty(t, l.Keys(deltaPrefix))
+	check := verifyBalance(t, l, s, kalpFoundation)
+	require.True(t, check.Consistent)
+	require.Equal(t, check.UtxoTotal, balanceOf(t, l, s, kalpFoundation))
+}
@@ -0,0 +1,169 @@
+package kalpAccounting
+
+import (
+	"fmt"
+	"math/big"
+	"net/http"
+	"sort"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const coinSelectionKey = "coinSelection"
+
+// Coin selection strategies that can be set with SetCoinSelection.
+const (
+	KeyOrderSelection      = "keyOrder"
+	LargestFirstSelection  = "largestFirst"
+	SmallestFirstSelection = "smallestFirst"
+	OldestFirstSelection   = "oldestFirst"
+	ExactMatchSelection    = "exactMatch"
+)
+
+// Coin is an unspent output together with its parsed amount.
+type Coin struct {
+	Utxo
+	Value *big.Int
+}
+
+// CoinSelector picks the UTXOs RemoveUtxo spends. Select returns a subset of coins whose total covers
+// amount, and false if the coins don't cover it.
+type CoinSelector interface {
+	Select(coins []Coin, amount *big.Int) ([]Coin, bool)
+}
+
+// KeyOrderSelector spends coins in key order until the amount is covered. It is the default, and the
+// only strategy that doesn't need to read every UTXO of the account.
+type KeyOrderSelector struct{}
+
+func (KeyOrderSelector) Select(coins []Coin, amount *big.Int) ([]Coin, bool) {
+	return takeUntilCovered(coins, amount)
+}
+
+// LargestFirstSelector spends the largest coins first, which keeps the number of inputs low.
+type LargestFirstSelector struct{}
+
+func (LargestFirstSelector) Select(coins []Coin, amount *big.Int) ([]Coin, bool) {
+	sorted := sortedCoins(coins, func(a, b Coin) bool { return a.Value.Cmp(b.Value) > 0 })
+	return takeUntilCovered(sorted, amount)
+}
+
+// SmallestFirstSelector spends the smallest coins first, sweeping dust out of the account.
+type SmallestFirstSelector struct{}
+
+func (SmallestFirstSelector) Select(coins []Coin, amount *big.Int) ([]Coin, bool) {
+	sorted := sortedCoins(coins, func(a, b Coin) bool { return a.Value.Cmp(b.Value) < 0 })
+	return takeUntilCovered(sorted, amount)
+}
+
+// OldestFirstSelector spends the coins created earliest first. Coins created before creation times
+// were recorded count as the oldest.
+type OldestFirstSelector struct{}
+
+func (OldestFirstSelector) Select(coins []Coin, amount *big.Int) ([]Coin, bool) {
+	sorted := sortedCoins(coins, func(a, b Coin) bool { return a.CreatedAt < b.CreatedAt })
+	return takeUntilCovered(sorted, amount)
+}
+
+// ExactMatchSelector spends a single coin equal to the amount if there is one, so no change output is
+// created. Otherwise it spends the smallest single coin that covers the amount, and falls back to
+// largest first.
+type ExactMatchSelector struct{}
+
+func (ExactMatchSelector) Select(coins []Coin, amount *big.Int) ([]Coin, bool) {
+	var best *Coin
+	for i := range coins {
+		switch coins[i].Value.Cmp(amount) {
+		case 0:
+			return coins[i : i+1], true
+		case 1:
+			if best == nil || coins[i].Value.Cmp(best.Value) < 0 {
+				best = &coins[i]
+			}
+		}
+	}
+	if best != nil {
+		return []Coin{*best}, true
+	}
+	return LargestFirstSelector{}.Select(coins, amount)
+}
+
+// sortedCoins returns a copy of coins sorted by less. Ties keep key order, so every peer selects the
+// same coins.
+func sortedCoins(coins []Coin, less func(a, b Coin) bool) []Coin {
+	sorted := append([]Coin{}, coins...)
+	sort.SliceStable(sorted, func(i, j int) bool { return less(sorted[i], sorted[j]) })
+	return sorted
+}
+
+func takeUntilCovered(coins []Coin, amount *big.Int) ([]Coin, bool) {
+	total := big.NewInt(0)
+	for i, c := range coins {
+		total.Add(total, c.Value)
+		if total.Cmp(amount) >= 0 {
+			return coins[:i+1], true
+		}
+	}
+	return nil, false
+}
+
+var coinSelectors = map[string]CoinSelector{
+	KeyOrderSelection:      KeyOrderSelector{},
+	LargestFirstSelection:  LargestFirstSelector{},
+	SmallestFirstSelection: SmallestFirstSelector{},
+	OldestFirstSelection:   OldestFirstSelector{},
+	ExactMatchSelection:    ExactMatchSelector{},
+}
+
+// getCoinSelection returns the name of the configured coin selection strategy.
+func getCoinSelection(sdk kalpsdk.TransactionContextInterface) (string, error) {
+	strategy, err := sdk.GetState(coinSelectionKey)
+	if err != nil {
+		return "", fmt.Errorf("failed to read coin selection: %v", err)
+	}
+	if strategy == nil {
+		return KeyOrderSelection, nil
+	}
+	return string(strategy), nil
+}
+
+// coinSelector returns the configured coin selection strategy.
+func coinSelector(sdk kalpsdk.TransactionContextInterface) (CoinSelector, error) {
+	strategy, err := getCoinSelection(sdk)
+	if err != nil {
+		return nil, err
+	}
+	selector, ok := coinSelectors[strategy]
+	if !ok {
+		return nil, fmt.Errorf("unknown coin selection %s", strategy)
+	}
+	return selector, nil
+}
+
+// GetCoinSelection is a smart contract function which returns the coin selection strategy used to spend UTXOs.
+func (s *SmartContract) GetCoinSelection(ctx kalpsdk.TransactionContextInterface) (string, error) {
+	return getCoinSelection(ctx)
+}
+
+// SetCoinSelection is a smart contract function which lets the foundation choose the strategy used to
+// pick the UTXOs a transfer spends: keyOrder, largestFirst, smallestFirst, oldestFirst or exactMatch.
+func (s *SmartContract) SetCoinSelection(ctx kalpsdk.TransactionContextInterface, strategy string) error {
+	ctx = NewUnitOfWork(ctx)
+	userValid, err := s.HasPermission(ctx, PermissionSetCoinSelection)
+	if err != nil {
+		return fmt.Errorf("error in validating the role %v", err)
+	}
+	if !userValid {
+		return fmt.Errorf("only %s can change coin selection", kalpFoundationRole)
+	}
+	if _, ok := coinSelectors[strategy]; !ok {
+		return fmt.Errorf("error with status code %v, invalid coin selection %s", http.StatusBadRequest, strategy)
+	}
+	if err := auditKeyChange(ctx, "SetCoinSelection", []string{strategy}, coinSelectionKey); err != nil {
+		return err
+	}
+	if err := ctx.PutStateWithoutKYC(coinSelectionKey, []byte(strategy)); err != nil {
+		return fmt.Errorf("failed to set coin selection: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package kalpAccounting
+
+import (
+	"math/big"
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func coins(values ...int64) []Coin {
+	var cs []Coin
+	for i, v := range values {
+		// Later keys are older, so key order and age order differ.
+		cs = append(cs, Coin{Utxo: Utxo{Key: string(rune('a' + i)), CreatedAt: int64(100 - i)}, Value: big.NewInt(v)})
+	}
+	return cs
+}
+
+func keysOf(cs []Coin) string {
+	keys := ""
+	for _, c := range cs {
+		keys += c.Key
+	}
+	return keys
+}
+
+func TestCoinSelectors(t *testing.T) {
+	available := coins(5, 1, 8, 3, 2)
+	for _, tc := range []struct {
+		strategy string
+		amount   int64
+		want     string
+	}{
+		{KeyOrderSelection, 6, "ab"},
+		{LargestFirstSelection, 10, "ca"},
+		{SmallestFirstSelection, 6, "bed"},
+		{OldestFirstSelection, 6, "edc"},
+		{ExactMatchSelection, 3, "d"},
+		{ExactMatchSelection, 4, "a"},
+		{ExactMatchSelection, 12, "ca"},
+	} {
+		spent, ok := coinSelectors[tc.strategy].Select(available, big.NewInt(tc.amount))
+		require.True(t, ok, tc.strategy)
+		require.Equal(t, tc.want, keysOf(spent), "%s %d", tc.strategy, tc.amount)
+	}
+	for strategy, selector := range coinSelectors {
+		_, ok := selector.Select(available, big.NewInt(20))
+		require.False(t, ok, strategy)
+	}
+}
+
+func TestRemoveUtxoUsesConfiguredSelection(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	for _, amount := range []string{"10", "1", "7"} {
+		require.NoError(t, transfer(l, s, kalpFoundation, alice, amount))
+	}
+
+	err := l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		return s.SetCoinSelection(ctx, "random")
+	})
+	require.Error(t, err)
+	require.NoError(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		return s.SetCoinSelection(ctx, ExactMatchSelection)
+	}))
+	strategy, err := s.GetCoinSelection(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, ExactMatchSelection, strategy)
+
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return RemoveUtxo(NewUnitOfWork(ctx), alice, big.NewInt(7))
+	}))
+	check := verifyBalance(t, l, s, alice)
+	require.True(t, check.Consistent)
+	require.Equal(t, "11", check.UtxoTotal)
+	require.Equal(t, 2, check.UtxoCount, "the exact match is spent without change")
+}
@@ -0,0 +1,216 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const consolidationKey = "utxoConsolidation"
+const defaultConsolidationThreshold = 500
+const defaultConsolidationMaxInputs = 100
+
+// ConsolidationConfig controls automatic consolidation. When a spend leaves the spender with more than
+// Threshold UTXOs, up to MaxInputs of the spender's remaining UTXOs are merged into one. A Threshold of
+// 0 disables it.
+type ConsolidationConfig struct {
+	Threshold int `json:"threshold"`
+	MaxInputs int `json:"maxInputs"`
+}
+
+// UtxoConsolidation records the merge of several UTXOs of an account into one.
+type UtxoConsolidation struct {
+	Account string `json:"account"`
+	Inputs  int    `json:"inputs"`
+	Amount  string `json:"amount"`
+	UtxoKey string `json:"utxoKey"`
+}
+
+func getConsolidationConfig(sdk kalpsdk.TransactionContextInterface) (*ConsolidationConfig, error) {
+	configJSON, err := sdk.GetState(consolidationKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read consolidation config: %v", err)
+	}
+	if configJSON == nil {
+		return &ConsolidationConfig{Threshold: defaultConsolidationThreshold, MaxInputs: defaultConsolidationMaxInputs}, nil
+	}
+	var config ConsolidationConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal consolidation config: %v", err)
+	}
+	return &config, nil
+}
+
+// consolidateUtxos merges up to maxInputs UTXOs of account into a single UTXO. It returns nil if the
+// account has fewer than two UTXOs.
+func consolidateUtxos(sdk kalpsdk.TransactionContextInterface, account string, maxInputs int) (*UtxoConsolidation, error) {
+	resultsIterator, err := RangeUtxoStore{}.Utxos(sdk, account)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer resultsIterator.Close()
+	var keys []string
+	var createdAt int64
+	total := big.NewInt(0)
+	for len(keys) < maxInputs && resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var u Utxo
+		if err := json.Unmarshal(queryResult.Value, &u); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal value %v", err)
+		}
+		amount, ok := big.NewInt(0).SetString(u.Amount, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid amount %s in utxo %s", u.Amount, queryResult.Key)
+		}
+		total.Add(total, amount)
+		if len(keys) == 0 || u.CreatedAt < createdAt {
+			createdAt = u.CreatedAt
+		}
+		keys = append(keys, queryResult.Key)
+	}
+	if len(keys) < 2 {
+		return nil, nil
+	}
+	if err := adjustBalance(sdk, account, big.NewInt(0), 1-len(keys)); err != nil {
+		return nil, err
+	}
+	for _, key := range keys {
+		if err := sdk.DelStateWithoutKYC(key); err != nil {
+			return nil, fmt.Errorf("failed to delete utxo %s from world state: %v", key, err)
+		}
+	}
+	utxoKey, err := newUtxoKey(sdk, account)
+	if err != nil {
+		return nil, err
+	}
+	// The merged UTXO keeps the age of its oldest input, so oldest-first selection still spends it early.
+	utxoJSON, err := json.Marshal(Utxo{DocType: UTXO, Account: account, Amount: total.String(), CreatedAt: createdAt})
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal utxo of %s to JSON: %v", account, err)
+	}
+	if err := sdk.PutStateWithoutKYC(utxoKey, utxoJSON); err != nil {
+		return nil, fmt.Errorf("failed to put utxo %s to world state: %v", utxoKey, err)
+	}
+	return &UtxoConsolidation{Account: account, Inputs: len(keys), Amount: total.String(), UtxoKey: utxoKey}, nil
+}
+
+// autoConsolidateUtxos consolidates the UTXOs of account after a spend by it that left it more than the
+// configured threshold of them, as counted by its balance record. It only runs under a UnitOfWork, since the merge has to see the
+// outputs written earlier in the transaction; the merges are reported in the transaction's transfer
+// event.
+func autoConsolidateUtxos(sdk kalpsdk.TransactionContextInterface, account string) error {
+	uow, ok := sdk.(*UnitOfWork)
+	if !ok {
+		return nil
+	}
+	config, err := getConsolidationConfig(uow)
+	if err != nil {
+		return err
+	}
+	if config.Threshold <= 0 {
+		return nil
+	}
+	balance, _, err := readBalance(uow, account)
+	if err != nil {
+		return err
+	}
+	if balance == nil || balance.UtxoCount <= config.Threshold {
+		return nil
+	}
+	consolidation, err := consolidateUtxos(uow, account, config.MaxInputs)
+	if err != nil {
+		return fmt.Errorf("failed to consolidate utxos of %s: %v", account, err)
+	}
+	if consolidation != nil {
+		uow.consolidations = append(uow.consolidations, *consolidation)
+	}
+	return nil
+}
+
+// ConsolidateUtxos is a smart contract function which merges up to maxInputs UTXOs of an account into
+// one. It can be called by the owner of the account or by the foundation.
+func (s *SmartContract) ConsolidateUtxos(ctx kalpsdk.TransactionContextInterface, account string, maxInputs int) (*UtxoConsolidation, error) {
+	ctx = NewUnitOfWork(ctx)
+	account = strings.Trim(account, " ")
+	if account == "" {
+		return nil, fmt.Errorf("invalid input account is required")
+	}
+	if maxInputs < 2 {
+		return nil, fmt.Errorf("error with status code %v, maxInputs must be at least 2", http.StatusBadRequest)
+	}
+	operator, err := GetUserId(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
+	}
+	if operator != account {
+		allowed, err := s.hasPermission(ctx, operator, PermissionConsolidateUtxos)
+		if err != nil {
+			return nil, fmt.Errorf("error checking operator's role: %v", err)
+		}
+		if !allowed {
+			return nil, fmt.Errorf("error with status code %v, only the account owner or %s can consolidate utxos", http.StatusBadRequest, kalpFoundationRole)
+		}
+		if err := recordAdminAudit(ctx, "ConsolidateUtxos", []string{account, fmt.Sprint(maxInputs)}, nil); err != nil {
+			return nil, err
+		}
+	}
+	consolidation, err := consolidateUtxos(ctx, account, maxInputs)
+	if err != nil {
+		return nil, fmt.Errorf("error with status code %v, failed to consolidate utxos: %v", http.StatusInternalServerError, err)
+	}
+	if consolidation == nil {
+		return nil, fmt.Errorf("error with status code %v, account %s has fewer than 2 utxos", http.StatusBadRequest, account)
+	}
+	consolidationJSON, err := json.Marshal(consolidation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := ctx.SetEvent("UtxosConsolidated", consolidationJSON); err != nil {
+		return nil, fmt.Errorf("failed to set event: %v", err)
+	}
+	return consolidation, nil
+}
+
+// GetUtxoConsolidation is a smart contract function which returns the automatic consolidation settings.
+func (s *SmartContract) GetUtxoConsolidation(ctx kalpsdk.TransactionContextInterface) (*ConsolidationConfig, error) {
+	return getConsolidationConfig(ctx)
+}
+
+// SetUtxoConsolidation is a smart contract function which lets the foundation change the number of
+// UTXOs a spend can walk before the spender is consolidated automatically, and the number of UTXOs
+// merged at a time.
+// A threshold of 0 disables automatic consolidation.
+func (s *SmartContract) SetUtxoConsolidation(ctx kalpsdk.TransactionContextInterface, threshold int, maxInputs int) error {
+	ctx = NewUnitOfWork(ctx)
+	userValid, err := s.HasPermission(ctx, PermissionSetUtxoConsolidation)
+	if err != nil {
+		return fmt.Errorf("error in validating the role %v", err)
+	}
+	if !userValid {
+		return fmt.Errorf("only %s can change consolidation settings", kalpFoundationRole)
+	}
+	if threshold < 0 {
+		return fmt.Errorf("error with status code %v, invalid threshold %d", http.StatusBadRequest, threshold)
+	}
+	if threshold > 0 && (maxInputs < 2 || maxInputs > threshold) {
+		return fmt.Errorf("error with status code %v, maxInputs must be between 2 and the threshold", http.StatusBadRequest)
+	}
+	configJSON, err := json.Marshal(ConsolidationConfig{Threshold: threshold, MaxInputs: maxInputs})
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := auditKeyChange(ctx, "SetUtxoConsolidation", []string{fmt.Sprint(threshold), fmt.Sprint(maxInputs)}, consolidationKey); err != nil {
+		return err
+	}
+	if err := ctx.PutStateWithoutKYC(consolidationKey, configJSON); err != nil {
+		return fmt.Errorf("failed to set consolidation settings: %v", err)
+	}
+	return nil
+}
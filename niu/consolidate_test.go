@@ -0,0 +1,97 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func lastEvent(t *testing.T, l *fakeledger.Ledger) fakeledger.Event {
+	t.Helper()
+	events := l.Events()
+	require.NotEmpty(t, events)
+	return events[len(events)-1]
+}
+
+func TestConsolidateUtxos(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		return s.SetUtxoConsolidation(ctx, 0, 0)
+	}))
+	for i := 0; i < 4; i++ {
+		require.NoError(t, transfer(l, s, kalpFoundation, alice, "10"))
+	}
+	require.Equal(t, 4, verifyBalance(t, l, s, alice).UtxoCount)
+
+	err := l.Submit(bob, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.ConsolidateUtxos(ctx, alice, 10)
+		return err
+	})
+	require.Error(t, err, "only the owner or the foundation can consolidate")
+
+	var consolidation *UtxoConsolidation
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		consolidation, err = s.ConsolidateUtxos(ctx, alice, 3)
+		return err
+	}))
+	require.Equal(t, 3, consolidation.Inputs)
+	require.Equal(t, "30", consolidation.Amount)
+	event := lastEvent(t, l)
+	require.Equal(t, "UtxosConsolidated", event.Name)
+
+	require.NoError(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.ConsolidateUtxos(ctx, alice, 10)
+		return err
+	}))
+	check := verifyBalance(t, l, s, alice)
+	require.True(t, check.Consistent)
+	require.Equal(t, 1, check.UtxoCount)
+	require.Equal(t, "40", balanceOf(t, l, s, alice))
+
+	err = l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.ConsolidateUtxos(ctx, alice, 10)
+		return err
+	})
+	require.Error(t, err, "a single utxo can't be consolidated")
+}
+
+func TestAutomaticConsolidation(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	err := l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		return s.SetUtxoConsolidation(ctx, 3, 5)
+	})
+	require.Error(t, err, "maxInputs can't exceed the threshold")
+	require.NoError(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		return s.SetUtxoConsolidation(ctx, 3, 3)
+	}))
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, transfer(l, s, kalpFoundation, alice, "1000000000000000000"))
+	}
+	require.Equal(t, 5, verifyBalance(t, l, s, alice).UtxoCount, "credits don't consolidate the account they pay")
+
+	// Spending walks a single utxo, but leaves four, so three of them are merged.
+	require.NoError(t, transfer(l, s, alice, bob, "1000000000000000000"))
+	check := verifyBalance(t, l, s, alice)
+	require.True(t, check.Consistent)
+	require.Equal(t, 2, check.UtxoCount)
+	require.Equal(t, "4000000000000000000", balanceOf(t, l, s, alice))
+	require.Equal(t, 1, verifyBalance(t, l, s, bob).UtxoCount)
+
+	var transferEvent TransferSingle
+	event := lastEvent(t, l)
+	require.Equal(t, "TransferSingle", event.Name)
+	require.NoError(t, json.Unmarshal(event.Payload, &transferEvent))
+	require.Len(t, transferEvent.Consolidations, 1)
+	require.Equal(t, alice, transferEvent.Consolidations[0].Account)
+	require.Equal(t, 3, transferEvent.Consolidations[0].Inputs)
+
+	// Two utxos are left, which is under the threshold.
+	require.NoError(t, transfer(l, s, alice, bob, "1000000000000000000"))
+	transferEvent = TransferSingle{}
+	require.NoError(t, json.Unmarshal(lastEvent(t, l).Payload, &transferEvent))
+	require.Empty(t, transferEvent.Consolidations)
+}
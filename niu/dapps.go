@@ -0,0 +1,333 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const DappDocType = "Dapp"
+const DappAccrualDocType = "DappAccrual"
+
+// maxDappClaimAccruals is the most accruals ClaimDappRevenue pays in one transaction. The rest is paid
+// by the next claim.
+const maxDappClaimAccruals = 1000
+
+// Dapp is a dapp registered for revenue sharing. It earns RevenueShare basis points of the foundation's
+// share of the gateway fees collected for it, which its owner claims from the foundation with
+// ClaimDappRevenue. The fees and revenue of a gateway fee are recorded as a DappAccrual next to its
+// receipt, and only added to the stored record when they are claimed, so collecting fees for the same
+// dapp doesn't write a shared key. GetDapp reports the totals including the accruals not claimed yet.
+type Dapp struct {
+	DappID         string `json:"dappId"`
+	DocType        string `json:"docType"`
+	Owner          string `json:"owner"`
+	RevenueShare   uint64 `json:"revenueShare"`
+	FeesCollected  string `json:"feesCollected"`
+	RevenueAccrued string `json:"revenueAccrued"`
+	RevenueClaimed string `json:"revenueClaimed"`
+}
+
+// DappAccrual is the fee and revenue of a gateway fee collected for a registered dapp that haven't been
+// claimed yet. It is keyed by the reference of the fee, like its receipt.
+type DappAccrual struct {
+	DappID    string `json:"dappId"`
+	DocType   string `json:"docType"`
+	Reference string `json:"reference"`
+	Fee       string `json:"fee"`
+	Revenue   string `json:"revenue"`
+}
+
+// dappAccruals are the accruals of a dapp paid by a claim, and their totals.
+type dappAccruals struct {
+	keys    []string
+	fees    *big.Int
+	revenue *big.Int
+}
+
+// DappRevenueClaim is the result and event of ClaimDappRevenue.
+type DappRevenueClaim struct {
+	DappID string `json:"dappId"`
+	Owner  string `json:"owner"`
+	Amount string `json:"amount"`
+}
+
+func dappKey(sdk kalpsdk.TransactionContextInterface, dappID string) (string, error) {
+	key, err := sdk.CreateCompositeKey(DappDocType, []string{dappID})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for dapp %s: %v", dappID, err)
+	}
+	return key, nil
+}
+
+// readDapp returns the registered dapp dappID, or nil if there is none.
+func readDapp(sdk kalpsdk.TransactionContextInterface, dappID string) (*Dapp, error) {
+	key, err := dappKey(sdk, dappID)
+	if err != nil {
+		return nil, err
+	}
+	dappJSON, err := sdk.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read dapp %s: %v", dappID, err)
+	}
+	if dappJSON == nil {
+		return nil, nil
+	}
+	var dapp Dapp
+	if err := json.Unmarshal(dappJSON, &dapp); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal dapp %s: %v", dappID, err)
+	}
+	return &dapp, nil
+}
+
+func writeDapp(sdk kalpsdk.TransactionContextInterface, dapp *Dapp) error {
+	key, err := dappKey(sdk, dapp.DappID)
+	if err != nil {
+		return err
+	}
+	dappJSON, err := json.Marshal(dapp)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := sdk.PutStateWithoutKYC(key, dappJSON); err != nil {
+		return fmt.Errorf("failed to write dapp %s: %v", dapp.DappID, err)
+	}
+	return nil
+}
+
+// accrueDappRevenue attributes a gateway fee to the dapp that caused it and returns the revenue the dapp
+// earned from it. The revenue is paid out of the foundation's balance, so it is a share of what the fee
+// split credits the foundation rather than of the whole fee. Fees of dapps that aren't registered are
+// only recorded in their receipts.
+func accrueDappRevenue(sdk kalpsdk.TransactionContextInterface, dappID string, reference string, fee *big.Int) (*big.Int, error) {
+	dapp, err := readDapp(sdk, dappID)
+	if err != nil || dapp == nil {
+		return nil, err
+	}
+	foundationShare, err := foundationFeeShare(sdk, fee)
+	if err != nil {
+		return nil, err
+	}
+	revenue := big.NewInt(0).Mul(foundationShare, big.NewInt(0).SetUint64(dapp.RevenueShare))
+	revenue.Quo(revenue, big.NewInt(maxBasisPoints))
+	key, err := sdk.CreateCompositeKey(DappAccrualDocType, []string{dappID, reference})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for accrual %s of dapp %s: %v", reference, dappID, err)
+	}
+	accrualJSON, err := json.Marshal(DappAccrual{DappID: dappID, DocType: DappAccrualDocType, Reference: reference, Fee: fee.String(), Revenue: revenue.String()})
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := sdk.PutStateWithoutKYC(key, accrualJSON); err != nil {
+		return nil, fmt.Errorf("failed to write accrual %s of dapp %s: %v", reference, dappID, err)
+	}
+	return revenue, nil
+}
+
+// readDappAccruals sums up to limit accruals of dapp that haven't been claimed yet.
+func readDappAccruals(sdk kalpsdk.TransactionContextInterface, dappID string, limit int) (*dappAccruals, error) {
+	resultsIterator, err := scanPartialCompositeKey(sdk, DappAccrualDocType, []string{dappID})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer resultsIterator.Close()
+	accruals := &dappAccruals{fees: big.NewInt(0), revenue: big.NewInt(0)}
+	for (limit <= 0 || len(accruals.keys) < limit) && resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var accrual DappAccrual
+		if err := json.Unmarshal(queryResult.Value, &accrual); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal value %v", err)
+		}
+		fee, ok := big.NewInt(0).SetString(accrual.Fee, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid fee %s in accrual %s", accrual.Fee, queryResult.Key)
+		}
+		revenue, ok := big.NewInt(0).SetString(accrual.Revenue, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid revenue %s in accrual %s", accrual.Revenue, queryResult.Key)
+		}
+		accruals.fees.Add(accruals.fees, fee)
+		accruals.revenue.Add(accruals.revenue, revenue)
+		accruals.keys = append(accruals.keys, queryResult.Key)
+	}
+	return accruals, nil
+}
+
+// RegisterDapp is a smart contract function which lets the foundation register a dapp, or change the
+// owner and revenue share of a registered one. revenueShare is in basis points of the foundation's share
+// of the gateway fees collected for the dapp from then on. The dapp ID of the fees collected through
+// Transfer can't be registered.
+func (s *SmartContract) RegisterDapp(ctx kalpsdk.TransactionContextInterface, dappId string, owner string, revenueShare uint64) (*Dapp, error) {
+	ctx = NewUnitOfWork(ctx)
+	userValid, err := s.HasPermission(ctx, PermissionRegisterDapp)
+	if err != nil {
+		return nil, fmt.Errorf("error in validating the role %v", err)
+	}
+	if !userValid {
+		return nil, fmt.Errorf("only %s can register dapps", kalpFoundationRole)
+	}
+	if err := requireMultisigProposal(ctx, ActionRegisterDapp); err != nil {
+		return nil, err
+	}
+	return storeDapp(ctx, dappId, owner, revenueShare)
+}
+
+func storeDapp(ctx kalpsdk.TransactionContextInterface, dappId string, owner string, revenueShare uint64) (*Dapp, error) {
+	if err := validateGatewayID("dappId", dappId); err != nil {
+		return nil, err
+	}
+	if dappId == legacyGatewayDappID {
+		return nil, fmt.Errorf("error with status code %v, dapp ID %s is reserved for gateway fees collected through Transfer", http.StatusBadRequest, legacyGatewayDappID)
+	}
+	owner = strings.Trim(owner, " ")
+	if len(owner) != 40 {
+		return nil, fmt.Errorf("address must be 40 characters long")
+	}
+	if strings.ContainsAny(owner, "`~!@#$%^&*()-_+=[]{}\\|;':\",./<>? ") {
+		return nil, fmt.Errorf("invalid address")
+	}
+	if revenueShare > maxBasisPoints {
+		return nil, fmt.Errorf("error with status code %v, revenue share can not exceed %d basis points", http.StatusBadRequest, maxBasisPoints)
+	}
+	key, err := dappKey(ctx, dappId)
+	if err != nil {
+		return nil, err
+	}
+	if err := auditKeyChange(ctx, "RegisterDapp", []string{dappId, owner, fmt.Sprint(revenueShare)}, key); err != nil {
+		return nil, err
+	}
+	dapp, err := readDapp(ctx, dappId)
+	if err != nil {
+		return nil, err
+	}
+	if dapp == nil {
+		dapp = &Dapp{DappID: dappId, DocType: DappDocType, FeesCollected: "0", RevenueAccrued: "0", RevenueClaimed: "0"}
+	}
+	dapp.Owner, dapp.RevenueShare = owner, revenueShare
+	if err := writeDapp(ctx, dapp); err != nil {
+		return nil, err
+	}
+	return dapp, nil
+}
+
+// GetDapp is a smart contract function which returns a registered dapp with the fees collected for it
+// and its revenue.
+func (s *SmartContract) GetDapp(ctx kalpsdk.TransactionContextInterface, dappId string) (*Dapp, error) {
+	ctx = NewQueryContext(ctx)
+	dapp, err := readDapp(ctx, dappId)
+	if err != nil {
+		return nil, err
+	}
+	if dapp == nil {
+		return nil, fmt.Errorf("error with status code %v, dapp %s is not registered", http.StatusNotFound, dappId)
+	}
+	accruals, err := readDappAccruals(ctx, dappId, 0)
+	if err != nil {
+		return nil, err
+	}
+	dapp.FeesCollected = addAmount(dapp.FeesCollected, accruals.fees)
+	dapp.RevenueAccrued = addAmount(dapp.RevenueAccrued, accruals.revenue)
+	return dapp, nil
+}
+
+// ClaimDappRevenue is a smart contract function which pays the owner of a dapp the revenue it has
+// accrued and not claimed yet, out of the foundation's balance. The owner or the foundation can claim it.
+// Claims of more than the multisig transfer threshold need a ClaimDappRevenue proposal.
+func (s *SmartContract) ClaimDappRevenue(ctx kalpsdk.TransactionContextInterface, dappId string) (*DappRevenueClaim, error) {
+	ctx = NewUnitOfWork(ctx)
+	operator, err := GetUserId(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
+	}
+	dapp, err := readDapp(ctx, dappId)
+	if err != nil {
+		return nil, err
+	}
+	if dapp == nil {
+		return nil, fmt.Errorf("error with status code %v, dapp %s is not registered", http.StatusNotFound, dappId)
+	}
+	if operator != dapp.Owner {
+		userValid, err := s.hasPermission(ctx, operator, PermissionClaimDappRevenue)
+		if err != nil {
+			return nil, fmt.Errorf("error in validating the role %v", err)
+		}
+		if !userValid {
+			return nil, fmt.Errorf("error with status code %v, only the owner of dapp %s or %s can claim its revenue", http.StatusBadRequest, dappId, kalpFoundationRole)
+		}
+		key, err := dappKey(ctx, dappId)
+		if err != nil {
+			return nil, err
+		}
+		if err := auditKeyChange(ctx, "ClaimDappRevenue", []string{dappId}, key); err != nil {
+			return nil, err
+		}
+	}
+	unclaimed, err := unclaimedDappRevenue(ctx, dapp)
+	if err != nil {
+		return nil, err
+	}
+	foundation, err := foundationAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkFoundationTransfer(ctx, foundation, unclaimed.revenue); err != nil {
+		return nil, err
+	}
+	return payDappRevenue(ctx, dapp, unclaimed)
+}
+
+// unclaimedDappRevenue returns the accruals of dapp a claim pays.
+func unclaimedDappRevenue(sdk kalpsdk.TransactionContextInterface, dapp *Dapp) (*dappAccruals, error) {
+	accruals, err := readDappAccruals(sdk, dapp.DappID, maxDappClaimAccruals)
+	if err != nil {
+		return nil, err
+	}
+	if accruals.revenue.Sign() <= 0 {
+		return nil, fmt.Errorf("error with status code %v, dapp %s has no revenue to claim", http.StatusBadRequest, dapp.DappID)
+	}
+	return accruals, nil
+}
+
+// payDappRevenue pays the owner of dapp the revenue of accruals out of the foundation's balance, and
+// adds them to the dapp's record.
+func payDappRevenue(ctx kalpsdk.TransactionContextInterface, dapp *Dapp, accruals *dappAccruals) (*DappRevenueClaim, error) {
+	dappId := dapp.DappID
+	unclaimed := accruals.revenue
+	foundation, err := foundationAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := RemoveUtxo(ctx, foundation, unclaimed); err != nil {
+		return nil, fmt.Errorf("error with status code %v, error:error while reducing balance %v", http.StatusBadRequest, err)
+	}
+	if err := AddUtxo(ctx, dapp.Owner, unclaimed); err != nil {
+		return nil, fmt.Errorf("error with status code %v, error:error while adding balance %v", http.StatusBadRequest, err)
+	}
+	for _, key := range accruals.keys {
+		if err := ctx.DelStateWithoutKYC(key); err != nil {
+			return nil, fmt.Errorf("failed to delete accrual %s: %v", key, err)
+		}
+	}
+	dapp.FeesCollected = addAmount(dapp.FeesCollected, accruals.fees)
+	dapp.RevenueAccrued = addAmount(dapp.RevenueAccrued, unclaimed)
+	dapp.RevenueClaimed = addAmount(dapp.RevenueClaimed, unclaimed)
+	if err := writeDapp(ctx, dapp); err != nil {
+		return nil, err
+	}
+	claim := &DappRevenueClaim{DappID: dappId, Owner: dapp.Owner, Amount: unclaimed.String()}
+	claimJSON, err := json.Marshal(claim)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := ctx.SetEvent("DappRevenueClaimed", claimJSON); err != nil {
+		return nil, fmt.Errorf("failed to set event: %v", err)
+	}
+	return claim, nil
+}
@@ -0,0 +1,122 @@
+package kalpAccounting
+
+import (
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func registerDapp(l *fakeledger.Ledger, s *SmartContract, dappID, owner string, revenueShare uint64) error {
+	return l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.RegisterDapp(ctx, dappID, owner, revenueShare)
+		return err
+	})
+}
+
+func claimDappRevenue(l *fakeledger.Ledger, s *SmartContract, operator, dappID string) (*DappRevenueClaim, error) {
+	var claim *DappRevenueClaim
+	err := l.Submit(operator, func(ctx *fakeledger.TransactionContext) error {
+		var err error
+		claim, err = s.ClaimDappRevenue(ctx, dappID)
+		return err
+	})
+	return claim, err
+}
+
+func TestDappRevenueSharing(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	require.Error(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.RegisterDapp(ctx, "dapp-1", dapp, 2500)
+		return err
+	}), "only the foundation registers dapps")
+	require.Error(t, registerDapp(l, s, "dapp-1", dapp, 10001))
+	require.Error(t, registerDapp(l, s, "dapp-1", "dapp", 2500))
+	require.Error(t, registerDapp(l, s, legacyGatewayDappID, dapp, 2500))
+	require.NoError(t, registerDapp(l, s, "dapp-1", dapp, 2500))
+
+	receipt, err := collectGatewayFeeAs(l, s, intialkalpGateWayadmin, alice, "1000", "dapp-1", "order-1")
+	require.NoError(t, err)
+	require.Equal(t, "250", receipt.DappRevenue)
+	_, err = collectGatewayFeeAs(l, s, intialkalpGateWayadmin, alice, "999", "dapp-1", "order-2")
+	require.NoError(t, err)
+	receipt, err = collectGatewayFeeAs(l, s, intialkalpGateWayadmin, alice, "1000", "dapp-2", "order-1")
+	require.NoError(t, err)
+	require.Empty(t, receipt.DappRevenue, "unregistered dapps earn nothing")
+
+	registered, err := s.GetDapp(l.NewTransaction(alice), "dapp-1")
+	require.NoError(t, err)
+	require.Equal(t, "1999", registered.FeesCollected)
+	require.Equal(t, "499", registered.RevenueAccrued)
+	_, err = s.GetDapp(l.NewTransaction(alice), "dapp-2")
+	require.Error(t, err)
+
+	_, err = claimDappRevenue(l, s, bob, "dapp-1")
+	require.Error(t, err, "only the owner or the foundation claims")
+	foundationBalance := balanceOf(t, l, s, kalpFoundation)
+	claim, err := claimDappRevenue(l, s, dapp, "dapp-1")
+	require.NoError(t, err)
+	require.Equal(t, &DappRevenueClaim{DappID: "dapp-1", Owner: dapp, Amount: "499"}, claim)
+	require.Equal(t, "499", balanceOf(t, l, s, dapp))
+	require.Equal(t, sum(foundationBalance, "-499"), balanceOf(t, l, s, kalpFoundation))
+	require.Equal(t, "DappRevenueClaimed", lastEvent(t, l).Name)
+	_, err = claimDappRevenue(l, s, dapp, "dapp-1")
+	require.Error(t, err, "nothing left to claim")
+
+	// A new owner and share apply to fees collected from then on.
+	require.NoError(t, registerDapp(l, s, "dapp-1", carol, 5000))
+	_, err = collectGatewayFeeAs(l, s, intialkalpGateWayadmin, alice, "100", "dapp-1", "order-3")
+	require.NoError(t, err)
+	claim, err = claimDappRevenue(l, s, kalpFoundation, "dapp-1")
+	require.NoError(t, err)
+	require.Equal(t, "50", claim.Amount)
+	require.Equal(t, "50", balanceOf(t, l, s, carol))
+}
+
+func TestDappRevenueFromFoundationShare(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	require.NoError(t, setGasFeeSplit(l, s, `[{"recipient":"`+kalpFoundation+`","basisPoints":7000},{"recipient":"`+BurnAddress+`","basisPoints":3000}]`))
+	require.NoError(t, registerDapp(l, s, "dapp-1", dapp, 10000))
+
+	// The foundation keeps 700 of the fee, and that is all the dapp can earn.
+	foundationBalance := balanceOf(t, l, s, kalpFoundation)
+	receipt, err := collectGatewayFeeAs(l, s, intialkalpGateWayadmin, alice, "1000", "dapp-1", "order-1")
+	require.NoError(t, err)
+	require.Equal(t, "700", receipt.DappRevenue)
+	claim, err := claimDappRevenue(l, s, dapp, "dapp-1")
+	require.NoError(t, err)
+	require.Equal(t, "700", claim.Amount)
+	require.Equal(t, foundationBalance, balanceOf(t, l, s, kalpFoundation))
+}
+
+func TestConcurrentGatewayFeesOfOneDapp(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	require.NoError(t, transfer(l, s, kalpFoundation, bob, "5000000000000000000"))
+	require.NoError(t, registerDapp(l, s, "dapp-1", dapp, 2500))
+
+	// Both fees are endorsed before either is committed, and only add their own accrual.
+	first := l.NewTransaction(intialkalpGateWayadmin)
+	_, err := s.CollectGatewayFee(first, alice, "1000", "dapp-1", "order-1")
+	require.NoError(t, err)
+	second := l.NewTransaction(intialkalpGateWayadmin)
+	_, err = s.CollectGatewayFee(second, bob, "1000", "dapp-1", "order-2")
+	require.NoError(t, err)
+	require.NoError(t, first.Commit())
+	require.NoError(t, second.Commit())
+
+	registered, err := s.GetDapp(l.NewTransaction(alice), "dapp-1")
+	require.NoError(t, err)
+	require.Equal(t, "2000", registered.FeesCollected)
+	require.Equal(t, "500", registered.RevenueAccrued)
+	claim, err := claimDappRevenue(l, s, dapp, "dapp-1")
+	require.NoError(t, err)
+	require.Equal(t, "500", claim.Amount)
+	registered, err = s.GetDapp(l.NewTransaction(alice), "dapp-1")
+	require.NoError(t, err)
+	require.Equal(t, "2000", registered.FeesCollected)
+	require.Equal(t, "500", registered.RevenueClaimed)
+}
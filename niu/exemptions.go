@@ -0,0 +1,193 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const FeeExemptionDocType = "FeeExemption"
+
+// FeeExemption is an address that neither pays gas fees when it sends nor has them deducted when it
+// receives.
+type FeeExemption struct {
+	Address string `json:"address"`
+	DocType string `json:"docType"`
+	Reason  string `json:"reason"`
+	AddedBy string `json:"addedBy"`
+}
+
+func feeExemptionKey(sdk kalpsdk.TransactionContextInterface, address string) (string, error) {
+	key, err := sdk.CreateCompositeKey(FeeExemptionDocType, []string{address})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for fee exemption of %s: %v", address, err)
+	}
+	return key, nil
+}
+
+// isFeeExempt reports whether address is in the fee exemption registry. The foundation collects the gas
+// fees and is always exempt.
+func isFeeExempt(sdk kalpsdk.TransactionContextInterface, address string) (bool, error) {
+	foundation, err := foundationAddress(sdk)
+	if err != nil {
+		return false, err
+	}
+	if address == foundation {
+		return true, nil
+	}
+	key, err := feeExemptionKey(sdk, address)
+	if err != nil {
+		return false, err
+	}
+	exemption, err := sdk.GetState(key)
+	if err != nil {
+		return false, fmt.Errorf("failed to read fee exemption of %s: %v", address, err)
+	}
+	return exemption != nil, nil
+}
+
+// AddFeeExemption is a smart contract function which lets the gas fees admin exempt an address, e.g. a
+// treasury or exchange wallet or a chaincode account, from gas fees.
+func (s *SmartContract) AddFeeExemption(ctx kalpsdk.TransactionContextInterface, address string, reason string) error {
+	ctx = NewUnitOfWork(ctx)
+	operator, err := s.requirePermission(ctx, PermissionManageFeeExemptions)
+	if err != nil {
+		return err
+	}
+	if err := requireMultisigProposal(ctx, ActionAddFeeExemption); err != nil {
+		return err
+	}
+	return storeFeeExemption(ctx, operator, address, reason)
+}
+
+func storeFeeExemption(ctx kalpsdk.TransactionContextInterface, operator string, address string, reason string) error {
+	address = strings.Trim(address, " ")
+	if address == "" {
+		return fmt.Errorf("invalid input address")
+	}
+	if len(address) != 40 && !strings.HasPrefix(address, "klp-") {
+		return fmt.Errorf("address must be 40 characters long or a chaincode address")
+	}
+	key, err := feeExemptionKey(ctx, address)
+	if err != nil {
+		return err
+	}
+	if err := auditKeyChange(ctx, "AddFeeExemption", []string{address, reason}, key); err != nil {
+		return err
+	}
+	exemptionJSON, err := json.Marshal(FeeExemption{Address: address, DocType: FeeExemptionDocType, Reason: reason, AddedBy: operator})
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := ctx.PutStateWithoutKYC(key, exemptionJSON); err != nil {
+		return fmt.Errorf("failed to add fee exemption: %v", err)
+	}
+	return nil
+}
+
+// RemoveFeeExemption is a smart contract function which lets the gas fees admin remove an address from
+// the fee exemption registry.
+func (s *SmartContract) RemoveFeeExemption(ctx kalpsdk.TransactionContextInterface, address string) error {
+	ctx = NewUnitOfWork(ctx)
+	if _, err := s.requirePermission(ctx, PermissionManageFeeExemptions); err != nil {
+		return err
+	}
+	if err := requireMultisigProposal(ctx, ActionRemoveFeeExemption); err != nil {
+		return err
+	}
+	return deleteFeeExemption(ctx, address)
+}
+
+func deleteFeeExemption(ctx kalpsdk.TransactionContextInterface, address string) error {
+	address = strings.Trim(address, " ")
+	key, err := feeExemptionKey(ctx, address)
+	if err != nil {
+		return err
+	}
+	exemption, err := ctx.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read fee exemption of %s: %v", address, err)
+	}
+	if exemption == nil {
+		return fmt.Errorf("error with status code %v, %s is not fee exempt", http.StatusBadRequest, address)
+	}
+	if err := recordAdminAudit(ctx, "RemoveFeeExemption", []string{address}, exemption); err != nil {
+		return err
+	}
+	if err := ctx.DelStateWithoutKYC(key); err != nil {
+		return fmt.Errorf("failed to remove fee exemption: %v", err)
+	}
+	return nil
+}
+
+// moveFeeExemption moves the registry entry of previous, if it has one, to address when the foundation
+// moves, so the old foundation address isn't left exempt.
+func moveFeeExemption(sdk kalpsdk.TransactionContextInterface, function string, args []string, previous string, address string) error {
+	previousKey, err := feeExemptionKey(sdk, previous)
+	if err != nil {
+		return err
+	}
+	exemptionJSON, err := sdk.GetState(previousKey)
+	if err != nil {
+		return fmt.Errorf("failed to read fee exemption of %s: %v", previous, err)
+	}
+	if exemptionJSON == nil {
+		return nil
+	}
+	var exemption FeeExemption
+	if err := json.Unmarshal(exemptionJSON, &exemption); err != nil {
+		return fmt.Errorf("failed to unmarshal fee exemption of %s: %v", previous, err)
+	}
+	if err := recordAdminAudit(sdk, function, args, exemptionJSON); err != nil {
+		return err
+	}
+	if err := sdk.DelStateWithoutKYC(previousKey); err != nil {
+		return fmt.Errorf("failed to remove fee exemption: %v", err)
+	}
+	key, err := feeExemptionKey(sdk, address)
+	if err != nil {
+		return err
+	}
+	existing, err := sdk.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read fee exemption of %s: %v", address, err)
+	}
+	if existing != nil {
+		return nil
+	}
+	exemption.Address = address
+	if exemptionJSON, err = json.Marshal(exemption); err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := sdk.PutStateWithoutKYC(key, exemptionJSON); err != nil {
+		return fmt.Errorf("failed to add fee exemption: %v", err)
+	}
+	return nil
+}
+
+// ListFeeExemptions is a smart contract function which returns the fee exemption registry. The
+// foundation is always exempt and is not listed.
+func (s *SmartContract) ListFeeExemptions(ctx kalpsdk.TransactionContextInterface) ([]FeeExemption, error) {
+	ctx = NewQueryContext(ctx)
+	resultsIterator, err := scanPartialCompositeKey(ctx, FeeExemptionDocType, []string{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer resultsIterator.Close()
+	exemptions := []FeeExemption{}
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var exemption FeeExemption
+		if err := json.Unmarshal(queryResult.Value, &exemption); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal value %v", err)
+		}
+		exemptions = append(exemptions, exemption)
+	}
+	return exemptions, nil
+}
@@ -0,0 +1,68 @@
+package kalpAccounting
+
+import (
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func addFeeExemption(l *fakeledger.Ledger, s *SmartContract, address string) error {
+	return l.Submit(intialgasfeesadmin, func(ctx *fakeledger.TransactionContext) error {
+		return s.AddFeeExemption(ctx, address, "treasury")
+	})
+}
+
+func TestFeeExemptionRegistry(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.Error(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		return s.AddFeeExemption(ctx, alice, "treasury")
+	}), "only the gas fees admin manages exemptions")
+	require.Error(t, addFeeExemption(l, s, "alice"))
+
+	require.NoError(t, addFeeExemption(l, s, alice))
+	require.NoError(t, addFeeExemption(l, s, BridgeContractAddress))
+	exemptions, err := s.ListFeeExemptions(l.NewTransaction(bob))
+	require.NoError(t, err)
+	require.Len(t, exemptions, 2)
+	require.Equal(t, FeeExemption{Address: alice, DocType: FeeExemptionDocType, Reason: "treasury", AddedBy: intialgasfeesadmin}, exemptions[0])
+
+	require.NoError(t, l.Submit(intialgasfeesadmin, func(ctx *fakeledger.TransactionContext) error {
+		return s.RemoveFeeExemption(ctx, BridgeContractAddress)
+	}))
+	require.Error(t, l.Submit(intialgasfeesadmin, func(ctx *fakeledger.TransactionContext) error {
+		return s.RemoveFeeExemption(ctx, BridgeContractAddress)
+	}))
+	exemptions, err = s.ListFeeExemptions(l.NewTransaction(bob))
+	require.NoError(t, err)
+	require.Len(t, exemptions, 1)
+}
+
+func TestFeeExemptTransfers(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	require.NoError(t, addFeeExemption(l, s, alice))
+
+	require.NoError(t, transfer(l, s, alice, bob, "2000000000000000000"))
+	require.Equal(t, "2000000000000000000", balanceOf(t, l, s, bob), "exempt senders pay no fee")
+	require.NoError(t, transfer(l, s, bob, alice, "1000000000000000000"))
+	require.Equal(t, "1000000000000000000", balanceOf(t, l, s, bob), "exempt receivers are credited in full")
+	require.Equal(t, "4000000000000000000", balanceOf(t, l, s, alice))
+
+	require.NoError(t, transfer(l, s, bob, carol, "500000000000000000"))
+	require.Equal(t, sum("500000000000000000", "-"+initialGasFees), balanceOf(t, l, s, carol))
+
+	inputs := []string{}
+	for _, u := range listUtxos(t, l, s, bob, 10, "").Utxos {
+		inputs = append(inputs, u.Key)
+	}
+	require.NoError(t, l.Submit(bob, func(ctx *fakeledger.TransactionContext) error {
+		transfer, err := s.TransferUtxos(ctx, inputs, []UtxoOutput{{Account: alice, Amount: "100"}, {Account: carol, Amount: "2000000000000000"}})
+		if err != nil {
+			return err
+		}
+		require.Equal(t, initialGasFees, transfer.Fee, "only the output to carol is charged")
+		return nil
+	}))
+}
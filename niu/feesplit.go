@@ -0,0 +1,221 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const gasFeeSplitKey = "gasFeeSplit"
+
+// BurnAddress receives the burned share of gas fees. Nobody holds its key, so tokens sent to it are out
+// of circulation and TotalSupply excludes them.
+const BurnAddress = "0000000000000000000000000000000000000000"
+
+const maxFeeSplitRecipients = 10
+
+// FeeShare is a recipient of gas fees and its share of every fee in basis points. In a transfer event
+// Amount is the part of the fee the recipient was credited.
+type FeeShare struct {
+	Recipient   string `json:"recipient"`
+	BasisPoints uint64 `json:"basisPoints"`
+	Amount      string `json:"amount,omitempty"`
+}
+
+// defaultFeeSplit sends every fee to the foundation, as before fee splits.
+func defaultFeeSplit(foundation string) []FeeShare {
+	return []FeeShare{{Recipient: foundation, BasisPoints: maxBasisPoints}}
+}
+
+func validateFeeSplit(split []FeeShare) error {
+	if len(split) == 0 || len(split) > maxFeeSplitRecipients {
+		return fmt.Errorf("fee split must have between 1 and %d recipients", maxFeeSplitRecipients)
+	}
+	var total uint64
+	seen := map[string]bool{}
+	for _, share := range split {
+		if len(share.Recipient) != 40 {
+			return fmt.Errorf("recipient %q must be 40 characters long", share.Recipient)
+		}
+		if strings.ContainsAny(share.Recipient, "`~!@#$%^&*()-_+=[]{}\\|;':\",./<>? ") {
+			return fmt.Errorf("invalid recipient %q", share.Recipient)
+		}
+		if seen[share.Recipient] {
+			return fmt.Errorf("recipient %s is listed twice", share.Recipient)
+		}
+		seen[share.Recipient] = true
+		if share.BasisPoints == 0 || share.BasisPoints > maxBasisPoints {
+			return fmt.Errorf("share of %s must be between 1 and %d basis points", share.Recipient, maxBasisPoints)
+		}
+		total += share.BasisPoints
+	}
+	if total != maxBasisPoints {
+		return fmt.Errorf("fee split adds up to %d basis points instead of %d", total, maxBasisPoints)
+	}
+	return nil
+}
+
+func getFeeSplit(sdk kalpsdk.TransactionContextInterface) ([]FeeShare, error) {
+	splitJSON, err := sdk.GetState(gasFeeSplitKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read fee split: %v", err)
+	}
+	if splitJSON == nil {
+		foundation, err := foundationAddress(sdk)
+		if err != nil {
+			return nil, err
+		}
+		return defaultFeeSplit(foundation), nil
+	}
+	var split []FeeShare
+	if err := json.Unmarshal(splitJSON, &split); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal fee split: %v", err)
+	}
+	return split, nil
+}
+
+// moveFeeSplitShare gives the share of previous in the stored fee split to address, adding it to the
+// share address already has, when the foundation moves. A split that was never set names the foundation
+// when it is read and is left alone.
+func moveFeeSplitShare(sdk kalpsdk.TransactionContextInterface, function string, args []string, previous string, address string) error {
+	splitJSON, err := sdk.GetState(gasFeeSplitKey)
+	if err != nil {
+		return fmt.Errorf("failed to read fee split: %v", err)
+	}
+	if splitJSON == nil {
+		return nil
+	}
+	var split []FeeShare
+	if err := json.Unmarshal(splitJSON, &split); err != nil {
+		return fmt.Errorf("failed to unmarshal fee split: %v", err)
+	}
+	moved := -1
+	for i := range split {
+		if split[i].Recipient == previous {
+			moved = i
+		}
+	}
+	if moved < 0 {
+		return nil
+	}
+	for i := range split {
+		if split[i].Recipient == address {
+			split[i].BasisPoints += split[moved].BasisPoints
+			split = append(split[:moved], split[moved+1:]...)
+			moved = -1
+			break
+		}
+	}
+	if moved >= 0 {
+		split[moved].Recipient = address
+	}
+	if err := auditKeyChange(sdk, function, args, gasFeeSplitKey); err != nil {
+		return err
+	}
+	if splitJSON, err = json.Marshal(split); err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := sdk.PutStateWithoutKYC(gasFeeSplitKey, splitJSON); err != nil {
+		return fmt.Errorf("failed to set fee split: %v", err)
+	}
+	return nil
+}
+
+// foundationFeeShare returns the part of fee distributeFee credits to the foundation, leaving out the
+// rounding remainder.
+func foundationFeeShare(sdk kalpsdk.TransactionContextInterface, fee *big.Int) (*big.Int, error) {
+	split, err := getFeeSplit(sdk)
+	if err != nil {
+		return nil, err
+	}
+	foundation, err := foundationAddress(sdk)
+	if err != nil {
+		return nil, err
+	}
+	share := big.NewInt(0)
+	for _, recipient := range split {
+		if recipient.Recipient == foundation {
+			share.Mul(fee, big.NewInt(0).SetUint64(recipient.BasisPoints))
+			share.Quo(share, big.NewInt(maxBasisPoints))
+		}
+	}
+	return share, nil
+}
+
+// distributeFee credits fee to the recipients of the fee split and returns what each was credited. The
+// rounding remainder goes to the first recipient. The distribution is reported in the transfer event.
+func distributeFee(sdk kalpsdk.TransactionContextInterface, fee *big.Int) ([]FeeShare, error) {
+	split, err := getFeeSplit(sdk)
+	if err != nil {
+		return nil, err
+	}
+	amounts := make([]*big.Int, len(split))
+	remainder := big.NewInt(0).Set(fee)
+	for i, share := range split {
+		amounts[i] = big.NewInt(0).Mul(fee, big.NewInt(0).SetUint64(share.BasisPoints))
+		amounts[i].Quo(amounts[i], big.NewInt(maxBasisPoints))
+		remainder.Sub(remainder, amounts[i])
+	}
+	amounts[0].Add(amounts[0], remainder)
+	for i := range split {
+		split[i].Amount = amounts[i].String()
+		if amounts[i].Sign() == 0 {
+			continue
+		}
+		if err := AddUtxo(sdk, split[i].Recipient, amounts[i]); err != nil {
+			return nil, fmt.Errorf("error with status code %v, error:error while adding balance %v", http.StatusBadRequest, err)
+		}
+	}
+	if uow, ok := sdk.(*UnitOfWork); ok {
+		uow.feeShares = append(uow.feeShares, split...)
+	}
+	return split, nil
+}
+
+// GetGasFeeSplit is a smart contract function which returns how gas fees are split between recipients.
+func (s *SmartContract) GetGasFeeSplit(ctx kalpsdk.TransactionContextInterface) ([]FeeShare, error) {
+	return getFeeSplit(ctx)
+}
+
+// SetGasFeeSplit is a smart contract function which lets the gas fees admin set how gas fees are split.
+// It takes a JSON list of recipients and basis points adding up to 10000, e.g.
+// [{"recipient":"<foundation>","basisPoints":7000},{"recipient":"<burn address>","basisPoints":3000}].
+func (s *SmartContract) SetGasFeeSplit(ctx kalpsdk.TransactionContextInterface, split string) error {
+	ctx = NewUnitOfWork(ctx)
+	if _, err := s.requirePermission(ctx, PermissionSetGasFeeSplit); err != nil {
+		return err
+	}
+	if err := requireMultisigProposal(ctx, ActionSetGasFeeSplit); err != nil {
+		return err
+	}
+	return storeGasFeeSplit(ctx, split)
+}
+
+func storeGasFeeSplit(ctx kalpsdk.TransactionContextInterface, split string) error {
+	var shares []FeeShare
+	if err := json.Unmarshal([]byte(split), &shares); err != nil {
+		return fmt.Errorf("error with status code %v, invalid fee split: %v", http.StatusBadRequest, err)
+	}
+	for i := range shares {
+		shares[i].Recipient = strings.Trim(shares[i].Recipient, " ")
+		shares[i].Amount = ""
+	}
+	if err := validateFeeSplit(shares); err != nil {
+		return fmt.Errorf("error with status code %v, %v", http.StatusBadRequest, err)
+	}
+	if err := auditKeyChange(ctx, "SetGasFeeSplit", []string{split}, gasFeeSplitKey); err != nil {
+		return err
+	}
+	splitJSON, err := json.Marshal(shares)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := ctx.PutStateWithoutKYC(gasFeeSplitKey, splitJSON); err != nil {
+		return fmt.Errorf("failed to set fee split: %v", err)
+	}
+	return nil
+}
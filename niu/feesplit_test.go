@@ -0,0 +1,70 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setGasFeeSplit(l *fakeledger.Ledger, s *SmartContract, split string) error {
+	return l.Submit(intialgasfeesadmin, func(ctx *fakeledger.TransactionContext) error {
+		return s.SetGasFeeSplit(ctx, split)
+	})
+}
+
+func TestSetGasFeeSplit(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	split, err := s.GetGasFeeSplit(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, []FeeShare{{Recipient: kalpFoundation, BasisPoints: 10000}}, split)
+
+	for _, invalid := range []string{
+		`[]`,
+		`[{"recipient":"` + kalpFoundation + `","basisPoints":9999}]`,
+		`[{"recipient":"` + kalpFoundation + `","basisPoints":5000},{"recipient":"` + kalpFoundation + `","basisPoints":5000}]`,
+		`[{"recipient":"` + kalpFoundation + `","basisPoints":10000},{"recipient":"` + carol + `","basisPoints":0}]`,
+		`[{"recipient":"carol","basisPoints":10000}]`,
+		`{"recipient":"` + kalpFoundation + `"}`,
+	} {
+		require.Error(t, setGasFeeSplit(l, s, invalid), invalid)
+	}
+	require.Error(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		return s.SetGasFeeSplit(ctx, `[{"recipient":"`+carol+`","basisPoints":10000}]`)
+	}), "only the gas fees admin sets the split")
+}
+
+func TestGasFeeSplitDistribution(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	require.NoError(t, setGasFeeSplit(l, s, `[
+		{"recipient":"`+kalpFoundation+`","basisPoints":5000},
+		{"recipient":"`+carol+`","basisPoints":3000},
+		{"recipient":"`+BurnAddress+`","basisPoints":2000}]`))
+	foundationBalance := balanceOf(t, l, s, kalpFoundation)
+
+	require.NoError(t, transfer(l, s, alice, bob, "2000000000000000000"))
+	require.Equal(t, "1999000000000000000", balanceOf(t, l, s, bob))
+	require.Equal(t, sum(foundationBalance, "500000000000000"), balanceOf(t, l, s, kalpFoundation))
+	require.Equal(t, "300000000000000", balanceOf(t, l, s, carol))
+	require.Equal(t, "200000000000000", balanceOf(t, l, s, BurnAddress))
+	supply, err := s.TotalSupply(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, sum(totalSupply, "-200000000000000"), supply)
+
+	var event TransferSingle
+	require.NoError(t, json.Unmarshal(lastEvent(t, l).Payload, &event))
+	require.Equal(t, []FeeShare{
+		{Recipient: kalpFoundation, BasisPoints: 5000, Amount: "500000000000000"},
+		{Recipient: carol, BasisPoints: 3000, Amount: "300000000000000"},
+		{Recipient: BurnAddress, BasisPoints: 2000, Amount: "200000000000000"},
+	}, event.FeeSplit)
+
+	// The gateway fee is split too, and the rounding remainder goes to the first recipient.
+	require.NoError(t, setGasFeeSplit(l, s, `[{"recipient":"`+carol+`","basisPoints":5000},{"recipient":"`+BurnAddress+`","basisPoints":5000}]`))
+	require.NoError(t, transfer(l, s, intialkalpGateWayadmin, `{"sender":"`+alice+`"}`, "7"))
+	require.Equal(t, sum("300000000000000", "4"), balanceOf(t, l, s, carol))
+	require.Equal(t, sum("200000000000000", "3"), balanceOf(t, l, s, BurnAddress))
+}
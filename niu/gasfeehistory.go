@@ -0,0 +1,166 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const GasFeeRecordDocType = "GasFeeRecord"
+
+// Sources of gas fee changes.
+const (
+	GasFeeInitialized = "initialized"
+	GasFeeSet         = "set"
+	GasFeeScheduled   = "scheduled"
+	// GasFeePending is a scheduled change that hasn't been applied yet. It isn't stored in the history.
+	GasFeePending = "pending"
+)
+
+// GasFeeRecord is an entry of the gas fee history. Old is the policy that applied before EffectiveAt and
+// is empty for the policy set by Initialize. Timestamp is when the record was written, which for a
+// scheduled change is when it was first applied, after EffectiveAt.
+type GasFeeRecord struct {
+	DocType     string        `json:"docType"`
+	Source      string        `json:"source"`
+	Operator    string        `json:"operator"`
+	Old         *GasFeePolicy `json:"old,omitempty"`
+	New         GasFeePolicy  `json:"new"`
+	EffectiveAt int64         `json:"effectiveAt"`
+	TxID        string        `json:"txId"`
+	Timestamp   int64         `json:"timestamp"`
+}
+
+// gasFeeRecordKey orders the history by EffectiveAt. Records are never overwritten, so the transaction
+// ID and source make the key unique.
+func gasFeeRecordKey(sdk kalpsdk.TransactionContextInterface, record *GasFeeRecord) (string, error) {
+	key, err := sdk.CreateCompositeKey(GasFeeRecordDocType, []string{fmt.Sprintf("%020d", record.EffectiveAt), record.TxID, record.Source})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for gas fee record: %v", err)
+	}
+	return key, nil
+}
+
+// changeGasFeePolicy stores policy as the gas fee policy and records the change in the gas fee history.
+func changeGasFeePolicy(sdk kalpsdk.TransactionContextInterface, source string, operator string, policy *GasFeePolicy, effectiveAt int64) (*GasFeeRecord, error) {
+	now, err := txTime(sdk)
+	if err != nil {
+		return nil, err
+	}
+	record := &GasFeeRecord{
+		DocType:     GasFeeRecordDocType,
+		Source:      source,
+		Operator:    operator,
+		New:         *policy,
+		EffectiveAt: effectiveAt,
+		TxID:        sdk.GetTxID(),
+		Timestamp:   now,
+	}
+	oldJSON, err := sdk.GetState(gasFeesKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Gas Fee: %v", err)
+	}
+	if oldJSON != nil {
+		if record.Old, err = parseGasFeePolicy(string(oldJSON)); err != nil {
+			return nil, err
+		}
+	}
+	key, err := gasFeeRecordKey(sdk, record)
+	if err != nil {
+		return nil, err
+	}
+	existing, err := sdk.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gas fee record: %v", err)
+	}
+	if existing != nil {
+		return nil, fmt.Errorf("gas fee record %s already exists", key)
+	}
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := sdk.PutStateWithoutKYC(key, recordJSON); err != nil {
+		return nil, fmt.Errorf("failed to record gas fee change: %v", err)
+	}
+	if err := putGasFeePolicy(sdk, policy); err != nil {
+		return nil, err
+	}
+	return record, nil
+}
+
+func emitGasFeeChanged(sdk kalpsdk.TransactionContextInterface, record *GasFeeRecord) error {
+	recordJSON, err := json.Marshal(record)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := sdk.SetEvent("GasFeeChanged", recordJSON); err != nil {
+		return fmt.Errorf("failed to set event: %v", err)
+	}
+	return nil
+}
+
+// GetGasFeeHistory is a smart contract function which returns the gas fee changes that took effect
+// between from and to, in seconds since the epoch, in the order they took effect. Each change is recorded
+// by the transaction that applied it. The scheduled change that hasn't been applied yet is returned last
+// with the source pending if it takes effect between from and to, whether or not its time has come.
+func (s *SmartContract) GetGasFeeHistory(ctx kalpsdk.TransactionContextInterface, from int64, to int64) ([]GasFeeRecord, error) {
+	ctx = NewQueryContext(ctx)
+	if from > to {
+		return nil, fmt.Errorf("error with status code %v, from %d is after to %d", http.StatusBadRequest, from, to)
+	}
+	// The keys start with EffectiveAt, so only the records between from and to are read.
+	startKey, err := ctx.CreateCompositeKey(GasFeeRecordDocType, []string{fmt.Sprintf("%020d", from)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for gas fee record: %v", err)
+	}
+	endKey, err := ctx.CreateCompositeKey(GasFeeRecordDocType, []string{fmt.Sprintf("%020d", to)})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the composite key for gas fee record: %v", err)
+	}
+	resultsIterator, err := scanPartialCompositeKeyRange(ctx, GasFeeRecordDocType, []string{}, startKey, endKey+string(utf8.MaxRune))
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer resultsIterator.Close()
+	records := []GasFeeRecord{}
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var record GasFeeRecord
+		if err := json.Unmarshal(queryResult.Value, &record); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal value %v", err)
+		}
+		records = append(records, record)
+	}
+
+	change, err := getGasFeeChange(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if change == nil || change.EffectiveAt < from || change.EffectiveAt > to {
+		return records, nil
+	}
+	oldJSON, err := ctx.GetState(gasFeesKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Gas Fee: %v", err)
+	}
+	old, err := parseGasFeePolicy(string(oldJSON))
+	if err != nil {
+		return nil, err
+	}
+	return append(records, GasFeeRecord{
+		DocType:     GasFeeRecordDocType,
+		Source:      GasFeePending,
+		Operator:    change.ScheduledBy,
+		Old:         old,
+		New:         change.Policy,
+		EffectiveAt: change.EffectiveAt,
+		Timestamp:   change.ScheduledAt,
+	}), nil
+}
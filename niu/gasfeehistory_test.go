@@ -0,0 +1,91 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func gasFeeHistory(t *testing.T, l *fakeledger.Ledger, s *SmartContract, from, to int64) []GasFeeRecord {
+	t.Helper()
+	history, err := s.GetGasFeeHistory(l.NewTransaction(alice), from, to)
+	require.NoError(t, err)
+	return history
+}
+
+func TestGasFeeHistory(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	history := gasFeeHistory(t, l, s, 0, l.Now().Unix())
+	require.Len(t, history, 1)
+	require.Equal(t, GasFeeInitialized, history[0].Source)
+	require.Nil(t, history[0].Old)
+	require.Equal(t, initialGasFees, history[0].New.Flat)
+
+	l.Advance(time.Hour)
+	require.NoError(t, setGasFees(l, s, "2000"))
+	event := lastEvent(t, l)
+	require.Equal(t, "GasFeeChanged", event.Name)
+	var changed GasFeeRecord
+	require.NoError(t, json.Unmarshal(event.Payload, &changed))
+	require.Equal(t, intialgasfeesadmin, changed.Operator)
+	require.Equal(t, initialGasFees, changed.Old.Flat)
+	require.Equal(t, "2000", changed.New.Flat)
+	require.Equal(t, GasFeeSet, changed.Source, "setting the gas fees takes effect immediately")
+	setAt := changed.EffectiveAt
+
+	effectiveAt := l.Now().Unix() + minGasFeeChangeDelay + 60
+	require.NoError(t, scheduleGasFeeChange(l, s, "3000", effectiveAt))
+	require.NoError(t, json.Unmarshal(lastEvent(t, l).Payload, &changed))
+	require.Equal(t, effectiveAt, changed.EffectiveAt, "scheduling notifies integrators")
+	require.Equal(t, GasFeePending, changed.Source)
+	require.Len(t, gasFeeHistory(t, l, s, 0, effectiveAt-1), 2, "a pending change isn't history yet")
+	history = gasFeeHistory(t, l, s, 0, effectiveAt)
+	require.Len(t, history, 3)
+	require.Equal(t, GasFeePending, history[2].Source, "the pending change is returned as pending")
+	require.Empty(t, history[2].TxID)
+
+	l.Advance(time.Duration(minGasFeeChangeDelay+60) * time.Second)
+	history = gasFeeHistory(t, l, s, 0, l.Now().Unix())
+	require.Len(t, history, 3)
+	require.Equal(t, GasFeePending, history[2].Source, "a change isn't recorded until a transaction applies it")
+
+	// The first transaction that charges the new fee applies the change and reports it in its event.
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	event = lastEvent(t, l)
+	var transferred TransferSingle
+	require.NoError(t, json.Unmarshal(event.Payload, &transferred))
+	require.NotNil(t, transferred.GasFeeChange)
+	require.Equal(t, "3000", transferred.GasFeeChange.New.Flat)
+	history = gasFeeHistory(t, l, s, 0, l.Now().Unix())
+	require.Len(t, history, 3)
+	require.Equal(t, GasFeeScheduled, history[2].Source)
+	require.Equal(t, event.TxID, history[2].TxID)
+	require.Equal(t, intialgasfeesadmin, history[2].Operator)
+	require.Equal(t, "2000", history[2].Old.Flat)
+	require.Equal(t, "3000", history[2].New.Flat)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	transferred = TransferSingle{}
+	require.NoError(t, json.Unmarshal(lastEvent(t, l).Payload, &transferred))
+	require.Nil(t, transferred.GasFeeChange, "the change is applied once")
+
+	// Applying the scheduled change keeps it in the history, in the order the changes took effect.
+	require.NoError(t, setGasFees(l, s, "4000"))
+	history = gasFeeHistory(t, l, s, 0, l.Now().Unix())
+	require.Len(t, history, 4)
+	require.Equal(t, effectiveAt, history[2].EffectiveAt)
+	require.NotEmpty(t, history[2].TxID)
+	require.Equal(t, "3000", history[3].Old.Flat)
+	require.Equal(t, "4000", history[3].New.Flat)
+
+	history = gasFeeHistory(t, l, s, setAt, effectiveAt)
+	require.Len(t, history, 2)
+	require.Equal(t, "2000", history[0].New.Flat)
+	require.Equal(t, "3000", history[1].New.Flat)
+
+	_, err := s.GetGasFeeHistory(l.NewTransaction(alice), 10, 1)
+	require.Error(t, err)
+}
@@ -0,0 +1,308 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const maxBasisPoints = 10000
+
+const gasFeeChangeKey = "gasFeeChange"
+
+// minGasFeeChangeDelay is the minimum notice, in seconds, of a scheduled gas fee change.
+const minGasFeeChangeDelay = 24 * 60 * 60
+
+// GasFeePolicy is the gas fee charged on a transfer: Flat plus BasisPoints of the amount, raised to Min
+// and capped at Max. An empty Max means the fee is not capped.
+type GasFeePolicy struct {
+	Flat        string `json:"flat"`
+	BasisPoints uint64 `json:"basisPoints"`
+	Min         string `json:"min"`
+	Max         string `json:"max,omitempty"`
+}
+
+// parseGasFeePolicy reads a policy stored under gasFeesKey or passed to SetGasFees. A plain number is a
+// flat fee, which is how gas fees were stored before fee policies.
+func parseGasFeePolicy(data string) (*GasFeePolicy, error) {
+	data = strings.TrimSpace(data)
+	policy := &GasFeePolicy{Flat: "0", Min: "0"}
+	if strings.HasPrefix(data, "{") {
+		if err := json.Unmarshal([]byte(data), policy); err != nil {
+			return nil, fmt.Errorf("invalid gas fee policy: %v", err)
+		}
+	} else {
+		policy.Flat = data
+	}
+	if err := policy.validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
+
+func (p *GasFeePolicy) validate() error {
+	if p.Flat == "" {
+		p.Flat = "0"
+	}
+	if p.Min == "" {
+		p.Min = "0"
+	}
+	flat, ok := big.NewInt(0).SetString(p.Flat, 10)
+	if !ok || flat.Sign() < 0 {
+		return fmt.Errorf("invalid flat gas fee %q", p.Flat)
+	}
+	if p.BasisPoints > maxBasisPoints {
+		return fmt.Errorf("gas fee basis points can not exceed %d", maxBasisPoints)
+	}
+	min, ok := big.NewInt(0).SetString(p.Min, 10)
+	if !ok || min.Sign() < 0 {
+		return fmt.Errorf("invalid minimum gas fee %q", p.Min)
+	}
+	if p.Max != "" {
+		max, ok := big.NewInt(0).SetString(p.Max, 10)
+		if !ok || max.Sign() < 0 {
+			return fmt.Errorf("invalid maximum gas fee %q", p.Max)
+		}
+		if max.Cmp(min) < 0 {
+			return fmt.Errorf("maximum gas fee %v is less than minimum gas fee %v", max, min)
+		}
+	}
+	return nil
+}
+
+// Fee returns the gas fee charged on a transfer of amount.
+func (p *GasFeePolicy) Fee(amount *big.Int) (*big.Int, error) {
+	fee, ok := big.NewInt(0).SetString(p.Flat, 10)
+	if !ok {
+		return nil, fmt.Errorf("gasfee can't be converted to big int")
+	}
+	if p.BasisPoints > 0 {
+		share := big.NewInt(0).Mul(amount, big.NewInt(0).SetUint64(p.BasisPoints))
+		fee.Add(fee, share.Quo(share, big.NewInt(maxBasisPoints)))
+	}
+	if min, ok := big.NewInt(0).SetString(p.Min, 10); ok && fee.Cmp(min) < 0 {
+		fee = min
+	}
+	if p.Max != "" {
+		if max, ok := big.NewInt(0).SetString(p.Max, 10); ok && fee.Cmp(max) > 0 {
+			fee = max
+		}
+	}
+	return fee, nil
+}
+
+// getGasFeePolicy returns the gas fee policy in effect at the time of the transaction: a scheduled change
+// takes effect once its time has come. A transaction with a UnitOfWork applies it, which records it in
+// the gas fee history; reads return it without anything being written.
+func getGasFeePolicy(sdk kalpsdk.TransactionContextInterface) (*GasFeePolicy, error) {
+	if uow, ok := sdk.(*UnitOfWork); ok {
+		if err := applyDueGasFeeChange(uow); err != nil {
+			return nil, err
+		}
+	}
+	change, err := getGasFeeChange(sdk)
+	if err != nil {
+		return nil, err
+	}
+	if change != nil {
+		due, err := change.due(sdk)
+		if err != nil {
+			return nil, err
+		}
+		if due {
+			return &change.Policy, nil
+		}
+	}
+	bytes, err := sdk.GetState(gasFeesKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get Gas Fee: %v", err)
+	}
+	if bytes == nil {
+		return nil, fmt.Errorf("gas fee not set")
+	}
+	return parseGasFeePolicy(string(bytes))
+}
+
+// GasFees is the gas fee policy in effect, with the scheduled change to it if there is one.
+type GasFees struct {
+	GasFeePolicy
+	Upcoming *GasFeeChange `json:"upcoming,omitempty"`
+}
+
+// GasFeeChange is a change of the gas fee policy that takes effect at EffectiveAt, in seconds since the
+// epoch of the transaction timestamp.
+type GasFeeChange struct {
+	Policy      GasFeePolicy `json:"policy"`
+	EffectiveAt int64        `json:"effectiveAt"`
+	ScheduledBy string       `json:"scheduledBy"`
+	ScheduledAt int64        `json:"scheduledAt"`
+}
+
+func (c *GasFeeChange) due(sdk kalpsdk.TransactionContextInterface) (bool, error) {
+	now, err := txTime(sdk)
+	if err != nil {
+		return false, err
+	}
+	return now >= c.EffectiveAt, nil
+}
+
+func getGasFeeChange(sdk kalpsdk.TransactionContextInterface) (*GasFeeChange, error) {
+	changeJSON, err := sdk.GetState(gasFeeChangeKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read scheduled gas fee change: %v", err)
+	}
+	if changeJSON == nil {
+		return nil, nil
+	}
+	var change GasFeeChange
+	if err := json.Unmarshal(changeJSON, &change); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal scheduled gas fee change: %v", err)
+	}
+	return &change, nil
+}
+
+// applyDueGasFeeChange stores a scheduled change that has taken effect as the gas fee policy, so the
+// policy can be changed again, records it in the gas fee history and emits a GasFeeChanged event. A
+// transaction that emits its own event reports the change in it from the UnitOfWork.
+func applyDueGasFeeChange(sdk kalpsdk.TransactionContextInterface) error {
+	change, err := getGasFeeChange(sdk)
+	if err != nil || change == nil {
+		return err
+	}
+	due, err := change.due(sdk)
+	if err != nil || !due {
+		return err
+	}
+	record, err := changeGasFeePolicy(sdk, GasFeeScheduled, change.ScheduledBy, &change.Policy, change.EffectiveAt)
+	if err != nil {
+		return err
+	}
+	if err := sdk.DelStateWithoutKYC(gasFeeChangeKey); err != nil {
+		return fmt.Errorf("failed to delete scheduled gas fee change: %v", err)
+	}
+	if uow, ok := sdk.(*UnitOfWork); ok {
+		uow.gasFeeChange = record
+	}
+	return emitGasFeeChanged(sdk, record)
+}
+
+func putGasFeePolicy(sdk kalpsdk.TransactionContextInterface, policy *GasFeePolicy) error {
+	policyJSON, err := json.Marshal(policy)
+	if err != nil {
+		return fmt.Errorf("failed to marshal gasfees: %v", err)
+	}
+	if err := sdk.PutStateWithoutKYC(gasFeesKey, policyJSON); err != nil {
+		return fmt.Errorf("failed to set gasfees: %v", err)
+	}
+	return nil
+}
+
+// ScheduleGasFeeChange is a smart contract function which lets the gas fees admin change the gas fee
+// policy at effectiveAt, in seconds since the epoch, giving integrators at least minGasFeeChangeDelay of
+// notice. The policy takes the same forms as in SetGasFees. Only one change can be pending at a time.
+func (s *SmartContract) ScheduleGasFeeChange(ctx kalpsdk.TransactionContextInterface, newFee string, effectiveAt int64) (*GasFeeChange, error) {
+	ctx = NewUnitOfWork(ctx)
+	operator, err := s.requirePermission(ctx, PermissionSetGasFees)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireMultisigProposal(ctx, ActionScheduleGasFeeChange); err != nil {
+		return nil, err
+	}
+	return storeGasFeeChange(ctx, operator, newFee, effectiveAt)
+}
+
+// storeGasFeeChange stores a gas fee change taking effect at effectiveAt.
+func storeGasFeeChange(ctx kalpsdk.TransactionContextInterface, operator string, newFee string, effectiveAt int64) (*GasFeeChange, error) {
+	policy, err := parseGasFeePolicy(newFee)
+	if err != nil {
+		return nil, fmt.Errorf("error with status code %v, %v", http.StatusBadRequest, err)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if effectiveAt < now+minGasFeeChangeDelay {
+		return nil, fmt.Errorf("error with status code %v, gas fee change must take effect at least %d seconds after %d", http.StatusBadRequest, minGasFeeChangeDelay, now)
+	}
+	if err := applyDueGasFeeChange(ctx); err != nil {
+		return nil, err
+	}
+	pending, err := getGasFeeChange(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if pending != nil {
+		return nil, fmt.Errorf("error with status code %v, a gas fee change is already scheduled for %d, cancel it first", http.StatusBadRequest, pending.EffectiveAt)
+	}
+	if err := auditKeyChange(ctx, "ScheduleGasFeeChange", []string{newFee, fmt.Sprint(effectiveAt)}, gasFeesKey); err != nil {
+		return nil, err
+	}
+	change := &GasFeeChange{Policy: *policy, EffectiveAt: effectiveAt, ScheduledBy: operator, ScheduledAt: now}
+	changeJSON, err := json.Marshal(change)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := ctx.PutStateWithoutKYC(gasFeeChangeKey, changeJSON); err != nil {
+		return nil, fmt.Errorf("failed to schedule gas fee change: %v", err)
+	}
+	current, err := getGasFeePolicy(ctx)
+	if err != nil {
+		return nil, err
+	}
+	// The change is recorded in the history once it is applied, but integrators are notified now.
+	if err := emitGasFeeChanged(ctx, &GasFeeRecord{
+		DocType:     GasFeeRecordDocType,
+		Source:      GasFeePending,
+		Operator:    operator,
+		Old:         current,
+		New:         *policy,
+		EffectiveAt: effectiveAt,
+		TxID:        ctx.GetTxID(),
+		Timestamp:   now,
+	}); err != nil {
+		return nil, err
+	}
+	return change, nil
+}
+
+// CancelGasFeeChange is a smart contract function which lets the gas fees admin cancel the scheduled gas
+// fee change before it takes effect.
+func (s *SmartContract) CancelGasFeeChange(ctx kalpsdk.TransactionContextInterface) error {
+	ctx = NewUnitOfWork(ctx)
+	if _, err := s.requirePermission(ctx, PermissionSetGasFees); err != nil {
+		return err
+	}
+	if err := requireMultisigProposal(ctx, ActionCancelGasFeeChange); err != nil {
+		return err
+	}
+	return discardGasFeeChange(ctx)
+}
+
+func discardGasFeeChange(ctx kalpsdk.TransactionContextInterface) error {
+	change, err := getGasFeeChange(ctx)
+	if err != nil {
+		return err
+	}
+	if change == nil {
+		return fmt.Errorf("error with status code %v, no gas fee change is scheduled", http.StatusBadRequest)
+	}
+	due, err := change.due(ctx)
+	if err != nil {
+		return err
+	}
+	if due {
+		return fmt.Errorf("error with status code %v, the gas fee change took effect at %d", http.StatusBadRequest, change.EffectiveAt)
+	}
+	if err := auditKeyChange(ctx, "CancelGasFeeChange", []string{}, gasFeeChangeKey); err != nil {
+		return err
+	}
+	if err := ctx.DelStateWithoutKYC(gasFeeChangeKey); err != nil {
+		return fmt.Errorf("failed to cancel gas fee change: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package kalpAccounting
+
+import (
+	"math/big"
+	"testing"
+	"time"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setGasFees(l *fakeledger.Ledger, s *SmartContract, policy string) error {
+	return l.Submit(intialgasfeesadmin, func(ctx *fakeledger.TransactionContext) error {
+		return s.SetGasFees(ctx, policy)
+	})
+}
+
+func TestGasFeePolicyFee(t *testing.T) {
+	policy := &GasFeePolicy{Flat: "100", BasisPoints: 50, Min: "150", Max: "10000"}
+	require.NoError(t, policy.validate())
+	for amount, want := range map[int64]string{
+		1:         "150",   // raised to the minimum
+		20000:     "200",   // 100 + 0.5%
+		10000000:  "10000", // capped at the maximum
+		123456789: "10000",
+	} {
+		fee, err := policy.Fee(big.NewInt(amount))
+		require.NoError(t, err)
+		require.Equal(t, want, fee.String(), "amount %d", amount)
+	}
+
+	legacy, err := parseGasFeePolicy("1000")
+	require.NoError(t, err)
+	require.Equal(t, &GasFeePolicy{Flat: "1000", Min: "0"}, legacy)
+
+	for _, invalid := range []string{
+		"-1",
+		"abc",
+		`{"basisPoints":10001}`,
+		`{"min":"10","max":"5"}`,
+		`{"flat":"1.5"}`,
+		`{"flat":`,
+	} {
+		_, err := parseGasFeePolicy(invalid)
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestSetGasFees(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	policy, err := s.GetGasFees(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, &GasFees{GasFeePolicy: GasFeePolicy{Flat: initialGasFees, Min: "0"}}, policy)
+
+	err = l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return s.SetGasFees(ctx, "1")
+	})
+	require.Error(t, err, "only the gas fees admin can set gas fees")
+	require.Error(t, setGasFees(l, s, `{"basisPoints":20000}`))
+
+	require.NoError(t, setGasFees(l, s, `{"flat":"0","basisPoints":100,"min":"1000000000000000","max":"50000000000000000"}`))
+	policy, err = s.GetGasFees(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, uint64(100), policy.BasisPoints)
+
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "20000000000000000000"))
+	foundationBefore := balanceOf(t, l, s, kalpFoundation)
+	// 1% of 2 GINI is 0.02 GINI, below the 0.05 GINI maximum.
+	require.NoError(t, transfer(l, s, alice, bob, "2000000000000000000"))
+	require.Equal(t, "1980000000000000000", balanceOf(t, l, s, bob))
+	require.Equal(t, sum(foundationBefore, "20000000000000000"), balanceOf(t, l, s, kalpFoundation))
+	// 1% of 10 GINI is capped at 0.05 GINI.
+	require.NoError(t, transfer(l, s, alice, carol, "10000000000000000000"))
+	require.Equal(t, "9950000000000000000", balanceOf(t, l, s, carol))
+
+	// Gas fees stored as a plain number before fee policies are read as a flat fee.
+	l.PutState(gasFeesKey, []byte("7"))
+	policy, err = s.GetGasFees(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, "7", policy.Flat)
+}
+
+func scheduleGasFeeChange(l *fakeledger.Ledger, s *SmartContract, policy string, effectiveAt int64) error {
+	return l.Submit(intialgasfeesadmin, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.ScheduleGasFeeChange(ctx, policy, effectiveAt)
+		return err
+	})
+}
+
+func cancelGasFeeChange(l *fakeledger.Ledger, s *SmartContract) error {
+	return l.Submit(intialgasfeesadmin, func(ctx *fakeledger.TransactionContext) error {
+		return s.CancelGasFeeChange(ctx)
+	})
+}
+
+func TestScheduleGasFeeChange(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	effectiveAt := l.Now().Unix() + minGasFeeChangeDelay + 60
+	require.Error(t, scheduleGasFeeChange(l, s, "2000000000000000", l.Now().Unix()+60), "too little notice")
+	require.Error(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.ScheduleGasFeeChange(ctx, "2000000000000000", effectiveAt)
+		return err
+	}))
+	require.Error(t, cancelGasFeeChange(l, s), "nothing to cancel")
+
+	require.NoError(t, scheduleGasFeeChange(l, s, "2000000000000000", effectiveAt))
+	require.Error(t, scheduleGasFeeChange(l, s, "3000000000000000", effectiveAt), "one change at a time")
+	gasFees, err := s.GetGasFees(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, initialGasFees, gasFees.Flat)
+	require.NotNil(t, gasFees.Upcoming)
+	require.Equal(t, "2000000000000000", gasFees.Upcoming.Policy.Flat)
+	require.Equal(t, effectiveAt, gasFees.Upcoming.EffectiveAt)
+
+	require.NoError(t, cancelGasFeeChange(l, s))
+	gasFees, err = s.GetGasFees(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Nil(t, gasFees.Upcoming)
+
+	require.NoError(t, scheduleGasFeeChange(l, s, "3000000000000000", effectiveAt))
+	require.NoError(t, transfer(l, s, alice, bob, "1000000000000000000"))
+	require.Equal(t, "999000000000000000", balanceOf(t, l, s, bob), "the current fee applies until the change takes effect")
+
+	l.Advance(time.Duration(minGasFeeChangeDelay+60) * time.Second)
+	gasFees, err = s.GetGasFees(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, "3000000000000000", gasFees.Flat)
+	require.Nil(t, gasFees.Upcoming)
+	require.Error(t, cancelGasFeeChange(l, s), "the change already took effect")
+	require.NoError(t, transfer(l, s, alice, carol, "1000000000000000000"))
+	require.Equal(t, "997000000000000000", balanceOf(t, l, s, carol))
+
+	// The change that took effect is kept when the next one is scheduled or the fee is set directly.
+	require.NoError(t, scheduleGasFeeChange(l, s, "4000000000000000", l.Now().Unix()+minGasFeeChangeDelay+60))
+	gasFees, err = s.GetGasFees(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, "3000000000000000", gasFees.Flat)
+	l.Advance(time.Duration(minGasFeeChangeDelay+60) * time.Second)
+	require.NoError(t, setGasFees(l, s, "5000000000000000"))
+	gasFees, err = s.GetGasFees(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, "5000000000000000", gasFees.Flat)
+}
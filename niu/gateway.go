@@ -0,0 +1,316 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const GatewayReceiptDocType = "GatewayReceipt"
+
+const maxGatewayReferenceLength = 128
+
+// maxGatewayFeeBatch is the most fees CollectGatewayFeesBatch collects in one transaction.
+const maxGatewayFeeBatch = 100
+
+// legacyGatewayDappID is the dapp ID of the receipts of gateway fees collected through Transfer, which
+// doesn't name the dapp.
+const legacyGatewayDappID = "legacy"
+
+// GatewayReceipt records a gateway fee collected from Sender for the dapp DappID. Reference is the
+// gateway's own ID for the fee and can only be used once per dapp.
+type GatewayReceipt struct {
+	DocType   string     `json:"docType"`
+	DappID    string     `json:"dappId"`
+	Reference string     `json:"reference"`
+	Sender    string     `json:"sender"`
+	Amount    string     `json:"amount"`
+	Operator  string     `json:"operator"`
+	TxID      string     `json:"txId"`
+	Timestamp int64      `json:"timestamp"`
+	FeeSplit  []FeeShare `json:"feeSplit"`
+	// DappRevenue is the share of the fee the dapp earned, if it is registered.
+	DappRevenue string `json:"dappRevenue,omitempty"`
+}
+
+func gatewayReceiptKey(sdk kalpsdk.TransactionContextInterface, dappID string, reference string) (string, error) {
+	key, err := sdk.CreateCompositeKey(GatewayReceiptDocType, []string{dappID, reference})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for gateway receipt %s: %v", reference, err)
+	}
+	return key, nil
+}
+
+// validateGatewayID checks a dapp ID or reference, which are part of the receipt key.
+func validateGatewayID(name string, id string) error {
+	if id == "" {
+		return fmt.Errorf("error with status code %v, invalid input %s is required", http.StatusBadRequest, name)
+	}
+	if len(id) > maxGatewayReferenceLength {
+		return fmt.Errorf("error with status code %v, %s can not be longer than %d characters", http.StatusBadRequest, name, maxGatewayReferenceLength)
+	}
+	if strings.ContainsAny(id, "\x00 ") {
+		return fmt.Errorf("error with status code %v, invalid %s %q", http.StatusBadRequest, name, id)
+	}
+	return nil
+}
+
+// validateGatewayFee checks the sender, amount and reference of a gateway fee and returns the amount.
+func validateGatewayFee(sender string, amount string, reference string) (*big.Int, error) {
+	if len(sender) != 40 {
+		return nil, fmt.Errorf("address must be 40 characters long")
+	}
+	if strings.ContainsAny(sender, "`~!@#$%^&*()-_+=[]{}\\|;':\",./<>? ") {
+		return nil, fmt.Errorf("invalid address")
+	}
+	if err := validateGatewayID("reference", reference); err != nil {
+		return nil, err
+	}
+	feeAmount, ok := big.NewInt(0).SetString(amount, 10)
+	if !ok || feeAmount.Sign() <= 0 {
+		return nil, fmt.Errorf("error with status code %v, invalid Amount %v", http.StatusBadRequest, amount)
+	}
+	return feeAmount, nil
+}
+
+// collectGatewayFee moves amount from sender to the fee recipients and records a receipt.
+func collectGatewayFee(sdk kalpsdk.TransactionContextInterface, operator string, sender string, amount *big.Int, dappID string, reference string) (*GatewayReceipt, error) {
+	if err := checkGatewayFee(sdk, sender, amount, dappID, reference); err != nil {
+		return nil, err
+	}
+	receipt, err := debitGatewayFee(sdk, operator, sender, amount, dappID, reference)
+	if err != nil {
+		return nil, err
+	}
+	if receipt.FeeSplit, err = distributeFee(sdk, amount); err != nil {
+		return nil, err
+	}
+	if err := writeGatewayReceipt(sdk, receipt); err != nil {
+		return nil, err
+	}
+	return receipt, nil
+}
+
+// checkGatewayFee fails if the gateway fee was already collected or sender can't pay it. Fees can't be
+// collected from the foundation, whose transfers need a multisig proposal, or from a sponsor's escrow.
+func checkGatewayFee(sdk kalpsdk.TransactionContextInterface, sender string, amount *big.Int, dappID string, reference string) error {
+	foundation, err := foundationAddress(sdk)
+	if err != nil {
+		return err
+	}
+	if sender == foundation || strings.HasPrefix(sender, sponsorEscrowPrefix) {
+		return fmt.Errorf("error with status code %v, gateway fees can not be collected from %s", http.StatusForbidden, sender)
+	}
+	key, err := gatewayReceiptKey(sdk, dappID, reference)
+	if err != nil {
+		return err
+	}
+	existing, err := sdk.GetState(key)
+	if err != nil {
+		return fmt.Errorf("failed to read gateway receipt: %v", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("error with status code %v, gateway fee %s of dapp %s was already collected", http.StatusConflict, reference, dappID)
+	}
+	balance, err := GetBalance(sdk, sender)
+	if err != nil {
+		return fmt.Errorf("failed to get balance %v", err)
+	}
+	if available, _ := big.NewInt(0).SetString(balance, 10); available == nil || available.Cmp(amount) < 0 {
+		return fmt.Errorf("error with status code %v, account %v has insufficient balance for token %v, required balance: %v, available balance: %v", http.StatusBadRequest, sender, GINI, amount, balance)
+	}
+	return nil
+}
+
+// debitGatewayFee takes a gateway fee from sender and attributes it to the dapp. The caller checks the
+// fee first, distributes it and writes the receipt.
+func debitGatewayFee(sdk kalpsdk.TransactionContextInterface, operator string, sender string, amount *big.Int, dappID string, reference string) (*GatewayReceipt, error) {
+	if err := RemoveUtxo(sdk, sender, amount); err != nil {
+		return nil, fmt.Errorf("error with status code %v, error:error while reducing balance %v", http.StatusBadRequest, err)
+	}
+	revenue, err := accrueDappRevenue(sdk, dappID, reference, amount)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(sdk)
+	if err != nil {
+		return nil, err
+	}
+	receipt := &GatewayReceipt{
+		DocType:   GatewayReceiptDocType,
+		DappID:    dappID,
+		Reference: reference,
+		Sender:    sender,
+		Amount:    amount.String(),
+		Operator:  operator,
+		TxID:      sdk.GetTxID(),
+		Timestamp: now,
+	}
+	if revenue != nil {
+		receipt.DappRevenue = revenue.String()
+	}
+	return receipt, nil
+}
+
+func writeGatewayReceipt(sdk kalpsdk.TransactionContextInterface, receipt *GatewayReceipt) error {
+	key, err := gatewayReceiptKey(sdk, receipt.DappID, receipt.Reference)
+	if err != nil {
+		return err
+	}
+	receiptJSON, err := json.Marshal(receipt)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := sdk.PutStateWithoutKYC(key, receiptJSON); err != nil {
+		return fmt.Errorf("failed to write gateway receipt: %v", err)
+	}
+	return nil
+}
+
+// CollectGatewayFee is a smart contract function which lets the gateway admin collect a fee of amount
+// from sender for a transaction of the dapp dappId. The fee is split like gas fees. reference identifies
+// the fee at the gateway, and a fee can't be collected twice with the same reference. It records a
+// receipt and emits a GatewayFeeCollected event.
+func (s *SmartContract) CollectGatewayFee(ctx kalpsdk.TransactionContextInterface, sender string, amount string, dappId string, reference string) (*GatewayReceipt, error) {
+	logger := kalpsdk.NewLogger()
+	ctx = NewUnitOfWork(ctx)
+	operator, err := s.requirePermission(ctx, PermissionCollectGatewayFee)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateGatewayID("dappId", dappId); err != nil {
+		return nil, err
+	}
+	sender = strings.Trim(sender, " ")
+	feeAmount, err := validateGatewayFee(sender, amount, reference)
+	if err != nil {
+		return nil, err
+	}
+	receipt, err := collectGatewayFee(ctx, operator, sender, feeAmount, dappId, reference)
+	if err != nil {
+		logger.Infof("gateway fee err: %v", err)
+		return nil, err
+	}
+	receiptJSON, err := json.Marshal(receipt)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := ctx.SetEvent("GatewayFeeCollected", receiptJSON); err != nil {
+		return nil, fmt.Errorf("failed to set event: %v", err)
+	}
+	return receipt, nil
+}
+
+// GatewayFeeEntry is a fee to collect with CollectGatewayFeesBatch.
+type GatewayFeeEntry struct {
+	Sender    string `json:"sender"`
+	Amount    string `json:"amount"`
+	Reference string `json:"reference"`
+}
+
+// GatewayFeeResult is the outcome of a GatewayFeeEntry. Error says why a fee wasn't collected.
+type GatewayFeeResult struct {
+	GatewayFeeEntry
+	Success     bool   `json:"success"`
+	Error       string `json:"error,omitempty"`
+	DappRevenue string `json:"dappRevenue,omitempty"`
+}
+
+// GatewayFeeBatch is the result and event of CollectGatewayFeesBatch. Total is the sum of the fees
+// collected, which was split once between the fee recipients.
+type GatewayFeeBatch struct {
+	DappID   string             `json:"dappId"`
+	Operator string             `json:"operator"`
+	Results  []GatewayFeeResult `json:"results"`
+	Total    string             `json:"total"`
+	FeeSplit []FeeShare         `json:"feeSplit,omitempty"`
+}
+
+// CollectGatewayFeesBatch is a smart contract function which lets the gateway admin collect many gateway
+// fees of the dapp dappId in one transaction. Each fee is collected like with CollectGatewayFee, except
+// that their total is split between the fee recipients once. A fee that can't be collected, e.g. because
+// its sender's balance is too low or its reference was used, is reported as failed without affecting
+// the others. The receipts of the fees record the batch transaction but not a fee split.
+func (s *SmartContract) CollectGatewayFeesBatch(ctx kalpsdk.TransactionContextInterface, dappId string, entries []GatewayFeeEntry) (*GatewayFeeBatch, error) {
+	logger := kalpsdk.NewLogger()
+	// Every debit reads the UTXOs written by the previous ones, which only a UnitOfWork can do.
+	ctx = NewUnitOfWork(ctx)
+	operator, err := s.requirePermission(ctx, PermissionCollectGatewayFee)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateGatewayID("dappId", dappId); err != nil {
+		return nil, err
+	}
+	if len(entries) == 0 || len(entries) > maxGatewayFeeBatch {
+		return nil, fmt.Errorf("error with status code %v, a batch must have between 1 and %d fees", http.StatusBadRequest, maxGatewayFeeBatch)
+	}
+	batch := &GatewayFeeBatch{DappID: dappId, Operator: operator, Results: make([]GatewayFeeResult, len(entries))}
+	total := big.NewInt(0)
+	for i, entry := range entries {
+		entry.Sender = strings.Trim(entry.Sender, " ")
+		result := GatewayFeeResult{GatewayFeeEntry: entry}
+		amount, err := validateGatewayFee(entry.Sender, entry.Amount, entry.Reference)
+		if err == nil {
+			err = checkGatewayFee(ctx, entry.Sender, amount, dappId, entry.Reference)
+		}
+		if err != nil {
+			logger.Infof("gateway fee %s err: %v", entry.Reference, err)
+			result.Error = err.Error()
+			batch.Results[i] = result
+			continue
+		}
+		// Nothing is written for a fee that fails its checks. A failure after that fails the whole batch,
+		// as the transaction would otherwise commit part of the fee.
+		receipt, err := debitGatewayFee(ctx, operator, entry.Sender, amount, dappId, entry.Reference)
+		if err != nil {
+			return nil, err
+		}
+		total.Add(total, amount)
+		// Written before the next entry, so a reference repeated in the batch is rejected.
+		if err := writeGatewayReceipt(ctx, receipt); err != nil {
+			return nil, err
+		}
+		result.Success, result.DappRevenue = true, receipt.DappRevenue
+		batch.Results[i] = result
+	}
+	batch.Total = total.String()
+	if total.Sign() > 0 {
+		if batch.FeeSplit, err = distributeFee(ctx, total); err != nil {
+			return nil, err
+		}
+	}
+	batchJSON, err := json.Marshal(batch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := ctx.SetEvent("GatewayFeesBatchCollected", batchJSON); err != nil {
+		return nil, fmt.Errorf("failed to set event: %v", err)
+	}
+	return batch, nil
+}
+
+// GetGatewayReceipt is a smart contract function which returns the receipt of the gateway fee with
+// reference of the dapp dappId.
+func (s *SmartContract) GetGatewayReceipt(ctx kalpsdk.TransactionContextInterface, dappId string, reference string) (*GatewayReceipt, error) {
+	key, err := gatewayReceiptKey(ctx, dappId, reference)
+	if err != nil {
+		return nil, err
+	}
+	receiptJSON, err := ctx.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read gateway receipt: %v", err)
+	}
+	if receiptJSON == nil {
+		return nil, fmt.Errorf("error with status code %v, no gateway fee %s of dapp %s", http.StatusNotFound, reference, dappId)
+	}
+	var receipt GatewayReceipt
+	if err := json.Unmarshal(receiptJSON, &receipt); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal gateway receipt: %v", err)
+	}
+	return &receipt, nil
+}
@@ -0,0 +1,143 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func collectGatewayFeeAs(l *fakeledger.Ledger, s *SmartContract, operator, sender, amount, dappID, reference string) (*GatewayReceipt, error) {
+	var receipt *GatewayReceipt
+	err := l.Submit(operator, func(ctx *fakeledger.TransactionContext) error {
+		var err error
+		receipt, err = s.CollectGatewayFee(ctx, sender, amount, dappID, reference)
+		return err
+	})
+	return receipt, err
+}
+
+func TestCollectGatewayFee(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	foundationBalance := balanceOf(t, l, s, kalpFoundation)
+
+	receipt, err := collectGatewayFeeAs(l, s, intialkalpGateWayadmin, alice, "300", "dapp-1", "order-1")
+	require.NoError(t, err)
+	require.Equal(t, alice, receipt.Sender)
+	require.Equal(t, "300", receipt.Amount)
+	require.Equal(t, []FeeShare{{Recipient: kalpFoundation, BasisPoints: 10000, Amount: "300"}}, receipt.FeeSplit)
+	require.Equal(t, sum("5000000000000000000", "-300"), balanceOf(t, l, s, alice))
+	require.Equal(t, sum(foundationBalance, "300"), balanceOf(t, l, s, kalpFoundation))
+
+	event := lastEvent(t, l)
+	require.Equal(t, "GatewayFeeCollected", event.Name)
+	var emitted GatewayReceipt
+	require.NoError(t, json.Unmarshal(event.Payload, &emitted))
+	require.Equal(t, *receipt, emitted)
+	stored, err := s.GetGatewayReceipt(l.NewTransaction(alice), "dapp-1", "order-1")
+	require.NoError(t, err)
+	require.Equal(t, receipt, stored)
+
+	_, err = collectGatewayFeeAs(l, s, intialkalpGateWayadmin, alice, "300", "dapp-1", "order-1")
+	require.Error(t, err, "a reference is used once")
+	_, err = collectGatewayFeeAs(l, s, intialkalpGateWayadmin, alice, "300", "dapp-2", "order-1")
+	require.NoError(t, err)
+	_, err = collectGatewayFeeAs(l, s, alice, alice, "300", "dapp-1", "order-2")
+	require.Error(t, err, "only the gateway admin collects fees")
+	for _, invalid := range [][3]string{
+		{`{"sender":"` + alice + `"}`, "300", "order-3"},
+		{alice, "0", "order-3"},
+		{alice, "300", ""},
+		{alice, "9000000000000000000", "order-3"},
+	} {
+		_, err = collectGatewayFeeAs(l, s, intialkalpGateWayadmin, invalid[0], invalid[1], "dapp-1", invalid[2])
+		require.Error(t, err, invalid)
+	}
+}
+
+func TestLegacyGatewayTransferRecordsReceipt(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	require.NoError(t, transfer(l, s, intialkalpGateWayadmin, `{"sender":"`+alice+`"}`, "300"))
+	require.Equal(t, sum("5000000000000000000", "-300"), balanceOf(t, l, s, alice))
+
+	event := lastEvent(t, l)
+	require.Equal(t, "TransferSingle", event.Name)
+	receipt, err := s.GetGatewayReceipt(l.NewTransaction(alice), legacyGatewayDappID, event.TxID)
+	require.NoError(t, err)
+	require.Equal(t, alice, receipt.Sender)
+	require.Equal(t, "300", receipt.Amount)
+}
+
+func TestCollectGatewayFeesBatch(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "1000"))
+	require.NoError(t, transfer(l, s, kalpFoundation, bob, "50"))
+	require.NoError(t, registerDapp(l, s, "dapp-1", dapp, 1000))
+	_, err := collectGatewayFeeAs(l, s, intialkalpGateWayadmin, alice, "10", "dapp-1", "used")
+	require.NoError(t, err)
+	foundationBalance := balanceOf(t, l, s, kalpFoundation)
+	eventsBefore := len(l.Events())
+
+	var batch *GatewayFeeBatch
+	require.NoError(t, l.Submit(intialkalpGateWayadmin, func(ctx *fakeledger.TransactionContext) error {
+		batch, err = s.CollectGatewayFeesBatch(ctx, "dapp-1", []GatewayFeeEntry{
+			{Sender: alice, Amount: "100", Reference: "a-1"},
+			{Sender: bob, Amount: "40", Reference: "b-1"},
+			{Sender: bob, Amount: "40", Reference: "b-2"},
+			{Sender: alice, Amount: "200", Reference: "a-1"},
+			{Sender: alice, Amount: "300", Reference: "used"},
+			{Sender: "alice", Amount: "1", Reference: "a-2"},
+			{Sender: alice, Amount: "200", Reference: "a-3"},
+		})
+		return err
+	}))
+	var succeeded []bool
+	for _, result := range batch.Results {
+		succeeded = append(succeeded, result.Success)
+	}
+	require.Equal(t, []bool{true, true, false, false, false, false, true}, succeeded)
+	require.Contains(t, batch.Results[2].Error, "insufficient balance")
+	require.Contains(t, batch.Results[3].Error, "already collected")
+	require.Equal(t, "340", batch.Total)
+	require.Equal(t, "10", batch.Results[0].DappRevenue)
+
+	require.Equal(t, sum("990", "-300"), balanceOf(t, l, s, alice))
+	require.Equal(t, "10", balanceOf(t, l, s, bob))
+	require.Equal(t, sum(foundationBalance, "340"), balanceOf(t, l, s, kalpFoundation))
+	require.Equal(t, []FeeShare{{Recipient: kalpFoundation, BasisPoints: 10000, Amount: "340"}}, batch.FeeSplit)
+	require.Len(t, l.Events(), eventsBefore+1)
+	require.Equal(t, "GatewayFeesBatchCollected", lastEvent(t, l).Name)
+
+	registered, err := s.GetDapp(l.NewTransaction(alice), "dapp-1")
+	require.NoError(t, err)
+	require.Equal(t, "350", registered.FeesCollected)
+	receipt, err := s.GetGatewayReceipt(l.NewTransaction(alice), "dapp-1", "b-1")
+	require.NoError(t, err)
+	require.Equal(t, "40", receipt.Amount)
+	_, err = s.GetGatewayReceipt(l.NewTransaction(alice), "dapp-1", "b-2")
+	require.Error(t, err)
+}
+
+func TestGatewayFeesFromFoundation(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	foundationBalance := balanceOf(t, l, s, kalpFoundation)
+
+	_, err := collectGatewayFeeAs(l, s, intialkalpGateWayadmin, kalpFoundation, "300", "dapp-1", "order-1")
+	require.Error(t, err, "the treasury can't be taken as a gateway fee")
+	var batch *GatewayFeeBatch
+	require.NoError(t, l.Submit(intialkalpGateWayadmin, func(ctx *fakeledger.TransactionContext) error {
+		batch, err = s.CollectGatewayFeesBatch(ctx, "dapp-1", []GatewayFeeEntry{{Sender: kalpFoundation, Amount: "300", Reference: "order-2"}})
+		return err
+	}))
+	require.False(t, batch.Results[0].Success)
+
+	// The legacy gateway transfer moves nothing, as it did before gateway fees were collected.
+	require.NoError(t, transfer(l, s, intialkalpGateWayadmin, `{"sender":"`+kalpFoundation+`"}`, "300"))
+	require.Equal(t, foundationBalance, balanceOf(t, l, s, kalpFoundation))
+	_, err = s.GetGatewayReceipt(l.NewTransaction(alice), legacyGatewayDappID, lastEvent(t, l).TxID)
+	require.Error(t, err)
+}
@@ -0,0 +1,282 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+	"golang.org/x/exp/slices"
+)
+
+const GovernanceDocType = "Governance"
+
+// legacyGovernanceAddresses are the addresses of contracts initialized before the governance addresses
+// were stored on the ledger.
+var legacyGovernanceAddresses = map[string]string{
+	kalpFoundationRole: kalpFoundation,
+	gasFeesAdminRole:   intialgasfeesadmin,
+	kalpGateWayAdmin:   intialkalpGateWayadmin,
+}
+
+// GovernanceAddress is the address holding one of the governance roles: the foundation, the gas fees
+// admin or the gateway admin. Pending is the address proposed to take over, which has to accept it.
+type GovernanceAddress struct {
+	Role       string `json:"role"`
+	DocType    string `json:"docType"`
+	Address    string `json:"address"`
+	Pending    string `json:"pending,omitempty"`
+	ProposedBy string `json:"proposedBy,omitempty"`
+	ProposedAt int64  `json:"proposedAt,omitempty"`
+}
+
+// GovernanceChange is the result and FoundationChanged event of AcceptGovernanceAddress.
+type GovernanceChange struct {
+	Role       string `json:"role"`
+	Previous   string `json:"previous"`
+	Address    string `json:"address"`
+	ProposedBy string `json:"proposedBy"`
+	// Moved is the balance moved from the previous foundation address.
+	Moved string `json:"moved,omitempty"`
+}
+
+func governanceKey(sdk kalpsdk.TransactionContextInterface, role string) (string, error) {
+	key, err := sdk.CreateCompositeKey(GovernanceDocType, []string{role})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for governance role %s: %v", role, err)
+	}
+	return key, nil
+}
+
+func readGovernanceAddress(sdk kalpsdk.TransactionContextInterface, role string) (*GovernanceAddress, error) {
+	key, err := governanceKey(sdk, role)
+	if err != nil {
+		return nil, err
+	}
+	governanceJSON, err := sdk.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read governance address of %s: %v", role, err)
+	}
+	if governanceJSON == nil {
+		return &GovernanceAddress{Role: role, DocType: GovernanceDocType, Address: legacyGovernanceAddresses[role]}, nil
+	}
+	var governance GovernanceAddress
+	if err := json.Unmarshal(governanceJSON, &governance); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal governance address of %s: %v", role, err)
+	}
+	return &governance, nil
+}
+
+func writeGovernanceAddress(sdk kalpsdk.TransactionContextInterface, governance *GovernanceAddress) error {
+	key, err := governanceKey(sdk, governance.Role)
+	if err != nil {
+		return err
+	}
+	governanceJSON, err := json.Marshal(governance)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := sdk.PutStateWithoutKYC(key, governanceJSON); err != nil {
+		return fmt.Errorf("failed to write governance address of %s: %v", governance.Role, err)
+	}
+	return nil
+}
+
+// auditGovernanceChange records a privileged call that is about to change governance.
+func auditGovernanceChange(sdk kalpsdk.TransactionContextInterface, function string, args []string, governance *GovernanceAddress) error {
+	previous, err := json.Marshal(governance)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	return recordAdminAudit(sdk, function, args, previous)
+}
+
+// foundationAddress returns the address of the kalp foundation, which holds the treasury.
+func foundationAddress(sdk kalpsdk.TransactionContextInterface) (string, error) {
+	governance, err := readGovernanceAddress(sdk, kalpFoundationRole)
+	if err != nil {
+		return "", err
+	}
+	return governance.Address, nil
+}
+
+func validateGovernanceAddress(address string) error {
+	if len(address) != 40 {
+		return fmt.Errorf("error with status code %v, address must be 40 characters long", http.StatusBadRequest)
+	}
+	if strings.ContainsAny(address, "`~!@#$%^&*()-_+=[]{}\\|;':\",./<>? ") {
+		return fmt.Errorf("error with status code %v, invalid address %s", http.StatusBadRequest, address)
+	}
+	return nil
+}
+
+// initializeGovernance stores the governance addresses and assigns them their roles.
+func initializeGovernance(sdk kalpsdk.TransactionContextInterface, addresses map[string]string) error {
+	for _, role := range validRoles {
+		address := addresses[role]
+		if err := validateGovernanceAddress(address); err != nil {
+			return err
+		}
+		if err := writeGovernanceAddress(sdk, &GovernanceAddress{Role: role, DocType: GovernanceDocType, Address: address}); err != nil {
+			return err
+		}
+		if _, err := InitializeRoles(sdk, address, role); err != nil {
+			return fmt.Errorf("error in initializing roles: %v", err)
+		}
+	}
+	return nil
+}
+
+// GetGovernance is a smart contract function which returns the foundation, gas fees admin and gateway
+// admin addresses, and the addresses proposed to replace them.
+func (s *SmartContract) GetGovernance(ctx kalpsdk.TransactionContextInterface) ([]GovernanceAddress, error) {
+	addresses := []GovernanceAddress{}
+	for _, role := range validRoles {
+		governance, err := readGovernanceAddress(ctx, role)
+		if err != nil {
+			return nil, err
+		}
+		addresses = append(addresses, *governance)
+	}
+	return addresses, nil
+}
+
+// ProposeGovernanceAddress is a smart contract function which lets the foundation propose a new address
+// for a governance role. The role moves once the proposed address accepts it with AcceptGovernanceAddress.
+// A new proposal replaces the pending one.
+func (s *SmartContract) ProposeGovernanceAddress(ctx kalpsdk.TransactionContextInterface, role string, address string) (*GovernanceAddress, error) {
+	ctx = NewUnitOfWork(ctx)
+	operator, err := s.requirePermission(ctx, PermissionRotateGovernance)
+	if err != nil {
+		return nil, err
+	}
+	if err := requireMultisigProposal(ctx, ActionProposeGovernanceAddress); err != nil {
+		return nil, err
+	}
+	return storeGovernanceProposal(ctx, operator, role, address)
+}
+
+func storeGovernanceProposal(ctx kalpsdk.TransactionContextInterface, operator string, role string, address string) (*GovernanceAddress, error) {
+	if !slices.Contains(validRoles, role) {
+		return nil, fmt.Errorf("error with status code %v, invalid role %s", http.StatusBadRequest, role)
+	}
+	address = strings.Trim(address, " ")
+	if err := validateGovernanceAddress(address); err != nil {
+		return nil, err
+	}
+	governance, err := readGovernanceAddress(ctx, role)
+	if err != nil {
+		return nil, err
+	}
+	if address == governance.Address {
+		return nil, fmt.Errorf("error with status code %v, %s already holds %s", http.StatusBadRequest, address, role)
+	}
+	if err := auditGovernanceChange(ctx, "ProposeGovernanceAddress", []string{role, address}, governance); err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	governance.Pending, governance.ProposedBy, governance.ProposedAt = address, operator, now
+	if err := writeGovernanceAddress(ctx, governance); err != nil {
+		return nil, err
+	}
+	return governance, nil
+}
+
+// CancelGovernanceProposal is a smart contract function which lets the foundation withdraw the pending
+// proposal for a governance role.
+func (s *SmartContract) CancelGovernanceProposal(ctx kalpsdk.TransactionContextInterface, role string) error {
+	ctx = NewUnitOfWork(ctx)
+	if _, err := s.requirePermission(ctx, PermissionRotateGovernance); err != nil {
+		return err
+	}
+	if !slices.Contains(validRoles, role) {
+		return fmt.Errorf("error with status code %v, invalid role %s", http.StatusBadRequest, role)
+	}
+	governance, err := readGovernanceAddress(ctx, role)
+	if err != nil {
+		return err
+	}
+	if governance.Pending == "" {
+		return fmt.Errorf("error with status code %v, no address is proposed for %s", http.StatusNotFound, role)
+	}
+	if err := auditGovernanceChange(ctx, "CancelGovernanceProposal", []string{role}, governance); err != nil {
+		return err
+	}
+	governance.Pending, governance.ProposedBy, governance.ProposedAt = "", "", 0
+	return writeGovernanceAddress(ctx, governance)
+}
+
+// AcceptGovernanceAddress is a smart contract function which lets the address proposed for a governance
+// role take it over from the previous address. When the foundation moves, its balance, its share of the
+// gas fee split and its fee exemption move with it.
+func (s *SmartContract) AcceptGovernanceAddress(ctx kalpsdk.TransactionContextInterface, role string) (*GovernanceChange, error) {
+	ctx = NewUnitOfWork(ctx)
+	operator, err := GetUserId(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
+	}
+	if !slices.Contains(validRoles, role) {
+		return nil, fmt.Errorf("error with status code %v, invalid role %s", http.StatusBadRequest, role)
+	}
+	governance, err := readGovernanceAddress(ctx, role)
+	if err != nil {
+		return nil, err
+	}
+	if governance.Pending == "" || governance.Pending != operator {
+		return nil, fmt.Errorf("error with status code %v, %s is not proposed for %s", http.StatusForbidden, operator, role)
+	}
+	if err := auditGovernanceChange(ctx, "AcceptGovernanceAddress", []string{role}, governance); err != nil {
+		return nil, err
+	}
+	change := &GovernanceChange{Role: role, Previous: governance.Address, Address: operator, ProposedBy: governance.ProposedBy}
+	if _, err := deleteUserRole(ctx, governance.Address, role); err != nil {
+		return nil, err
+	}
+	if err := putUserRole(ctx, UserRole{Id: operator, Role: role}); err != nil {
+		return nil, err
+	}
+	if role == kalpFoundationRole {
+		balance, err := GetBalance(ctx, governance.Address)
+		if err != nil {
+			return nil, err
+		}
+		amount, ok := big.NewInt(0).SetString(balance, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid balance %s of %s", balance, governance.Address)
+		}
+		if amount.Sign() > 0 {
+			if err := RemoveUtxo(ctx, governance.Address, amount); err != nil {
+				return nil, fmt.Errorf("error with status code %v, error:error while reducing balance %v", http.StatusBadRequest, err)
+			}
+			if err := AddUtxo(ctx, operator, amount); err != nil {
+				return nil, fmt.Errorf("error with status code %v, error:error while adding balance %v", http.StatusBadRequest, err)
+			}
+			change.Moved = amount.String()
+		}
+		// The fee split and the fee exemptions name the foundation by address, so they follow it.
+		if err := moveFeeSplitShare(ctx, "AcceptGovernanceAddress", []string{role}, governance.Address, operator); err != nil {
+			return nil, err
+		}
+		if err := moveFeeExemption(ctx, "AcceptGovernanceAddress", []string{role}, governance.Address, operator); err != nil {
+			return nil, err
+		}
+	}
+	governance.Address = operator
+	governance.Pending, governance.ProposedBy, governance.ProposedAt = "", "", 0
+	if err := writeGovernanceAddress(ctx, governance); err != nil {
+		return nil, err
+	}
+	changeJSON, err := json.Marshal(change)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := ctx.SetEvent("FoundationChanged", changeJSON); err != nil {
+		return nil, fmt.Errorf("failed to set event: %v", err)
+	}
+	return change, nil
+}
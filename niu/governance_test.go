@@ -0,0 +1,122 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"math/big"
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func proposeGovernanceAddress(l *fakeledger.Ledger, s *SmartContract, operator, role, address string) error {
+	return l.Submit(operator, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.ProposeGovernanceAddress(ctx, role, address)
+		return err
+	})
+}
+
+func acceptGovernanceAddress(l *fakeledger.Ledger, s *SmartContract, operator, role string) (*GovernanceChange, error) {
+	var change *GovernanceChange
+	err := l.Submit(operator, func(ctx *fakeledger.TransactionContext) error {
+		var err error
+		change, err = s.AcceptGovernanceAddress(ctx, role)
+		return err
+	})
+	return change, err
+}
+
+func TestRotateFoundation(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	treasury := balanceOf(t, l, s, kalpFoundation)
+
+	require.Error(t, proposeGovernanceAddress(l, s, alice, kalpFoundationRole, carol), "only the foundation proposes")
+	require.Error(t, proposeGovernanceAddress(l, s, kalpFoundation, kalpFoundationRole, kalpFoundation))
+	require.Error(t, proposeGovernanceAddress(l, s, kalpFoundation, kalpFoundationRole, "carol"))
+	require.NoError(t, proposeGovernanceAddress(l, s, kalpFoundation, kalpFoundationRole, bob))
+	require.NoError(t, proposeGovernanceAddress(l, s, kalpFoundation, kalpFoundationRole, carol), "a new proposal replaces the pending one")
+	_, err := acceptGovernanceAddress(l, s, bob, kalpFoundationRole)
+	require.Error(t, err)
+
+	change, err := acceptGovernanceAddress(l, s, carol, kalpFoundationRole)
+	require.NoError(t, err)
+	require.Equal(t, &GovernanceChange{Role: kalpFoundationRole, Previous: kalpFoundation, Address: carol, ProposedBy: kalpFoundation, Moved: treasury}, change)
+	event := lastEvent(t, l)
+	require.Equal(t, "FoundationChanged", event.Name)
+	var emitted GovernanceChange
+	require.NoError(t, json.Unmarshal(event.Payload, &emitted))
+	require.Equal(t, *change, emitted)
+	_, err = acceptGovernanceAddress(l, s, carol, kalpFoundationRole)
+	require.Error(t, err, "the proposal is used once")
+
+	require.Equal(t, treasury, balanceOf(t, l, s, carol))
+	require.Equal(t, "0", balanceOf(t, l, s, kalpFoundation))
+	require.True(t, hasPermission(t, l, s, carol, PermissionSetUserRoles))
+	require.False(t, hasPermission(t, l, s, kalpFoundation, PermissionSetUserRoles))
+
+	// Gas fees go to the new foundation, which sends without them.
+	require.NoError(t, transfer(l, s, alice, bob, "2000000000000000"))
+	require.Equal(t, sum(treasury, initialGasFees), balanceOf(t, l, s, carol))
+	require.NoError(t, transfer(l, s, carol, bob, "1000"))
+	require.Equal(t, sum("2000000000000000", "-"+initialGasFees, "1000"), balanceOf(t, l, s, bob))
+}
+
+func TestRotateGatewayAdmin(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, proposeGovernanceAddress(l, s, kalpFoundation, kalpGateWayAdmin, bob))
+	require.NoError(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		return s.CancelGovernanceProposal(ctx, kalpGateWayAdmin)
+	}))
+	_, err := acceptGovernanceAddress(l, s, bob, kalpGateWayAdmin)
+	require.Error(t, err, "the proposal was cancelled")
+
+	require.NoError(t, proposeGovernanceAddress(l, s, kalpFoundation, kalpGateWayAdmin, bob))
+	governance, err := s.GetGovernance(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, bob, governance[2].Pending)
+	change, err := acceptGovernanceAddress(l, s, bob, kalpGateWayAdmin)
+	require.NoError(t, err)
+	require.Empty(t, change.Moved)
+	require.True(t, hasPermission(t, l, s, bob, PermissionCollectGatewayFee))
+	require.False(t, hasPermission(t, l, s, intialkalpGateWayadmin, PermissionCollectGatewayFee))
+	require.Equal(t, []string{bob}, listRoleMembers(t, l, s, kalpGateWayAdmin))
+	require.Equal(t, intialFoundationBalance, balanceOf(t, l, s, kalpFoundation))
+}
+
+func TestRotateFoundationMovesFeeSplitAndExemption(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	require.NoError(t, setGasFeeSplit(l, s, `[{"recipient":"`+kalpFoundation+`","basisPoints":6000},{"recipient":"`+BurnAddress+`","basisPoints":3000},{"recipient":"`+dapp+`","basisPoints":1000}]`))
+	require.NoError(t, addFeeExemption(l, s, kalpFoundation))
+
+	require.NoError(t, proposeGovernanceAddress(l, s, kalpFoundation, kalpFoundationRole, carol))
+	_, err := acceptGovernanceAddress(l, s, carol, kalpFoundationRole)
+	require.NoError(t, err)
+	split, err := s.GetGasFeeSplit(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, []FeeShare{{Recipient: carol, BasisPoints: 6000}, {Recipient: BurnAddress, BasisPoints: 3000}, {Recipient: dapp, BasisPoints: 1000}}, split)
+	exemptions, err := s.ListFeeExemptions(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Len(t, exemptions, 1)
+	require.Equal(t, carol, exemptions[0].Address)
+	share, err := foundationFeeShare(NewUnitOfWork(l.NewTransaction(alice)), big.NewInt(1000))
+	require.NoError(t, err)
+	require.Equal(t, "600", share.String())
+
+	treasury := balanceOf(t, l, s, carol)
+	require.NoError(t, transfer(l, s, alice, bob, "2000000000000000"))
+	require.Equal(t, sum(treasury, "600000000000000"), balanceOf(t, l, s, carol))
+	exempt, err := isFeeExempt(l.NewTransaction(alice), kalpFoundation)
+	require.NoError(t, err)
+	require.False(t, exempt, "the old foundation isn't exempt any more")
+
+	// A foundation that already has a share gets the share of the previous one added to it.
+	require.NoError(t, proposeGovernanceAddress(l, s, carol, kalpFoundationRole, dapp))
+	_, err = acceptGovernanceAddress(l, s, dapp, kalpFoundationRole)
+	require.NoError(t, err)
+	split, err = s.GetGasFeeSplit(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, []FeeShare{{Recipient: BurnAddress, BasisPoints: 3000}, {Recipient: dapp, BasisPoints: 7000}}, split)
+}
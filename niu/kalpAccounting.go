@@ -3,7 +3,6 @@ package kalpAccounting
 import (
 	//Standard Libs
 
-	"encoding/json"
 	"fmt"
 	"math/big"
 	"net/http"
@@ -13,7 +12,8 @@ import (
 )
 
 // Deployment notes for GINI contract:
-// Initialize with name and symbol as GINI, GINI
+// Initialize with name and symbol as GINI, GINI and the foundation, gas fees admin and gateway admin
+// addresses. The addresses below are the ones of contracts initialized before they were parameters.
 const kalpFoundation = "0b87970433b22494faff1cc7a819e71bddc7880c"
 const intialgasfeesadmin = "fb2305a2373fd9fa5b5bf5acc6fdbf22ecbde930"
 const intialkalpGateWayadmin = "67c30fcb223182fef1c471a26527bfc4c50d093c"
@@ -32,6 +32,7 @@ const gasFeesAdminRole = "GasFeesAdmin"
 const kalpGateWayAdmin = "KalpGatewayAdmin"
 const userRolePrefix = "ID~UserRoleMap"
 const UserRoleMap = "UserRoleMap"
+const roleMemberPrefix = "Role~ID"
 const BridgeContractAddress = "klp-6b616c70627269646765-cc"
 
 type SmartContract struct {
@@ -50,6 +51,8 @@ type UserRole struct {
 	Role    string `json:"Role"`
 	DocType string `json:"DocType"`
 	Desc    string `json:"Desc"`
+	// ExpiresAt is the unix time from which the role is no longer granted, or 0 if it doesn't expire.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
 }
 
 type Sender struct {
@@ -62,28 +65,28 @@ func (s *SmartContract) InitLedger(ctx kalpsdk.TransactionContextInterface) erro
 	return nil
 }
 
-// Initializing smart contract
-func (s *SmartContract) Initialize(ctx kalpsdk.TransactionContextInterface, name string, symbol string) (bool, error) {
+// Initializing smart contract. The deploy-time foundation identity initializes it with the addresses of
+// the foundation, the gas fees admin and the gateway admin.
+func (s *SmartContract) Initialize(ctx kalpsdk.TransactionContextInterface, name string, symbol string, foundation string, gasFeesAdmin string, gatewayAdmin string) (bool, error) {
 	//check contract options are not already set, client is not authorized to change them once intitialized
+	ctx = NewUnitOfWork(ctx)
 
 	operator, err := GetUserId(ctx)
 	if err != nil {
 		return false, fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
 	}
+	// Only the identity the contract was deployed for can hand out the governance addresses.
 	if operator != kalpFoundation {
-		return false, fmt.Errorf("error with status code %v, only kalp foundation can intialize the contract: %v", http.StatusBadRequest, err)
-	}
-	_, err = InitializeRoles(ctx, kalpFoundation, kalpFoundationRole)
-	if err != nil {
-		return false, fmt.Errorf("error in initializing roles: %v", err)
-	}
-	_, err = InitializeRoles(ctx, intialgasfeesadmin, gasFeesAdminRole)
-	if err != nil {
-		return false, fmt.Errorf("error in initializing roles: %v", err)
-	}
-	_, err = InitializeRoles(ctx, intialkalpGateWayadmin, kalpGateWayAdmin)
+		return false, fmt.Errorf("error with status code %v, only kalp foundation can intialize the contract", http.StatusForbidden)
+	}
+	foundation = strings.Trim(foundation, " ")
+	err = initializeGovernance(ctx, map[string]string{
+		kalpFoundationRole: foundation,
+		gasFeesAdminRole:   strings.Trim(gasFeesAdmin, " "),
+		kalpGateWayAdmin:   strings.Trim(gatewayAdmin, " "),
+	})
 	if err != nil {
-		return false, fmt.Errorf("error in initializing roles: %v", err)
+		return false, err
 	}
 	bytes, err := ctx.GetState(nameKey)
 	if err != nil {
@@ -102,14 +105,21 @@ func (s *SmartContract) Initialize(ctx kalpsdk.TransactionContextInterface, name
 		return false, fmt.Errorf("failed to set symbol: %v", err)
 	}
 	//setting initial gas fees
-	err = ctx.PutStateWithoutKYC(gasFeesKey, []byte(initialGasFees))
+	now, err := txTime(ctx)
 	if err != nil {
-		return false, fmt.Errorf("failed to set gasfees: %v", err)
+		return false, err
+	}
+	_, err = changeGasFeePolicy(ctx, GasFeeInitialized, operator, &GasFeePolicy{Flat: initialGasFees, Min: "0"}, now)
+	if err != nil {
+		return false, err
 	}
 	err = s.mint(ctx, BridgeContractAddress, totalSupply)
 	if err != nil {
 		return false, fmt.Errorf("error with status code %v,error in minting: %v", http.StatusInternalServerError, err)
 	}
+	if err := recordAdminAudit(ctx, "Initialize", []string{name, symbol, foundation, gasFeesAdmin, gatewayAdmin}, nil); err != nil {
+		return false, err
+	}
 	return true, nil
 }
 
@@ -133,39 +143,71 @@ func (s *SmartContract) Decimals(ctx kalpsdk.TransactionContextInterface) uint8
 	return 18
 }
 
-func (s *SmartContract) GetGasFees(ctx kalpsdk.TransactionContextInterface) (string, error) {
-	bytes, err := ctx.GetState(gasFeesKey)
+// GetGasFees returns the gas fee policy in effect: a flat fee, a basis point share of the amount, and the
+// minimum and maximum fee. A scheduled change that hasn't taken effect yet is returned as upcoming.
+func (s *SmartContract) GetGasFees(ctx kalpsdk.TransactionContextInterface) (*GasFees, error) {
+	policy, err := getGasFeePolicy(ctx)
 	if err != nil {
-		// return "", fmt.Errorf("failed to get Name: %v", err)
 		fmt.Printf("failed to get Gas Fee: %v", err)
-		return "", fmt.Errorf("failed to get Gas Fee: %v", err)
+		return nil, err
 	}
-	if bytes == nil {
-		return "", fmt.Errorf("gas fee not set")
+	gasFees := &GasFees{GasFeePolicy: *policy}
+	change, err := getGasFeeChange(ctx)
+	if err != nil {
+		return nil, err
 	}
-	return string(bytes), nil
+	if change != nil {
+		due, err := change.due(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if !due {
+			gasFees.Upcoming = change
+		}
+	}
+	return gasFees, nil
 }
 
+// SetGasFees is a smart contract function which lets the gas fees admin set the gas fee policy. It takes
+// a JSON policy, e.g. {"flat":"1000","basisPoints":10,"min":"1000","max":"1000000"}, or a plain number
+// for a flat fee. The policy takes effect immediately; ScheduleGasFeeChange gives integrators notice of a
+// change instead.
 func (s *SmartContract) SetGasFees(ctx kalpsdk.TransactionContextInterface, gasFees string) error {
 	logger := kalpsdk.NewLogger()
-	operator, err := GetUserId(ctx)
+	ctx = NewUnitOfWork(ctx)
+	operator, err := s.requirePermission(ctx, PermissionSetGasFees)
 	if err != nil {
-		return fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
+		logger.Infof("set gas fees err: %v", err)
+		return err
 	}
-	userRole, err := s.GetUserRoles(ctx, operator)
+	if err := requireMultisigProposal(ctx, ActionSetGasFees); err != nil {
+		return err
+	}
+	return replaceGasFees(ctx, operator, gasFees)
+}
+
+// replaceGasFees replaces the gas fee policy and records the change.
+func replaceGasFees(ctx kalpsdk.TransactionContextInterface, operator string, gasFees string) error {
+	policy, err := parseGasFeePolicy(gasFees)
 	if err != nil {
-		logger.Infof("error checking operator's role: %v", err)
-		return fmt.Errorf("error checking operator's role: %v", err)
+		return fmt.Errorf("error with status code %v, %v", http.StatusBadRequest, err)
 	}
-	logger.Infof("useRole: %s\n", userRole)
-	if userRole != gasFeesAdminRole {
-		return fmt.Errorf("error with status code %v, error: only gas fees admin is allowed to update gas fees", http.StatusInternalServerError)
+	// A scheduled change that has taken effect would otherwise still override the new policy.
+	if err := applyDueGasFeeChange(ctx); err != nil {
+		return err
 	}
-	err = ctx.PutStateWithoutKYC(gasFeesKey, []byte(gasFees))
+	if err := auditKeyChange(ctx, "SetGasFees", []string{gasFees}, gasFeesKey); err != nil {
+		return err
+	}
+	now, err := txTime(ctx)
 	if err != nil {
-		return fmt.Errorf("failed to set gasfees: %v", err)
+		return err
 	}
-	return nil
+	record, err := changeGasFeePolicy(ctx, GasFeeSet, operator, policy, now)
+	if err != nil {
+		return err
+	}
+	return emitGasFeeChanged(ctx, record)
 }
 
 func (s *SmartContract) mint(ctx kalpsdk.TransactionContextInterface, address string, amount string) error {
@@ -180,7 +222,7 @@ func (s *SmartContract) mint(ctx kalpsdk.TransactionContextInterface, address st
 		return fmt.Errorf("error with status code %v, invalid amount %v", http.StatusBadRequest, amount)
 	}
 
-	balance, _ := GetTotalUTXO(ctx, address)
+	balance, _ := GetBalance(ctx, address)
 	logger.Infof("balance: %s", balance)
 	balanceAmount, su := big.NewInt(0).SetString(balance, 10)
 	if !su {
@@ -300,245 +342,52 @@ func (s *SmartContract) mint(ctx kalpsdk.TransactionContextInterface, address st
 func (s *SmartContract) Transfer(ctx kalpsdk.TransactionContextInterface, address string, amount string) (bool, error) {
 	logger := kalpsdk.NewLogger()
 	logger.Info("Transfer---->")
+	ctx = NewUnitOfWork(ctx)
 	address = strings.Trim(address, " ")
-	if address == "" {
-		return false, fmt.Errorf("invalid input address")
-	}
 
 	sender, err := ctx.GetUserID()
 	if err != nil {
 		return false, fmt.Errorf("error in getting user id: %v", err)
 	}
-	userRole, err := s.GetUserRoles(ctx, sender)
+	viaGateway, err := s.hasPermission(ctx, sender, PermissionCollectGatewayFee)
 	if err != nil {
 		logger.Infof("error checking user's role: %v", err)
 		return false, fmt.Errorf("error checking user's role:: %v", err)
 	}
-	if len(address) != 40 && userRole != kalpGateWayAdmin {
-		return false, fmt.Errorf("address must be 40 characters long")
-	}
-	if strings.ContainsAny(address, "`~!@#$%^&*()-_+=[]{}\\|;':\",./<>? ") && userRole != kalpGateWayAdmin {
-		return false, fmt.Errorf("invalid address")
+	viaBridge := false
+	if !viaGateway {
+		b, err := IsCallerKalpBridge(ctx, BridgeContractAddress)
+		viaBridge = b && err == nil
 	}
-	gasFees, err := s.GetGasFees(ctx)
+	plan, err := planTransfer(ctx, sender, address, amount, viaGateway, viaBridge)
 	if err != nil {
-		return false, fmt.Errorf("failed to get gas gee: %v", err)
-	}
-	gasFeesAmount, su := big.NewInt(0).SetString(gasFees, 10)
-	if !su {
-		return false, fmt.Errorf("gasfee can't be converted to big int")
+		logger.Infof("transfer err: %v", err)
+		return false, err
 	}
-	validateAmount, su := big.NewInt(0).SetString(amount, 10)
-	if !su {
-		logger.Infof("Amount can't be converted to string")
-		return false, fmt.Errorf("error with status code %v, invalid Amount %v", http.StatusBadRequest, amount)
-	}
-	if validateAmount.Cmp(big.NewInt(0)) == -1 || validateAmount.Cmp(big.NewInt(0)) == 0 { // <= 0 {
-		return false, fmt.Errorf("error with status code %v, invalid Amount %v", http.StatusBadRequest, amount)
-	}
-	logger.Infof("useRole: %s\n", userRole)
-	// Covers below 2 scenarios where gateway deducts gas fees and transfers to kalp foundation:
-	// 1. when Dapp/users sends non-GINI transactions via gateway
-	// 2. when HandleBridgeToken from bridge contract is called by Bridge Admin
-	if userRole == kalpGateWayAdmin {
-		var send Sender
-		errs := json.Unmarshal([]byte(address), &send)
-		if errs != nil {
-			logger.Info("internal error: error in parsing sender data")
-			return false, fmt.Errorf("internal error: error in parsing sender data")
-		}
-		if len(send.Sender) != 40 {
-			return false, fmt.Errorf("address must be 40 characters long")
-		}
-		if strings.ContainsAny(send.Sender, "`~!@#$%^&*()-_+=[]{}\\|;':\",./<>? ") {
-			return false, fmt.Errorf("invalid address")
-		}
-		if send.Sender != kalpFoundation {
-			gRemoveAmount, su := big.NewInt(0).SetString(amount, 10)
-			if !su {
-				logger.Infof("amount can't be converted to string ")
-
-				return false, fmt.Errorf("amount can't be converted to string: %v ", err)
-			}
-			err = RemoveUtxo(ctx, send.Sender, gRemoveAmount)
-			if err != nil {
-				logger.Infof("transfer remove err: %v", err)
-				return false, fmt.Errorf("transfer remove err: %v", err)
-			}
-			gAddAmount, su := big.NewInt(0).SetString(amount, 10)
-			if !su {
-				logger.Infof("amount can't be converted to string ")
-
-				return false, fmt.Errorf("amount can't be converted to string: %v ", err)
-			}
-			err = AddUtxo(ctx, kalpFoundation, gAddAmount)
-			if err != nil {
-				logger.Infof("err: %v\n", err)
-				return false, fmt.Errorf("transfer add err: %v", err)
-			}
-			logger.Infof("foundation transfer : %s\n", userRole)
-		}
-	} else if b, err := IsCallerKalpBridge(ctx, BridgeContractAddress); b && err == nil {
-		// In this scenario transfer function is invoked fron Withdraw token funtion from bridge contract address
-		logger.Infof("sender address changed to Bridge contract addres: \n", BridgeContractAddress)
-		// In this scenario sender is kalp foundation is bridgeing from WithdrawToken Function,
-		// will credit amount to kalp foundation and remove amount from sender without gas fees
-		if sender == kalpFoundation {
-			sender = BridgeContractAddress
-			subAmount, su := big.NewInt(0).SetString(amount, 10)
-			if !su {
-				logger.Infof("amount can't be converted to string ")
-				return false, fmt.Errorf("amount can't be converted to string: %v ", err)
-			}
-
-			err = RemoveUtxo(ctx, sender, subAmount)
-			if err != nil {
-				logger.Infof("transfer remove err: %v", err)
-				return false, fmt.Errorf("transfer remove err: %v", err)
-			}
-			addAmount, su := big.NewInt(0).SetString(amount, 10)
-			if !su {
-				logger.Infof("amount can't be converted to string ")
-				return false, fmt.Errorf("amount can't be converted to string: %v ", err)
-			}
-			err = AddUtxo(ctx, kalpFoundation, addAmount)
-			if err != nil {
-				logger.Infof("err: %v\n", err)
-				return false, fmt.Errorf("transfer add err: %v", err)
-			}
-			logger.Infof("bridge transfer to foundation : %s\n", kalpFoundation)
-		} else {
-			// In this scenario sender is Kalp Bridge we will credit gas fees to kalp foundation and remove amount from bridge contract
-			// address. Reciver will recieve amount after gas fees deduction
-			sender = BridgeContractAddress
-			removeAmount, su := big.NewInt(0).SetString(amount, 10)
-			if !su {
-				logger.Infof("amount can't be converted to string ")
-				return false, fmt.Errorf("amount can't be converted to string: %v ", err)
-			}
-			if removeAmount.Cmp(gasFeesAmount) == -1 || removeAmount.Cmp(gasFeesAmount) == 0 {
-				return false, fmt.Errorf("error with status code %v, error:bridge amount can not be less than equal to gas fee", http.StatusBadRequest)
-			}
-			err = RemoveUtxo(ctx, sender, removeAmount)
-			if err != nil {
-				logger.Infof("transfer remove err: %v", err)
-				return false, fmt.Errorf("transfer remove err: %v", err)
-			}
-			addAmount, su := big.NewInt(0).SetString(amount, 10)
-			if !su {
-				logger.Infof("amount can't be converted to string ")
-				return false, fmt.Errorf("amount can't be converted to string: %v ", err)
-			}
-
-			bridgedAmount := addAmount.Sub(addAmount, gasFeesAmount)
-			logger.Infof("bridgedAmount :%v", bridgedAmount)
-			err = AddUtxo(ctx, address, bridgedAmount)
-			if err != nil {
-				logger.Infof("err: %v\n", err)
-				return false, fmt.Errorf("transfer add err: %v", err)
-			}
-			err = AddUtxo(ctx, kalpFoundation, gasFeesAmount)
-			if err != nil {
-				logger.Infof("err: %v\n", err)
-				return false, fmt.Errorf("transfer add err: %v", err)
-			}
-			logger.Infof("bridge transfer to normal user : %s\n", userRole)
-		}
-	} else if sender == kalpFoundation && address == kalpFoundation {
-		//In this scenario sender is kalp foundation and address is the kalp foundation so no addition or removal is required
-		logger.Infof("foundation transfer to foundation : %s address:%s\n", sender, address)
-
-	} else if sender == kalpFoundation {
-		//In this scenario sender is kalp foundation and address is the reciver so no gas fees deduction in code
-		subAmount, su := big.NewInt(0).SetString(amount, 10)
-		if !su {
-			logger.Infof("amount can't be converted to string ")
-			return false, fmt.Errorf("amount can't be converted to string: %v ", err)
+	logger.Infof("transfer path %s: %s -> %s, amount %s, gas fee %s", plan.Path, plan.From, plan.To, plan.Amount, plan.Fee)
+	if plan.From != plan.To {
+		transferAmount, _ := big.NewInt(0).SetString(plan.Amount, 10)
+		if err := checkFoundationTransfer(ctx, plan.From, transferAmount); err != nil {
+			return false, err
 		}
-		err := RemoveUtxo(ctx, sender, subAmount)
-		if err != nil {
-			logger.Infof("transfer remove err: %v", err)
-			return false, fmt.Errorf("transfer remove err: %v", err)
-		}
-		addAmount, su := big.NewInt(0).SetString(amount, 10)
-		if !su {
-			logger.Infof("amount can't be converted to string ")
-			return false, fmt.Errorf("amount can't be converted to string: %v ", err)
-		}
-		err = AddUtxo(ctx, address, addAmount)
-		if err != nil {
-			logger.Infof("err: %v\n", err)
-			return false, fmt.Errorf("transfer add err: %v", err)
-		}
-		logger.Infof("foundation transfer to user : %s\n", userRole)
-
-	} else if address == kalpFoundation {
-		//In this scenario sender is normal user and address is the kap foundation so gas fees+amount will be credited to kalp foundation
-		removeAmount, su := big.NewInt(0).SetString(amount, 10)
-		if !su {
-			logger.Infof("removeAmount can't be converted to string ")
-			return false, fmt.Errorf("removeAmount can't be converted to string: %v ", err)
-		}
-		err := RemoveUtxo(ctx, sender, removeAmount)
-		if err != nil {
-			logger.Infof("transfer remove err: %v", err)
-			return false, fmt.Errorf("transfer remove err: %v", err)
-		}
-		addAmount, su := big.NewInt(0).SetString(amount, 10)
-		if !su {
-			logger.Infof("amount can't be converted to string ")
-			return false, fmt.Errorf("amount can't be converted to string: %v ", err)
-		}
-		err = AddUtxo(ctx, address, addAmount)
-		if err != nil {
-			logger.Infof("err: %v\n", err)
-			return false, fmt.Errorf("transfer add err: %v", err)
-		}
-		logger.Infof("foundation transfer to user : %s\n", userRole)
-	} else {
-		//This is normal scenario where amount will be deducted from sender and amount-gas fess will credited to address and gas fees will be credited to kalp foundation
-		logger.Infof("operator-->", sender)
-		logger.Info("transfer transferAmount")
-		if sender == address {
-			return false, fmt.Errorf("transfer to self not alllowed")
-		}
-		transferAmount, su := big.NewInt(0).SetString(amount, 10)
-		if !su {
-			logger.Infof("Amount can't be converted to string")
-			return false, fmt.Errorf("error with status code %v,Amount can't be converted to string", http.StatusConflict)
-		}
-		if transferAmount.Cmp(gasFeesAmount) == -1 || transferAmount.Cmp(gasFeesAmount) == 0 {
-			return false, fmt.Errorf("error with status code %v, error:transfer amount can not be less than equal to gas fee", http.StatusBadRequest)
-		}
-		logger.Infof("transferAmount %v\n", transferAmount)
-		logger.Infof("gasFeesAmount %v\n", gasFeesAmount)
-		// Withdraw the funds from the sender address
-		err = RemoveUtxo(ctx, sender, transferAmount)
-		if err != nil {
-			logger.Infof("transfer remove err: %v", err)
-			return false, fmt.Errorf("error with status code %v, error:error while reducing balance %v", http.StatusBadRequest, err)
-		}
-		addAmount, su := big.NewInt(0).SetString(amount, 10)
-		if !su {
-			logger.Infof("transfer Amount can't be converted to string ")
-			return false, fmt.Errorf("error with status code %v,transaction %v already accounted", http.StatusConflict, transferAmount)
-		}
-		logger.Infof("Add amount %v\n", addAmount)
-		addAmounts := addAmount.Sub(addAmount, gasFeesAmount)
-		// Deposit the fund to the recipient address
-		err = AddUtxo(ctx, address, addAmounts)
-		if err != nil {
-			logger.Infof("err: %v\n", err)
-			return false, fmt.Errorf("error with status code %v, error:error while adding balance %v", http.StatusBadRequest, err)
-		}
-		logger.Infof("gasFeesAmount %v\n", gasFeesAmount)
-		err = AddUtxo(ctx, kalpFoundation, gasFeesAmount)
-		if err != nil {
-			logger.Infof("err: %v\n", err)
-			return false, fmt.Errorf("error with status code %v, error:error while adding balance %v", http.StatusBadRequest, err)
+	}
+	// A gateway fee named from the foundation moves nothing, as before CollectGatewayFee.
+	if plan.Path == GatewayPath && plan.From != plan.To {
+		// Compatibility shim for gateways that haven't moved to CollectGatewayFee. The fee gets a receipt
+		// under the transaction ID, and the TransferSingle event is emitted as before.
+		fee, _ := big.NewInt(0).SetString(plan.Fee, 10)
+		if _, err := collectGatewayFee(ctx, sender, plan.From, fee, legacyGatewayDappID, ctx.GetTxID()); err != nil {
+			logger.Infof("transfer err: %v", err)
+			return false, err
 		}
+	} else if err := executeTransfer(ctx, plan); err != nil {
+		logger.Infof("transfer err: %v", err)
+		return false, err
 	}
-	transferSingleEvent := TransferSingle{Operator: sender, From: sender, To: address, Value: amount}
+	if viaBridge {
+		sender = BridgeContractAddress
+	}
+	transferSingleEvent := TransferSingle{Operator: sender, From: sender, To: address, Value: amount, Sponsor: plan.Sponsor}
 	if err := EmitTransferSingle(ctx, transferSingleEvent); err != nil {
 		logger.Infof("err: %v\n", err)
 		return false, fmt.Errorf("error with status code %v, error:error while adding balance %v", http.StatusBadRequest, err)
@@ -548,6 +397,7 @@ func (s *SmartContract) Transfer(ctx kalpsdk.TransactionContextInterface, addres
 }
 
 func (s *SmartContract) BalanceOf(ctx kalpsdk.TransactionContextInterface, owner string) (string, error) {
+	ctx = NewQueryContext(ctx)
 	logger := kalpsdk.NewLogger()
 	owner = strings.Trim(owner, " ")
 	if owner == "" {
@@ -559,7 +409,7 @@ func (s *SmartContract) BalanceOf(ctx kalpsdk.TransactionContextInterface, owner
 	if strings.ContainsAny(owner, "`~!@#$%^&*()-_+=[]{}\\|;':\",./<>? ") && owner != BridgeContractAddress {
 		return big.NewInt(0).String(), fmt.Errorf("invalid address")
 	}
-	amt, err := GetTotalUTXO(ctx, owner)
+	amt, err := GetBalance(ctx, owner)
 	if err != nil {
 		return big.NewInt(0).String(), fmt.Errorf("error: %v", err)
 	}
@@ -569,6 +419,31 @@ func (s *SmartContract) BalanceOf(ctx kalpsdk.TransactionContextInterface, owner
 	return amt, nil
 }
 
+// MigrateUtxoKeys is a smart contract function which moves the UTXOs of an account created before
+// outputs were indexed to the UTXO~account~txID~index key format. It returns the number of UTXOs moved.
+func (s *SmartContract) MigrateUtxoKeys(ctx kalpsdk.TransactionContextInterface, account string) (int, error) {
+	userValid, err := s.HasPermission(ctx, PermissionMigrateUtxoKeys)
+	if err != nil {
+		return 0, fmt.Errorf("error in validating the role %v", err)
+	}
+	if !userValid {
+		return 0, fmt.Errorf("error with status code %v, only %s can migrate utxos", http.StatusBadRequest, kalpFoundationRole)
+	}
+	account = strings.Trim(account, " ")
+	if account == "" {
+		return 0, fmt.Errorf("invalid input account is required")
+	}
+	ctx = NewUnitOfWork(ctx)
+	if err := recordAdminAudit(ctx, "MigrateUtxoKeys", []string{account}, nil); err != nil {
+		return 0, err
+	}
+	migrated, err := migrateUtxoKeys(ctx, account)
+	if err != nil {
+		return 0, fmt.Errorf("error with status code %v, failed to migrate utxos: %v", http.StatusInternalServerError, err)
+	}
+	return migrated, nil
+}
+
 // GetTransactionTimestamp retrieves the transaction timestamp from the context and returns it as a string.
 func (s *SmartContract) GetTransactionTimestamp(ctx kalpsdk.TransactionContextInterface) (string, error) {
 	timestamp, err := ctx.GetTxTimestamp()
@@ -580,6 +455,7 @@ func (s *SmartContract) GetTransactionTimestamp(ctx kalpsdk.TransactionContextIn
 }
 
 func (s *SmartContract) Approve(ctx kalpsdk.TransactionContextInterface, spender string, value string) (bool, error) {
+	ctx = NewUnitOfWork(ctx)
 	owner, err := ctx.GetUserID()
 	if err != nil {
 		return false, err
@@ -596,10 +472,14 @@ func (s *SmartContract) Approve(ctx kalpsdk.TransactionContextInterface, spender
 func (s *SmartContract) TransferFrom(ctx kalpsdk.TransactionContextInterface, from string, to string, value string) (bool, error) {
 	logger := kalpsdk.NewLogger()
 	logger.Info("TransferFrom---->")
+	ctx = NewUnitOfWork(ctx)
 	spender, err := ctx.GetUserID()
 	if err != nil {
 		return false, fmt.Errorf("error iin getting spender's id: %v", err)
 	}
+	if err := checkSponsorEscrowReceiver(strings.Trim(to, " ")); err != nil {
+		return false, err
+	}
 	err = TransferUTXOFrom(ctx, []string{from}, []string{spender}, to, value, UTXO)
 	if err != nil {
 		logger.Infof("err: %v\n", err)
@@ -617,6 +497,17 @@ func (s *SmartContract) Allowance(ctx kalpsdk.TransactionContextInterface, owner
 	return allowance, nil
 }
 
+// TotalSupply returns the tokens in circulation, which excludes the tokens burned by sending them to
+// BurnAddress.
 func (s *SmartContract) TotalSupply(ctx kalpsdk.TransactionContextInterface) (string, error) {
-	return totalSupply, nil
+	burned, err := GetBalance(ctx, BurnAddress)
+	if err != nil {
+		return "", fmt.Errorf("failed to get burned balance: %v", err)
+	}
+	supply, _ := big.NewInt(0).SetString(totalSupply, 10)
+	burnedAmount, ok := big.NewInt(0).SetString(burned, 10)
+	if !ok {
+		return "", fmt.Errorf("invalid burned balance %v", burned)
+	}
+	return supply.Sub(supply, burnedAmount).String(), nil
 }
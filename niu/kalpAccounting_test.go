@@ -0,0 +1,186 @@
+package kalpAccounting
+
+import (
+	"math/big"
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	alice = "a11ce00000000000000000000000000000000001"
+	bob   = "b0b0000000000000000000000000000000000002"
+	carol = "ca20100000000000000000000000000000000003"
+)
+
+// newInitializedLedger returns a CouchDB ledger on which the foundation has called Initialize.
+func newInitializedLedger(t *testing.T) (*fakeledger.Ledger, *SmartContract) {
+	t.Helper()
+	return initializeLedger(t, fakeledger.New())
+}
+
+func initializeLedger(t *testing.T, l *fakeledger.Ledger) (*fakeledger.Ledger, *SmartContract) {
+	t.Helper()
+	s := &SmartContract{}
+	require.NoError(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.Initialize(ctx, "GINI", "GINI", kalpFoundation, intialgasfeesadmin, intialkalpGateWayadmin)
+		return err
+	}))
+	return l, s
+}
+
+func balanceOf(t *testing.T, l *fakeledger.Ledger, s *SmartContract, account string) string {
+	t.Helper()
+	balance, err := s.BalanceOf(l.NewTransaction(account), account)
+	require.NoError(t, err)
+	return balance
+}
+
+func transfer(l *fakeledger.Ledger, s *SmartContract, from string, to string, amount string) error {
+	return l.Submit(from, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.Transfer(ctx, to, amount)
+		return err
+	})
+}
+
+func sum(amounts ...string) string {
+	total := big.NewInt(0)
+	for _, a := range amounts {
+		n, _ := big.NewInt(0).SetString(a, 10)
+		total.Add(total, n)
+	}
+	return total.String()
+}
+
+func TestInitialize(t *testing.T) {
+	l, s := newInitializedLedger(t)
+
+	require.Equal(t, intialFoundationBalance, balanceOf(t, l, s, kalpFoundation))
+	require.Equal(t, intialBridgeContractBalance, balanceOf(t, l, s, BridgeContractAddress))
+
+	roles, err := s.ListUserRoles(l.NewTransaction(alice), intialgasfeesadmin)
+	require.NoError(t, err)
+	require.Equal(t, []string{gasFeesAdminRole}, roles)
+	role, err := s.GetUserRoles(l.NewTransaction(alice), intialgasfeesadmin)
+	require.NoError(t, err)
+	require.Equal(t, gasFeesAdminRole, role)
+
+	err = l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.Initialize(ctx, "GINI", "GINI", kalpFoundation, intialgasfeesadmin, intialkalpGateWayadmin)
+		return err
+	})
+	require.Error(t, err, "initialize must only succeed once")
+
+	err = l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.Initialize(ctx, "GINI", "GINI", kalpFoundation, intialgasfeesadmin, intialkalpGateWayadmin)
+		return err
+	})
+	require.Error(t, err)
+}
+
+func TestInitializeGovernanceAddresses(t *testing.T) {
+	l := fakeledger.New()
+	s := &SmartContract{}
+	initialize := func(operator, foundation, gasFeesAdmin, gatewayAdmin string) error {
+		return l.Submit(operator, func(ctx *fakeledger.TransactionContext) error {
+			_, err := s.Initialize(ctx, "GINI", "GINI", foundation, gasFeesAdmin, gatewayAdmin)
+			return err
+		})
+	}
+	require.Error(t, initialize(alice, alice, bob, carol), "only the deploy-time foundation initializes the contract")
+	require.Error(t, initialize(bob, kalpFoundation, intialgasfeesadmin, intialkalpGateWayadmin))
+	require.Error(t, initialize(kalpFoundation, alice, "bob", carol))
+	require.NoError(t, initialize(kalpFoundation, alice, bob, carol))
+
+	require.Equal(t, intialFoundationBalance, balanceOf(t, l, s, alice))
+	require.Equal(t, "0", balanceOf(t, l, s, kalpFoundation))
+	governance, err := s.GetGovernance(l.NewTransaction(bob))
+	require.NoError(t, err)
+	require.Equal(t, []GovernanceAddress{
+		{Role: kalpFoundationRole, DocType: GovernanceDocType, Address: alice},
+		{Role: gasFeesAdminRole, DocType: GovernanceDocType, Address: bob},
+		{Role: kalpGateWayAdmin, DocType: GovernanceDocType, Address: carol},
+	}, governance)
+	require.True(t, hasPermission(t, l, s, bob, PermissionSetGasFees))
+	require.False(t, hasPermission(t, l, s, intialgasfeesadmin, PermissionSetGasFees))
+
+	// The foundation sends without gas fees and collects the fees of others.
+	require.NoError(t, transfer(l, s, alice, dapp, "1000000000000000000"))
+	require.Equal(t, "1000000000000000000", balanceOf(t, l, s, dapp))
+	require.NoError(t, transfer(l, s, dapp, bob, "2000000000000000"))
+	require.Equal(t, sum(intialFoundationBalance, "-1000000000000000000", initialGasFees), balanceOf(t, l, s, alice))
+}
+
+func TestTransfer(t *testing.T) {
+	l, s := newInitializedLedger(t)
+
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	require.Equal(t, "5000000000000000000", balanceOf(t, l, s, alice))
+
+	require.NoError(t, transfer(l, s, alice, bob, "2000000000000000000"))
+	require.Equal(t, "3000000000000000000", balanceOf(t, l, s, alice))
+	require.Equal(t, "1999000000000000000", balanceOf(t, l, s, bob))
+	require.Equal(t, sum(intialFoundationBalance, "-5000000000000000000", initialGasFees), balanceOf(t, l, s, kalpFoundation))
+
+	require.Error(t, transfer(l, s, alice, bob, "4000000000000000000"), "insufficient balance")
+	require.Error(t, transfer(l, s, alice, bob, initialGasFees), "amount must exceed the gas fee")
+	require.Error(t, transfer(l, s, alice, alice, "2000000000000000000"), "transfer to self")
+	require.Equal(t, "3000000000000000000", balanceOf(t, l, s, alice))
+
+	events := l.Events()
+	require.Equal(t, "TransferSingle", events[len(events)-1].Name)
+}
+
+func TestTransferFrom(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "1000"))
+
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.Approve(ctx, bob, "600")
+		return err
+	}))
+	require.NoError(t, l.Submit(bob, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.TransferFrom(ctx, alice, carol, "400")
+		return err
+	}))
+
+	require.Equal(t, "600", balanceOf(t, l, s, alice))
+	require.Equal(t, "400", balanceOf(t, l, s, carol))
+	allowance, err := s.Allowance(l.NewTransaction(bob), alice, bob)
+	require.NoError(t, err)
+	require.Equal(t, "200", allowance)
+
+	err = l.Submit(bob, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.TransferFrom(ctx, alice, carol, "300")
+		return err
+	})
+	require.Error(t, err, "transfer above allowance")
+}
+
+func TestRemoveUtxo(t *testing.T) {
+	l := fakeledger.New()
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return AddUtxo(NewUnitOfWork(ctx), alice, big.NewInt(30))
+	}))
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return AddUtxo(NewUnitOfWork(ctx), alice, big.NewInt(20))
+	}))
+
+	total, err := GetTotalUTXO(l.NewTransaction(alice), alice)
+	require.NoError(t, err)
+	require.Equal(t, "50", total)
+
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return RemoveUtxo(NewUnitOfWork(ctx), alice, big.NewInt(35))
+	}))
+	total, err = GetTotalUTXO(l.NewTransaction(alice), alice)
+	require.NoError(t, err)
+	require.Equal(t, "15", total)
+
+	err = l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return RemoveUtxo(NewUnitOfWork(ctx), alice, big.NewInt(16))
+	})
+	require.ErrorContains(t, err, "insufficient balance")
+}
@@ -0,0 +1,542 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+	"golang.org/x/exp/slices"
+)
+
+const multisigKey = "multisig"
+const MultisigProposalDocType = "MultisigProposal"
+
+const maxMultisigSigners = 20
+
+// Actions that need a multisig proposal once signers are configured, and the arguments they take.
+const (
+	// ActionSetUserRoles takes the role assignment SetUserRoles takes.
+	ActionSetUserRoles = "SetUserRoles"
+	// ActionSetGasFees takes the gas fee policy.
+	ActionSetGasFees = "SetGasFees"
+	// ActionScheduleGasFeeChange takes the gas fee policy and the unix time it takes effect at.
+	ActionScheduleGasFeeChange = "ScheduleGasFeeChange"
+	// ActionSetGasFeeSplit takes the fee split.
+	ActionSetGasFeeSplit = "SetGasFeeSplit"
+	// ActionProposeGovernanceAddress takes the governance role and the proposed address.
+	ActionProposeGovernanceAddress = "ProposeGovernanceAddress"
+	// ActionTransfer takes the receiver and the amount of a transfer from the foundation.
+	ActionTransfer = "Transfer"
+	// ActionSetMultisig takes the new multisig configuration. Without signers it turns multisig off.
+	ActionSetMultisig = "SetMultisig"
+	// ActionRevokeUserRole takes the user ID and the role to revoke.
+	ActionRevokeUserRole = "RevokeUserRole"
+	// ActionAddFeeExemption takes the exempted address and the reason.
+	ActionAddFeeExemption = "AddFeeExemption"
+	// ActionRemoveFeeExemption takes the address to remove from the fee exemption registry.
+	ActionRemoveFeeExemption = "RemoveFeeExemption"
+	// ActionCancelGasFeeChange takes no arguments.
+	ActionCancelGasFeeChange = "CancelGasFeeChange"
+	// ActionRegisterDapp takes the dapp ID, its owner and its revenue share in basis points.
+	ActionRegisterDapp = "RegisterDapp"
+	// ActionClaimDappRevenue takes the dapp ID whose revenue is paid out of the foundation's balance.
+	ActionClaimDappRevenue = "ClaimDappRevenue"
+)
+
+var multisigActionArgs = map[string]int{
+	ActionSetUserRoles:             1,
+	ActionSetGasFees:               1,
+	ActionScheduleGasFeeChange:     2,
+	ActionSetGasFeeSplit:           1,
+	ActionProposeGovernanceAddress: 2,
+	ActionTransfer:                 2,
+	ActionSetMultisig:              1,
+	ActionRevokeUserRole:           2,
+	ActionAddFeeExemption:          2,
+	ActionRemoveFeeExemption:       1,
+	ActionCancelGasFeeChange:       0,
+	ActionRegisterDapp:             3,
+	ActionClaimDappRevenue:         1,
+}
+
+const (
+	ProposalPending   = "pending"
+	ProposalExecuted  = "executed"
+	ProposalCancelled = "cancelled"
+	// ProposalExpired is reported for pending proposals past their expiry. It isn't stored.
+	ProposalExpired = "expired"
+)
+
+// MultisigConfig is the set of signers that approve the sensitive foundation actions. An action executes
+// once Threshold signers have approved it. Transfers from the foundation of more than TransferThreshold
+// need a proposal, smaller ones don't. Proposals expire ProposalLifetime seconds after they are made.
+type MultisigConfig struct {
+	Signers           []string `json:"signers"`
+	Threshold         uint64   `json:"threshold"`
+	TransferThreshold string   `json:"transferThreshold"`
+	ProposalLifetime  int64    `json:"proposalLifetime"`
+}
+
+// MultisigProposal is an action proposed by a signer and the signers that approved it.
+type MultisigProposal struct {
+	ID         string   `json:"id"`
+	DocType    string   `json:"docType"`
+	Action     string   `json:"action"`
+	Args       []string `json:"args"`
+	Proposer   string   `json:"proposer"`
+	Approvals  []string `json:"approvals"`
+	Status     string   `json:"status"`
+	CreatedAt  int64    `json:"createdAt"`
+	ExpiresAt  int64    `json:"expiresAt"`
+	ExecutedAt int64    `json:"executedAt,omitempty"`
+}
+
+func validateMultisigConfig(config *MultisigConfig) error {
+	if len(config.Signers) == 0 || len(config.Signers) > maxMultisigSigners {
+		return fmt.Errorf("multisig must have between 1 and %d signers", maxMultisigSigners)
+	}
+	for i, signer := range config.Signers {
+		if len(signer) != 40 {
+			return fmt.Errorf("signer %q must be 40 characters long", signer)
+		}
+		if strings.ContainsAny(signer, "`~!@#$%^&*()-_+=[]{}\\|;':\",./<>? ") {
+			return fmt.Errorf("invalid signer %q", signer)
+		}
+		if slices.Contains(config.Signers[:i], signer) {
+			return fmt.Errorf("signer %s is listed twice", signer)
+		}
+	}
+	if config.Threshold == 0 || config.Threshold > uint64(len(config.Signers)) {
+		return fmt.Errorf("threshold must be between 1 and the number of signers %d", len(config.Signers))
+	}
+	threshold, ok := big.NewInt(0).SetString(config.TransferThreshold, 10)
+	if !ok || threshold.Sign() < 0 {
+		return fmt.Errorf("invalid transfer threshold %q", config.TransferThreshold)
+	}
+	if config.ProposalLifetime <= 0 {
+		return fmt.Errorf("proposal lifetime must be positive")
+	}
+	return nil
+}
+
+// getMultisigConfig returns the multisig configuration, or nil if no signers are configured.
+func getMultisigConfig(sdk kalpsdk.TransactionContextInterface) (*MultisigConfig, error) {
+	configJSON, err := sdk.GetState(multisigKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read multisig configuration: %v", err)
+	}
+	if configJSON == nil {
+		return nil, nil
+	}
+	var config MultisigConfig
+	if err := json.Unmarshal(configJSON, &config); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal multisig configuration: %v", err)
+	}
+	return &config, nil
+}
+
+// setMultisig replaces the multisig configuration. An empty list of signers removes it.
+func setMultisig(sdk kalpsdk.TransactionContextInterface, data string) error {
+	var config MultisigConfig
+	if err := json.Unmarshal([]byte(data), &config); err != nil {
+		return fmt.Errorf("error with status code %v, invalid multisig configuration: %v", http.StatusBadRequest, err)
+	}
+	if err := auditKeyChange(sdk, "SetMultisig", []string{data}, multisigKey); err != nil {
+		return err
+	}
+	if len(config.Signers) == 0 {
+		if err := sdk.DelStateWithoutKYC(multisigKey); err != nil {
+			return fmt.Errorf("failed to remove multisig configuration: %v", err)
+		}
+		return nil
+	}
+	for i := range config.Signers {
+		config.Signers[i] = strings.Trim(config.Signers[i], " ")
+	}
+	if err := validateMultisigConfig(&config); err != nil {
+		return fmt.Errorf("error with status code %v, %v", http.StatusBadRequest, err)
+	}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := sdk.PutStateWithoutKYC(multisigKey, configJSON); err != nil {
+		return fmt.Errorf("failed to set multisig configuration: %v", err)
+	}
+	return nil
+}
+
+// requireMultisigProposal rejects calling action directly once multisig signers are configured.
+func requireMultisigProposal(sdk kalpsdk.TransactionContextInterface, action string) error {
+	config, err := getMultisigConfig(sdk)
+	if err != nil || config == nil {
+		return err
+	}
+	return fmt.Errorf("error with status code %v, %s needs a multisig proposal approved by %d of %d signers", http.StatusForbidden, action, config.Threshold, len(config.Signers))
+}
+
+// checkFoundationTransfer rejects moving more than the multisig transfer threshold out of the
+// foundation's balance without a proposal.
+func checkFoundationTransfer(sdk kalpsdk.TransactionContextInterface, from string, amount *big.Int) error {
+	config, err := getMultisigConfig(sdk)
+	if err != nil || config == nil {
+		return err
+	}
+	foundation, err := foundationAddress(sdk)
+	if err != nil {
+		return err
+	}
+	if from != foundation {
+		return nil
+	}
+	threshold, _ := big.NewInt(0).SetString(config.TransferThreshold, 10)
+	if threshold != nil && amount.Cmp(threshold) <= 0 {
+		return nil
+	}
+	return fmt.Errorf("error with status code %v, transfers of more than %s from the foundation need a multisig proposal", http.StatusForbidden, config.TransferThreshold)
+}
+
+// approvals returns the number of current signers that approved proposal.
+func (config *MultisigConfig) approvals(proposal *MultisigProposal) uint64 {
+	var count uint64
+	for _, signer := range config.Signers {
+		if slices.Contains(proposal.Approvals, signer) {
+			count++
+		}
+	}
+	return count
+}
+
+func multisigProposalKey(sdk kalpsdk.TransactionContextInterface, id string) (string, error) {
+	key, err := sdk.CreateCompositeKey(MultisigProposalDocType, []string{id})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for proposal %s: %v", id, err)
+	}
+	return key, nil
+}
+
+func readMultisigProposal(sdk kalpsdk.TransactionContextInterface, id string) (*MultisigProposal, error) {
+	key, err := multisigProposalKey(sdk, id)
+	if err != nil {
+		return nil, err
+	}
+	proposalJSON, err := sdk.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read proposal %s: %v", id, err)
+	}
+	if proposalJSON == nil {
+		return nil, fmt.Errorf("error with status code %v, proposal %s not found", http.StatusNotFound, id)
+	}
+	var proposal MultisigProposal
+	if err := json.Unmarshal(proposalJSON, &proposal); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal proposal %s: %v", id, err)
+	}
+	return &proposal, nil
+}
+
+func writeMultisigProposal(sdk kalpsdk.TransactionContextInterface, proposal *MultisigProposal) error {
+	key, err := multisigProposalKey(sdk, proposal.ID)
+	if err != nil {
+		return err
+	}
+	proposalJSON, err := json.Marshal(proposal)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := sdk.PutStateWithoutKYC(key, proposalJSON); err != nil {
+		return fmt.Errorf("failed to write proposal %s: %v", proposal.ID, err)
+	}
+	return nil
+}
+
+func emitMultisigProposal(sdk kalpsdk.TransactionContextInterface, name string, proposal *MultisigProposal) error {
+	proposalJSON, err := json.Marshal(proposal)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := sdk.SetEvent(name, proposalJSON); err != nil {
+		return fmt.Errorf("failed to set event: %v", err)
+	}
+	return nil
+}
+
+// executeMultisigAction performs the action of an approved proposal with the authority of the role that
+// would otherwise call it. It reports whether the action emitted its own event.
+func executeMultisigAction(sdk kalpsdk.TransactionContextInterface, executor string, proposal *MultisigProposal) (bool, error) {
+	args := proposal.Args
+	switch proposal.Action {
+	case ActionSetUserRoles:
+		var userRole UserRole
+		if err := json.Unmarshal([]byte(args[0]), &userRole); err != nil {
+			return false, fmt.Errorf("failed to parse data: %v", err)
+		}
+		return false, assignUserRole(sdk, userRole)
+	case ActionSetGasFees:
+		return true, replaceGasFees(sdk, proposal.Proposer, args[0])
+	case ActionScheduleGasFeeChange:
+		effectiveAt, err := strconv.ParseInt(args[1], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("error with status code %v, invalid effectiveAt %s", http.StatusBadRequest, args[1])
+		}
+		_, err = storeGasFeeChange(sdk, proposal.Proposer, args[0], effectiveAt)
+		return true, err
+	case ActionSetGasFeeSplit:
+		return false, storeGasFeeSplit(sdk, args[0])
+	case ActionProposeGovernanceAddress:
+		_, err := storeGovernanceProposal(sdk, proposal.Proposer, args[0], args[1])
+		return false, err
+	case ActionTransfer:
+		foundation, err := foundationAddress(sdk)
+		if err != nil {
+			return false, err
+		}
+		plan, err := planTransfer(sdk, foundation, args[0], args[1], false, false)
+		if err != nil {
+			return false, err
+		}
+		if err := recordAdminAudit(sdk, ActionTransfer, args, nil); err != nil {
+			return false, err
+		}
+		if err := executeTransfer(sdk, plan); err != nil {
+			return false, err
+		}
+		return true, EmitTransferSingle(sdk, TransferSingle{Operator: executor, From: foundation, To: plan.To, Value: plan.Amount, Sponsor: plan.Sponsor})
+	case ActionSetMultisig:
+		return false, setMultisig(sdk, args[0])
+	case ActionRevokeUserRole:
+		return false, revokeRole(sdk, args[0], args[1])
+	case ActionAddFeeExemption:
+		return false, storeFeeExemption(sdk, proposal.Proposer, args[0], args[1])
+	case ActionRemoveFeeExemption:
+		return false, deleteFeeExemption(sdk, args[0])
+	case ActionCancelGasFeeChange:
+		return false, discardGasFeeChange(sdk)
+	case ActionRegisterDapp:
+		revenueShare, err := strconv.ParseUint(args[2], 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("error with status code %v, invalid revenue share %s", http.StatusBadRequest, args[2])
+		}
+		_, err = storeDapp(sdk, args[0], args[1], revenueShare)
+		return false, err
+	case ActionClaimDappRevenue:
+		dapp, err := readDapp(sdk, args[0])
+		if err != nil {
+			return false, err
+		}
+		if dapp == nil {
+			return false, fmt.Errorf("error with status code %v, dapp %s is not registered", http.StatusNotFound, args[0])
+		}
+		if err := recordAdminAudit(sdk, ActionClaimDappRevenue, args, nil); err != nil {
+			return false, err
+		}
+		unclaimed, err := unclaimedDappRevenue(sdk, dapp)
+		if err != nil {
+			return false, err
+		}
+		_, err = payDappRevenue(sdk, dapp, unclaimed)
+		return true, err
+	}
+	return false, fmt.Errorf("error with status code %v, invalid action %s", http.StatusBadRequest, proposal.Action)
+}
+
+// approveMultisigProposal records the approval of signer and executes the proposal once it has enough
+// approvals. event is emitted if it doesn't execute yet.
+func approveMultisigProposal(sdk kalpsdk.TransactionContextInterface, config *MultisigConfig, signer string, proposal *MultisigProposal, event string) error {
+	proposal.Approvals = append(proposal.Approvals, signer)
+	if config.approvals(proposal) >= config.Threshold {
+		emitted, err := executeMultisigAction(sdk, signer, proposal)
+		if err != nil {
+			return err
+		}
+		now, err := txTime(sdk)
+		if err != nil {
+			return err
+		}
+		proposal.Status, proposal.ExecutedAt = ProposalExecuted, now
+		if emitted {
+			event = ""
+		} else {
+			event = "MultisigProposalExecuted"
+		}
+	}
+	if err := writeMultisigProposal(sdk, proposal); err != nil {
+		return err
+	}
+	if event == "" {
+		return nil
+	}
+	return emitMultisigProposal(sdk, event, proposal)
+}
+
+// requireSigner returns the caller and the multisig configuration if the caller is a signer.
+func requireSigner(sdk kalpsdk.TransactionContextInterface) (string, *MultisigConfig, error) {
+	operator, err := GetUserId(sdk)
+	if err != nil {
+		return "", nil, fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
+	}
+	config, err := getMultisigConfig(sdk)
+	if err != nil {
+		return "", nil, err
+	}
+	if config == nil {
+		return "", nil, fmt.Errorf("error with status code %v, no multisig signers are configured", http.StatusBadRequest)
+	}
+	if !slices.Contains(config.Signers, operator) {
+		return "", nil, fmt.Errorf("error with status code %v, %s is not a multisig signer", http.StatusForbidden, operator)
+	}
+	return operator, config, nil
+}
+
+// SetMultisig is a smart contract function which lets the foundation configure the multisig signers, e.g.
+// {"signers":["<signer>","<signer>","<signer>"],"threshold":2,"transferThreshold":"1000000000000000000000",
+// "proposalLifetime":604800}. Once configured, the configuration only changes through a SetMultisig
+// proposal.
+func (s *SmartContract) SetMultisig(ctx kalpsdk.TransactionContextInterface, config string) error {
+	ctx = NewUnitOfWork(ctx)
+	if _, err := s.requirePermission(ctx, PermissionSetMultisig); err != nil {
+		return err
+	}
+	if err := requireMultisigProposal(ctx, ActionSetMultisig); err != nil {
+		return err
+	}
+	var parsed MultisigConfig
+	if err := json.Unmarshal([]byte(config), &parsed); err != nil {
+		return fmt.Errorf("error with status code %v, invalid multisig configuration: %v", http.StatusBadRequest, err)
+	}
+	if len(parsed.Signers) == 0 {
+		return fmt.Errorf("error with status code %v, multisig must have at least one signer", http.StatusBadRequest)
+	}
+	return setMultisig(ctx, config)
+}
+
+// GetMultisig is a smart contract function which returns the multisig configuration.
+func (s *SmartContract) GetMultisig(ctx kalpsdk.TransactionContextInterface) (*MultisigConfig, error) {
+	config, err := getMultisigConfig(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if config == nil {
+		return nil, fmt.Errorf("error with status code %v, no multisig signers are configured", http.StatusNotFound)
+	}
+	return config, nil
+}
+
+// ProposeMultisigAction is a smart contract function which lets a signer propose an action, which counts
+// as their approval. The proposal is identified by the transaction ID and executes once enough signers
+// approve it with ApproveMultisigProposal.
+func (s *SmartContract) ProposeMultisigAction(ctx kalpsdk.TransactionContextInterface, action string, args []string) (*MultisigProposal, error) {
+	ctx = NewUnitOfWork(ctx)
+	operator, config, err := requireSigner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	count, ok := multisigActionArgs[action]
+	if !ok {
+		return nil, fmt.Errorf("error with status code %v, invalid action %s", http.StatusBadRequest, action)
+	}
+	if len(args) != count {
+		return nil, fmt.Errorf("error with status code %v, %s takes %d arguments", http.StatusBadRequest, action, count)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	proposal := &MultisigProposal{
+		ID:        ctx.GetTxID(),
+		DocType:   MultisigProposalDocType,
+		Action:    action,
+		Args:      args,
+		Proposer:  operator,
+		Approvals: []string{},
+		Status:    ProposalPending,
+		CreatedAt: now,
+		ExpiresAt: now + config.ProposalLifetime,
+	}
+	if err := approveMultisigProposal(ctx, config, operator, proposal, "MultisigProposalCreated"); err != nil {
+		return nil, err
+	}
+	return proposal, nil
+}
+
+// ApproveMultisigProposal is a smart contract function which lets a signer approve a pending proposal.
+// The approval that reaches the threshold executes the action, and fails if the action fails.
+func (s *SmartContract) ApproveMultisigProposal(ctx kalpsdk.TransactionContextInterface, id string) (*MultisigProposal, error) {
+	ctx = NewUnitOfWork(ctx)
+	operator, config, err := requireSigner(ctx)
+	if err != nil {
+		return nil, err
+	}
+	proposal, err := readMultisigProposal(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	if proposal.Status != ProposalPending {
+		return nil, fmt.Errorf("error with status code %v, proposal %s is %s", http.StatusBadRequest, id, proposal.Status)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if now >= proposal.ExpiresAt {
+		return nil, fmt.Errorf("error with status code %v, proposal %s expired at %d", http.StatusBadRequest, id, proposal.ExpiresAt)
+	}
+	if slices.Contains(proposal.Approvals, operator) {
+		return nil, fmt.Errorf("error with status code %v, %s already approved proposal %s", http.StatusBadRequest, operator, id)
+	}
+	if err := approveMultisigProposal(ctx, config, operator, proposal, "MultisigProposalApproved"); err != nil {
+		return nil, err
+	}
+	return proposal, nil
+}
+
+// CancelMultisigProposal is a smart contract function which lets the signer who made a pending proposal
+// cancel it.
+func (s *SmartContract) CancelMultisigProposal(ctx kalpsdk.TransactionContextInterface, id string) error {
+	ctx = NewUnitOfWork(ctx)
+	operator, err := GetUserId(ctx)
+	if err != nil {
+		return fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
+	}
+	proposal, err := readMultisigProposal(ctx, id)
+	if err != nil {
+		return err
+	}
+	if proposal.Proposer != operator {
+		return fmt.Errorf("error with status code %v, only %s can cancel proposal %s", http.StatusForbidden, proposal.Proposer, id)
+	}
+	if proposal.Status != ProposalPending {
+		return fmt.Errorf("error with status code %v, proposal %s is %s", http.StatusBadRequest, id, proposal.Status)
+	}
+	key, err := multisigProposalKey(ctx, id)
+	if err != nil {
+		return err
+	}
+	if err := auditKeyChange(ctx, "CancelMultisigProposal", []string{id}, key); err != nil {
+		return err
+	}
+	proposal.Status = ProposalCancelled
+	if err := writeMultisigProposal(ctx, proposal); err != nil {
+		return err
+	}
+	return emitMultisigProposal(ctx, "MultisigProposalCancelled", proposal)
+}
+
+// GetMultisigProposal is a smart contract function which returns a proposal and its approvals.
+func (s *SmartContract) GetMultisigProposal(ctx kalpsdk.TransactionContextInterface, id string) (*MultisigProposal, error) {
+	proposal, err := readMultisigProposal(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if proposal.Status == ProposalPending && now >= proposal.ExpiresAt {
+		proposal.Status = ProposalExpired
+	}
+	return proposal, nil
+}
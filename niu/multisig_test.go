@@ -0,0 +1,212 @@
+package kalpAccounting
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func configureMultisig(l *fakeledger.Ledger, s *SmartContract, operator, config string) error {
+	return l.Submit(operator, func(ctx *fakeledger.TransactionContext) error {
+		return s.SetMultisig(ctx, config)
+	})
+}
+
+func proposeAction(l *fakeledger.Ledger, s *SmartContract, signer, action string, args ...string) (*MultisigProposal, error) {
+	var proposal *MultisigProposal
+	err := l.Submit(signer, func(ctx *fakeledger.TransactionContext) error {
+		var err error
+		proposal, err = s.ProposeMultisigAction(ctx, action, args)
+		return err
+	})
+	return proposal, err
+}
+
+func approveProposal(l *fakeledger.Ledger, s *SmartContract, signer, id string) (*MultisigProposal, error) {
+	var proposal *MultisigProposal
+	err := l.Submit(signer, func(ctx *fakeledger.TransactionContext) error {
+		var err error
+		proposal, err = s.ApproveMultisigProposal(ctx, id)
+		return err
+	})
+	return proposal, err
+}
+
+func newMultisigLedger(t *testing.T) (*fakeledger.Ledger, *SmartContract) {
+	t.Helper()
+	l, s := newInitializedLedger(t)
+	config := fmt.Sprintf(`{"signers":["%s","%s","%s"],"threshold":2,"transferThreshold":"1000000000000000000000","proposalLifetime":3600}`, alice, bob, carol)
+	require.Error(t, configureMultisig(l, s, alice, config), "only the foundation configures multisig")
+	require.Error(t, configureMultisig(l, s, kalpFoundation, `{"signers":[],"threshold":0}`))
+	require.Error(t, configureMultisig(l, s, kalpFoundation, fmt.Sprintf(`{"signers":["%s"],"threshold":2,"transferThreshold":"0","proposalLifetime":3600}`, alice)))
+	require.NoError(t, configureMultisig(l, s, kalpFoundation, config))
+	require.Error(t, configureMultisig(l, s, kalpFoundation, config), "multisig changes go through proposals")
+	return l, s
+}
+
+func TestMultisigFoundationTransfer(t *testing.T) {
+	l, s := newMultisigLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, dapp, "1000000000000000000000"), "transfers up to the threshold don't need a proposal")
+	require.Error(t, transfer(l, s, kalpFoundation, dapp, "1000000000000000000001"))
+	require.NoError(t, transfer(l, s, dapp, bob, "1000000000000000000000"), "the threshold applies to the foundation only")
+	require.Error(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.DepositSponsorship(ctx, "2000000000000000000000")
+		return err
+	}), "deposits from the foundation are transfers")
+	treasury := balanceOf(t, l, s, kalpFoundation)
+
+	_, err := proposeAction(l, s, kalpFoundation, ActionTransfer, dapp, "2000000000000000000000")
+	require.Error(t, err, "only signers propose")
+	_, err = proposeAction(l, s, alice, ActionTransfer, dapp)
+	require.Error(t, err)
+	_, err = proposeAction(l, s, alice, "Burn", dapp)
+	require.Error(t, err)
+	proposal, err := proposeAction(l, s, alice, ActionTransfer, dapp, "2000000000000000000000")
+	require.NoError(t, err)
+	require.Equal(t, ProposalPending, proposal.Status)
+	require.Equal(t, "MultisigProposalCreated", lastEvent(t, l).Name)
+	_, err = approveProposal(l, s, alice, proposal.ID)
+	require.Error(t, err, "a signer approves once")
+	_, err = approveProposal(l, s, kalpFoundation, proposal.ID)
+	require.Error(t, err)
+	require.Equal(t, treasury, balanceOf(t, l, s, kalpFoundation))
+
+	proposal, err = approveProposal(l, s, carol, proposal.ID)
+	require.NoError(t, err)
+	require.Equal(t, ProposalExecuted, proposal.Status)
+	require.Equal(t, []string{alice, carol}, proposal.Approvals)
+	require.Equal(t, "TransferSingle", lastEvent(t, l).Name)
+	require.Equal(t, sum(treasury, "-2000000000000000000000"), balanceOf(t, l, s, kalpFoundation))
+	require.Equal(t, "2000000000000000000000", balanceOf(t, l, s, dapp))
+	_, err = approveProposal(l, s, bob, proposal.ID)
+	require.Error(t, err, "the proposal executed")
+}
+
+func TestMultisigFeeAndRoleChanges(t *testing.T) {
+	l, s := newMultisigLedger(t)
+	require.Error(t, setGasFees(l, s, "5"))
+	require.Error(t, setUserRole(l, s, kalpFoundation, dapp, gasFeesAdminRole))
+
+	proposal, err := proposeAction(l, s, bob, ActionSetGasFees, "5")
+	require.NoError(t, err)
+	_, err = approveProposal(l, s, alice, proposal.ID)
+	require.NoError(t, err)
+	require.Equal(t, "GasFeeChanged", lastEvent(t, l).Name)
+	fees, err := s.GetGasFees(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Equal(t, "5", fees.Flat)
+
+	// Proposals expire.
+	proposal, err = proposeAction(l, s, bob, ActionSetUserRoles, `{"User":"`+dapp+`","Role":"`+gasFeesAdminRole+`"}`)
+	require.NoError(t, err)
+	l.Advance(time.Hour)
+	_, err = approveProposal(l, s, alice, proposal.ID)
+	require.Error(t, err)
+	stored, err := s.GetMultisigProposal(l.NewTransaction(alice), proposal.ID)
+	require.NoError(t, err)
+	require.Equal(t, ProposalExpired, stored.Status)
+
+	// The proposer can cancel a proposal.
+	proposal, err = proposeAction(l, s, bob, ActionSetUserRoles, `{"User":"`+dapp+`","Role":"`+gasFeesAdminRole+`"}`)
+	require.NoError(t, err)
+	cancel := func(signer string) error {
+		return l.Submit(signer, func(ctx *fakeledger.TransactionContext) error {
+			return s.CancelMultisigProposal(ctx, proposal.ID)
+		})
+	}
+	require.Error(t, cancel(alice))
+	require.NoError(t, cancel(bob))
+	require.Equal(t, "MultisigProposalCancelled", lastEvent(t, l).Name)
+	require.Len(t, adminAudit(t, l, s, bob, "CancelMultisigProposal", 0, l.Now().Unix()), 1)
+	_, err = approveProposal(l, s, alice, proposal.ID)
+	require.Error(t, err)
+
+	proposal, err = proposeAction(l, s, bob, ActionSetUserRoles, `{"User":"`+dapp+`","Role":"`+gasFeesAdminRole+`"}`)
+	require.NoError(t, err)
+	_, err = approveProposal(l, s, carol, proposal.ID)
+	require.NoError(t, err)
+	require.Equal(t, "MultisigProposalExecuted", lastEvent(t, l).Name)
+	require.True(t, hasPermission(t, l, s, dapp, PermissionSetGasFees))
+
+	// Removing the signers turns multisig off.
+	proposal, err = proposeAction(l, s, carol, ActionSetMultisig, `{"signers":[]}`)
+	require.NoError(t, err)
+	_, err = approveProposal(l, s, bob, proposal.ID)
+	require.NoError(t, err)
+	_, err = s.GetMultisig(l.NewTransaction(alice))
+	require.Error(t, err)
+	require.NoError(t, setGasFees(l, s, "7"))
+}
+
+func TestMultisigRegistryChanges(t *testing.T) {
+	l, s := newMultisigLedger(t)
+	execute := func(action string, args ...string) {
+		t.Helper()
+		proposal, err := proposeAction(l, s, alice, action, args...)
+		require.NoError(t, err)
+		proposal, err = approveProposal(l, s, bob, proposal.ID)
+		require.NoError(t, err)
+		require.Equal(t, ProposalExecuted, proposal.Status)
+	}
+
+	require.Error(t, revokeUserRole(l, s, kalpFoundation, intialkalpGateWayadmin, kalpGateWayAdmin))
+	execute(ActionRevokeUserRole, intialkalpGateWayadmin, kalpGateWayAdmin)
+	require.Empty(t, listRoleMembers(t, l, s, kalpGateWayAdmin))
+
+	require.Error(t, addFeeExemption(l, s, alice))
+	execute(ActionAddFeeExemption, alice, "treasury")
+	exempt, err := isFeeExempt(l.NewTransaction(alice), alice)
+	require.NoError(t, err)
+	require.True(t, exempt)
+	require.Error(t, l.Submit(intialgasfeesadmin, func(ctx *fakeledger.TransactionContext) error {
+		return s.RemoveFeeExemption(ctx, alice)
+	}))
+	execute(ActionRemoveFeeExemption, alice)
+	exempt, err = isFeeExempt(l.NewTransaction(alice), alice)
+	require.NoError(t, err)
+	require.False(t, exempt)
+
+	execute(ActionScheduleGasFeeChange, "2000000000000000", fmt.Sprint(l.Now().Unix()+minGasFeeChangeDelay+60))
+	require.Error(t, cancelGasFeeChange(l, s))
+	execute(ActionCancelGasFeeChange)
+	change, err := getGasFeeChange(l.NewTransaction(alice))
+	require.NoError(t, err)
+	require.Nil(t, change)
+
+	require.Error(t, registerDapp(l, s, "dapp-1", dapp, 2500))
+	execute(ActionRegisterDapp, "dapp-1", dapp, "2500")
+	registered, err := s.GetDapp(l.NewTransaction(alice), "dapp-1")
+	require.NoError(t, err)
+	require.Equal(t, dapp, registered.Owner)
+}
+
+func TestMultisigDappRevenueClaim(t *testing.T) {
+	l, s := newMultisigLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	proposal, err := proposeAction(l, s, alice, ActionRegisterDapp, "dapp-1", dapp, "2500")
+	require.NoError(t, err)
+	_, err = approveProposal(l, s, bob, proposal.ID)
+	require.NoError(t, err)
+	_, err = collectGatewayFeeAs(l, s, intialkalpGateWayadmin, alice, "1000", "dapp-1", "order-1")
+	require.NoError(t, err)
+
+	// With a transfer threshold of 0 every claim moves too much out of the foundation.
+	proposal, err = proposeAction(l, s, alice, ActionSetMultisig, fmt.Sprintf(`{"signers":["%s","%s","%s"],"threshold":2,"transferThreshold":"0","proposalLifetime":3600}`, alice, bob, carol))
+	require.NoError(t, err)
+	_, err = approveProposal(l, s, bob, proposal.ID)
+	require.NoError(t, err)
+	_, err = claimDappRevenue(l, s, dapp, "dapp-1")
+	require.Error(t, err)
+	require.Equal(t, "0", balanceOf(t, l, s, dapp))
+
+	proposal, err = proposeAction(l, s, alice, ActionClaimDappRevenue, "dapp-1")
+	require.NoError(t, err)
+	_, err = approveProposal(l, s, carol, proposal.ID)
+	require.NoError(t, err)
+	require.Equal(t, "DappRevenueClaimed", lastEvent(t, l).Name)
+	require.Equal(t, "250", balanceOf(t, l, s, dapp))
+}
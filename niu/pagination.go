@@ -0,0 +1,255 @@
+package kalpAccounting
+
+import (
+	"fmt"
+
+	"github.com/hyperledger/fabric-chaincode-go/shim"
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/hyperledger/fabric-protos-go/peer"
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+// totalQueryLimit must match ledger.state.totalQueryLimit in the core.yaml of the peers. Fabric stops an
+// unpaginated query after that many results without reporting an error.
+var totalQueryLimit = 100000
+
+// queryPageSize is the number of results fetched per page by paginated queries.
+const queryPageSize = 1000
+
+// PaginatedQuerier runs paginated queries. Fabric only allows them in read-only transactions: a
+// transaction can't write after a paginated query, or run one after writing.
+type PaginatedQuerier interface {
+	GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error)
+	GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error)
+}
+
+// stubQuerier runs paginated queries on the chaincode stub, which TransactionContextInterface doesn't expose.
+type stubQuerier struct {
+	stub shim.ChaincodeStubInterface
+}
+
+func (q stubQuerier) GetStateByPartialCompositeKeyWithPagination(objectType string, keys []string, pageSize int32, bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	return q.stub.GetStateByPartialCompositeKeyWithPagination(objectType, keys, pageSize, bookmark)
+}
+
+func (q stubQuerier) GetQueryResultWithPagination(query string, pageSize int32, bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+	return q.stub.GetQueryResultWithPagination(query, pageSize, bookmark)
+}
+
+// QueryContext wraps the context of a contract function that only reads, and is the only context whose
+// scans use paginated queries. Fabric rejects a transaction that mixes paginated queries and writes, so
+// a function must not wrap its context in it unless it never writes.
+type QueryContext struct {
+	kalpsdk.TransactionContextInterface
+}
+
+// NewQueryContext wraps ctx for a contract function that only reads. A UnitOfWork is returned unchanged,
+// since the function is then part of one that writes.
+func NewQueryContext(ctx kalpsdk.TransactionContextInterface) kalpsdk.TransactionContextInterface {
+	switch ctx.(type) {
+	case *UnitOfWork, *QueryContext:
+		return ctx
+	}
+	return &QueryContext{TransactionContextInterface: ctx}
+}
+
+// paginatedQuerier returns the querier of a QueryContext. Any other context gets false, so functions
+// that write scan without pagination whether or not they use a UnitOfWork.
+func paginatedQuerier(sdk kalpsdk.TransactionContextInterface) (PaginatedQuerier, bool) {
+	query, ok := sdk.(*QueryContext)
+	if !ok {
+		return nil, false
+	}
+	switch ctx := query.TransactionContextInterface.(type) {
+	case PaginatedQuerier:
+		return ctx, true
+	case interface {
+		GetStub() shim.ChaincodeStubInterface
+	}:
+		return stubQuerier{stub: ctx.GetStub()}, true
+	}
+	return nil, false
+}
+
+// scanPartialCompositeKey iterates over the keys with the given partial composite key. Read-only
+// transactions page through them; other transactions use a single scan, which fails once it reaches
+// totalQueryLimit instead of ending early. The iterator must be closed.
+func scanPartialCompositeKey(sdk kalpsdk.TransactionContextInterface, objectType string, keys []string) (kalpsdk.StateQueryIteratorInterface, error) {
+	if querier, ok := paginatedQuerier(sdk); ok {
+		return newPagedIterator(func(bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+			return querier.GetStateByPartialCompositeKeyWithPagination(objectType, keys, queryPageSize, bookmark)
+		})
+	}
+	it, err := sdk.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedIterator{base: it}, nil
+}
+
+// scanPartialCompositeKeyRange iterates over the keys with the given partial composite key from startKey
+// up to but excluding endKey. Fabric doesn't allow range queries over composite keys, so read-only
+// transactions start the paginated query at startKey by passing it as the bookmark, and stop reading
+// pages at endKey. The iterator must be closed.
+func scanPartialCompositeKeyRange(sdk kalpsdk.TransactionContextInterface, objectType string, keys []string, startKey string, endKey string) (kalpsdk.StateQueryIteratorInterface, error) {
+	var it kalpsdk.StateQueryIteratorInterface
+	var err error
+	if querier, ok := paginatedQuerier(sdk); ok {
+		it, err = newPagedIterator(func(bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+			if bookmark == "" {
+				bookmark = startKey
+			}
+			return querier.GetStateByPartialCompositeKeyWithPagination(objectType, keys, queryPageSize, bookmark)
+		})
+	} else {
+		it, err = scanPartialCompositeKey(sdk, objectType, keys)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &boundedIterator{base: it, startKey: startKey, endKey: endKey}, nil
+}
+
+// scanQueryResult iterates over the results of a rich query, like scanPartialCompositeKey.
+func scanQueryResult(sdk kalpsdk.TransactionContextInterface, query string) (kalpsdk.StateQueryIteratorInterface, error) {
+	if querier, ok := paginatedQuerier(sdk); ok {
+		return newPagedIterator(func(bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error) {
+			return querier.GetQueryResultWithPagination(query, queryPageSize, bookmark)
+		})
+	}
+	it, err := sdk.GetQueryResult(query)
+	if err != nil {
+		return nil, err
+	}
+	return &limitedIterator{base: it}, nil
+}
+
+// pagedIterator iterates over all pages of a paginated query. The first page is fetched up front, so
+// query errors are returned by the constructor.
+type pagedIterator struct {
+	fetch    func(bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error)
+	page     kalpsdk.StateQueryIteratorInterface
+	bookmark string
+	last     bool
+	err      error
+}
+
+func newPagedIterator(fetch func(bookmark string) (kalpsdk.StateQueryIteratorInterface, *peer.QueryResponseMetadata, error)) (*pagedIterator, error) {
+	it := &pagedIterator{fetch: fetch}
+	if err := it.nextPage(); err != nil {
+		return nil, err
+	}
+	return it, nil
+}
+
+func (it *pagedIterator) nextPage() error {
+	page, metadata, err := it.fetch(it.bookmark)
+	if err != nil {
+		return err
+	}
+	it.page = page
+	it.bookmark = metadata.GetBookmark()
+	// CouchDB returns a bookmark with the last page too, so a short page also ends the query.
+	it.last = it.bookmark == "" || metadata.GetFetchedRecordsCount() < queryPageSize
+	return nil
+}
+
+func (it *pagedIterator) HasNext() bool {
+	for it.err == nil && !it.page.HasNext() {
+		if it.last {
+			return false
+		}
+		if err := it.page.Close(); err != nil {
+			it.err = err
+			break
+		}
+		it.err = it.nextPage()
+	}
+	return true
+}
+
+func (it *pagedIterator) Next() (*queryresult.KV, error) {
+	if it.err != nil {
+		return nil, it.err
+	}
+	return it.page.Next()
+}
+
+func (it *pagedIterator) Close() error {
+	if it.page == nil {
+		return nil
+	}
+	return it.page.Close()
+}
+
+// limitedIterator fails with an error when a query returns totalQueryLimit results, as its results
+// may have been cut short by the peer.
+type limitedIterator struct {
+	base  kalpsdk.StateQueryIteratorInterface
+	count int
+}
+
+func (it *limitedIterator) HasNext() bool {
+	return it.base.HasNext() || it.count >= totalQueryLimit
+}
+
+func (it *limitedIterator) Next() (*queryresult.KV, error) {
+	if it.count >= totalQueryLimit {
+		return nil, fmt.Errorf("query reached the limit of %d results and may be incomplete, consolidate the utxos of the account first", totalQueryLimit)
+	}
+	it.count++
+	return it.base.Next()
+}
+
+func (it *limitedIterator) Close() error {
+	return it.base.Close()
+}
+
+// boundedIterator returns the results of base from startKey up to but excluding endKey. It stops reading
+// base at the first key after the range.
+type boundedIterator struct {
+	base     kalpsdk.StateQueryIteratorInterface
+	startKey string
+	endKey   string
+	next     *queryresult.KV
+	err      error
+	done     bool
+}
+
+func (it *boundedIterator) HasNext() bool {
+	for it.next == nil && it.err == nil && !it.done {
+		if !it.base.HasNext() {
+			it.done = true
+			break
+		}
+		kv, err := it.base.Next()
+		if err != nil {
+			it.err = err
+			break
+		}
+		if kv.Key >= it.endKey {
+			it.done = true
+			break
+		}
+		if kv.Key >= it.startKey {
+			it.next = kv
+		}
+	}
+	return it.next != nil || it.err != nil
+}
+
+func (it *boundedIterator) Next() (*queryresult.KV, error) {
+	if !it.HasNext() {
+		return nil, fmt.Errorf("no more results")
+	}
+	if it.err != nil {
+		return nil, it.err
+	}
+	kv := it.next
+	it.next = nil
+	return kv, nil
+}
+
+func (it *boundedIterator) Close() error {
+	return it.base.Close()
+}
@@ -0,0 +1,51 @@
+package kalpAccounting
+
+import (
+	"fmt"
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestScansOfLargeAccounts(t *testing.T) {
+	l := fakeledger.New()
+	s := &SmartContract{}
+	ctx := l.NewTransaction(alice)
+	for i := 0; i < 2*queryPageSize+5; i++ {
+		key, err := ctx.CreateCompositeKey(UTXO, []string{alice, fmt.Sprintf("tx%05d", i), "0"})
+		require.NoError(t, err)
+		l.PutState(key, []byte(`{"account":"`+alice+`","docType":"UTXO","amount":"1"}`))
+	}
+	l.SetTotalQueryLimit(queryPageSize)
+	defer func(limit int) { totalQueryLimit = limit }(totalQueryLimit)
+	totalQueryLimit = queryPageSize
+
+	// Read-only transactions page through every UTXO.
+	total, err := GetTotalUTXO(NewQueryContext(l.NewTransaction(alice)), alice)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprint(2*queryPageSize+5), total)
+
+	l.PutState(richQueryKey, []byte("true"))
+	total, err = GetTotalUTXO(NewQueryContext(l.NewTransaction(alice)), alice)
+	require.NoError(t, err)
+	require.Equal(t, fmt.Sprint(2*queryPageSize+5), total)
+
+	balance, err := s.BalanceOf(l.NewTransaction(alice), alice)
+	require.NoError(t, err)
+	require.Equal(t, total, balance, "query functions mark their context read-only")
+
+	// Writing transactions can't page, and get an error instead of a truncated result, whether or not
+	// they use a UnitOfWork.
+	_, err = GetTotalUTXO(NewUnitOfWork(l.NewTransaction(alice)), alice)
+	require.ErrorContains(t, err, "limit")
+	_, err = GetTotalUTXO(l.NewTransaction(alice), alice)
+	require.ErrorContains(t, err, "limit")
+	_, err = GetTotalUTXO(NewUnitOfWork(NewQueryContext(l.NewTransaction(alice))), alice)
+	require.ErrorContains(t, err, "limit", "a unit of work is never read-only")
+	err = l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return AddUtxo(NewUnitOfWork(ctx), alice, 1)
+	})
+	require.ErrorContains(t, err, "limit")
+}
@@ -0,0 +1,110 @@
+package kalpAccounting
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+	"golang.org/x/exp/slices"
+)
+
+// Permissions checked by the admin entrypoints. Most are named after the contract function they allow.
+const (
+	// PermissionSetUserRoles allows SetUserRoles and RevokeUserRole.
+	PermissionSetUserRoles = "SetUserRoles"
+	// PermissionRotateGovernance allows proposing new foundation, gas fees admin and gateway admin addresses.
+	PermissionRotateGovernance = "RotateGovernance"
+	// PermissionSetMultisig allows configuring the multisig signers the first time.
+	PermissionSetMultisig          = "SetMultisig"
+	PermissionRebuildBalance       = "RebuildBalance"
+	PermissionMigrateUtxoKeys      = "MigrateUtxoKeys"
+	PermissionSetRichQueryBalances = "SetRichQueryBalances"
+	PermissionSetCoinSelection     = "SetCoinSelection"
+	PermissionSetUtxoConsolidation = "SetUtxoConsolidation"
+	// PermissionConsolidateUtxos allows consolidating the UTXOs of any account, not only the caller's.
+	PermissionConsolidateUtxos = "ConsolidateUtxos"
+	// PermissionSetGasFees allows SetGasFees, ScheduleGasFeeChange and CancelGasFeeChange.
+	PermissionSetGasFees     = "SetGasFees"
+	PermissionSetGasFeeSplit = "SetGasFeeSplit"
+	// PermissionManageFeeExemptions allows AddFeeExemption and RemoveFeeExemption.
+	PermissionManageFeeExemptions = "ManageFeeExemptions"
+	// PermissionCollectGatewayFee allows CollectGatewayFee, CollectGatewayFeesBatch and gateway Transfers.
+	PermissionCollectGatewayFee = "CollectGatewayFee"
+	PermissionRegisterDapp      = "RegisterDapp"
+	// PermissionClaimDappRevenue allows claiming the revenue of any dapp, not only the caller's.
+	PermissionClaimDappRevenue = "ClaimDappRevenue"
+)
+
+// rolePermissions is the permission table: the permissions each role grants.
+var rolePermissions = map[string][]string{
+	kalpFoundationRole: {
+		PermissionSetUserRoles,
+		PermissionRotateGovernance,
+		PermissionSetMultisig,
+		PermissionRebuildBalance,
+		PermissionMigrateUtxoKeys,
+		PermissionSetRichQueryBalances,
+		PermissionSetCoinSelection,
+		PermissionSetUtxoConsolidation,
+		PermissionConsolidateUtxos,
+		PermissionRegisterDapp,
+		PermissionClaimDappRevenue,
+	},
+	gasFeesAdminRole: {
+		PermissionSetGasFees,
+		PermissionSetGasFeeSplit,
+		PermissionManageFeeExemptions,
+	},
+	kalpGateWayAdmin: {
+		PermissionCollectGatewayFee,
+	},
+}
+
+// hasPermission reports whether one of the roles of id grants permission.
+func (s *SmartContract) hasPermission(ctx kalpsdk.TransactionContextInterface, id string, permission string) (bool, error) {
+	roles, err := getUserRoles(ctx, id)
+	if err != nil {
+		return false, err
+	}
+	for _, role := range roles {
+		if slices.Contains(rolePermissions[role], permission) {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// HasPermission is a smart contract function which reports whether one of the roles of the caller
+// grants permission.
+func (s *SmartContract) HasPermission(ctx kalpsdk.TransactionContextInterface, permission string) (bool, error) {
+	operator, err := GetUserId(ctx)
+	if err != nil {
+		return false, fmt.Errorf("failed to get client id: %v", err)
+	}
+	return s.hasPermission(ctx, operator, permission)
+}
+
+// requirePermission returns the caller if one of their roles grants permission.
+func (s *SmartContract) requirePermission(ctx kalpsdk.TransactionContextInterface, permission string) (string, error) {
+	operator, err := GetUserId(ctx)
+	if err != nil {
+		return "", fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
+	}
+	allowed, err := s.hasPermission(ctx, operator, permission)
+	if err != nil {
+		return "", fmt.Errorf("error checking operator's role: %v", err)
+	}
+	if !allowed {
+		return "", fmt.Errorf("error with status code %v, error: %s does not have the %s permission", http.StatusForbidden, operator, permission)
+	}
+	return operator, nil
+}
+
+// GetRolePermissions is a smart contract function which returns the permissions a role grants.
+func (s *SmartContract) GetRolePermissions(ctx kalpsdk.TransactionContextInterface, role string) ([]string, error) {
+	permissions, ok := rolePermissions[role]
+	if !ok {
+		return nil, fmt.Errorf("error with status code %v, invalid role %s", http.StatusBadRequest, role)
+	}
+	return permissions, nil
+}
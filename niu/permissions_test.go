@@ -0,0 +1,152 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"testing"
+	"time"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func setUserRole(l *fakeledger.Ledger, s *SmartContract, operator, id, role string) error {
+	return l.Submit(operator, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.SetUserRoles(ctx, `{"User":"`+id+`","Role":"`+role+`"}`)
+		return err
+	})
+}
+
+func hasPermission(t *testing.T, l *fakeledger.Ledger, s *SmartContract, id, permission string) bool {
+	t.Helper()
+	allowed, err := s.HasPermission(l.NewTransaction(id), permission)
+	require.NoError(t, err)
+	return allowed
+}
+
+func TestMultipleRolesPerIdentity(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.Error(t, setUserRole(l, s, alice, alice, kalpFoundationRole), "only the foundation assigns roles")
+	require.Error(t, setUserRole(l, s, kalpFoundation, alice, "Admin"))
+
+	require.NoError(t, setUserRole(l, s, kalpFoundation, alice, gasFeesAdminRole))
+	require.NoError(t, setUserRole(l, s, kalpFoundation, alice, kalpGateWayAdmin))
+	roles, err := s.ListUserRoles(l.NewTransaction(bob), alice)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{gasFeesAdminRole, kalpGateWayAdmin}, roles)
+	role, err := s.GetUserRoles(l.NewTransaction(bob), alice)
+	require.NoError(t, err)
+	require.Equal(t, gasFeesAdminRole, role, "the legacy query returns the highest role")
+
+	require.True(t, hasPermission(t, l, s, alice, PermissionSetGasFees))
+	require.True(t, hasPermission(t, l, s, alice, PermissionCollectGatewayFee))
+	require.False(t, hasPermission(t, l, s, alice, PermissionSetUserRoles))
+	require.False(t, hasPermission(t, l, s, bob, PermissionSetGasFees))
+
+	// Both roles work for the same identity.
+	require.NoError(t, transfer(l, s, kalpFoundation, bob, "1000"))
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return s.SetGasFees(ctx, "5")
+	}))
+	_, err = collectGatewayFeeAs(l, s, alice, bob, "100", "dapp-1", "order-1")
+	require.NoError(t, err)
+	require.Equal(t, "900", balanceOf(t, l, s, bob))
+
+	permissions, err := s.GetRolePermissions(l.NewTransaction(bob), gasFeesAdminRole)
+	require.NoError(t, err)
+	require.Contains(t, permissions, PermissionManageFeeExemptions)
+	_, err = s.GetRolePermissions(l.NewTransaction(bob), "Admin")
+	require.Error(t, err)
+}
+
+func TestLegacyUserRoleIsRead(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	key, err := l.NewTransaction(alice).CreateCompositeKey(userRolePrefix, []string{carol, UserRoleMap})
+	require.NoError(t, err)
+	legacy, err := json.Marshal(UserRole{Id: carol, Role: gasFeesAdminRole, DocType: UserRoleMap})
+	require.NoError(t, err)
+	l.PutState(key, legacy)
+
+	require.True(t, hasPermission(t, l, s, carol, PermissionSetGasFeeSplit))
+	require.NoError(t, setUserRole(l, s, kalpFoundation, carol, kalpGateWayAdmin))
+	roles, err := s.ListUserRoles(l.NewTransaction(bob), carol)
+	require.NoError(t, err)
+	require.ElementsMatch(t, []string{gasFeesAdminRole, kalpGateWayAdmin}, roles, "a new role doesn't replace the legacy one")
+}
+
+func listRoleMembers(t *testing.T, l *fakeledger.Ledger, s *SmartContract, role string) []string {
+	t.Helper()
+	members, err := s.ListRoleMembers(l.NewTransaction(bob), role)
+	require.NoError(t, err)
+	ids := []string{}
+	for _, member := range members {
+		ids = append(ids, member.Id)
+	}
+	return ids
+}
+
+func revokeUserRole(l *fakeledger.Ledger, s *SmartContract, operator, id, role string) error {
+	return l.Submit(operator, func(ctx *fakeledger.TransactionContext) error {
+		return s.RevokeUserRole(ctx, id, role)
+	})
+}
+
+func TestRevokeAndListRoleMembers(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.Equal(t, []string{intialkalpGateWayadmin}, listRoleMembers(t, l, s, kalpGateWayAdmin))
+	require.NoError(t, setUserRole(l, s, kalpFoundation, alice, kalpGateWayAdmin))
+	require.ElementsMatch(t, []string{alice, intialkalpGateWayadmin}, listRoleMembers(t, l, s, kalpGateWayAdmin))
+
+	require.Error(t, revokeUserRole(l, s, alice, intialkalpGateWayadmin, kalpGateWayAdmin), "only the foundation revokes roles")
+	require.NoError(t, revokeUserRole(l, s, kalpFoundation, intialkalpGateWayadmin, kalpGateWayAdmin))
+	require.Equal(t, []string{alice}, listRoleMembers(t, l, s, kalpGateWayAdmin))
+	require.False(t, hasPermission(t, l, s, intialkalpGateWayadmin, PermissionCollectGatewayFee))
+	require.Error(t, revokeUserRole(l, s, kalpFoundation, intialkalpGateWayadmin, kalpGateWayAdmin), "the role is no longer held")
+	require.Error(t, revokeUserRole(l, s, kalpFoundation, kalpFoundation, kalpFoundationRole))
+	_, err := s.ListRoleMembers(l.NewTransaction(bob), "Admin")
+	require.Error(t, err)
+
+	// A legacy assignment is revoked too.
+	key, err := l.NewTransaction(alice).CreateCompositeKey(userRolePrefix, []string{carol, UserRoleMap})
+	require.NoError(t, err)
+	legacy, err := json.Marshal(UserRole{Id: carol, Role: gasFeesAdminRole, DocType: UserRoleMap})
+	require.NoError(t, err)
+	l.PutState(key, legacy)
+	require.NoError(t, revokeUserRole(l, s, kalpFoundation, carol, gasFeesAdminRole))
+	require.False(t, hasPermission(t, l, s, carol, PermissionSetGasFees))
+}
+
+func TestUserRoleExpiry(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	expiresAt := l.Now().Add(time.Hour).Unix()
+	grant := func(expiresAt int64) error {
+		return l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+			_, err := s.SetUserRoles(ctx, fmt.Sprintf(`{"User":"%s","Role":"%s","expiresAt":%d}`, alice, gasFeesAdminRole, expiresAt))
+			return err
+		})
+	}
+	require.Error(t, grant(l.Now().Unix()), "expiry must be in the future")
+	require.NoError(t, grant(expiresAt))
+	require.True(t, hasPermission(t, l, s, alice, PermissionSetGasFees))
+	members, err := s.ListRoleMembers(l.NewTransaction(bob), gasFeesAdminRole)
+	require.NoError(t, err)
+	require.Contains(t, members, UserRole{Id: alice, Role: gasFeesAdminRole, DocType: UserRoleMap, ExpiresAt: expiresAt})
+
+	l.Advance(time.Hour)
+	require.False(t, hasPermission(t, l, s, alice, PermissionSetGasFees))
+	require.Error(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return s.SetGasFees(ctx, "5")
+	}))
+	roles, err := s.ListUserRoles(l.NewTransaction(bob), alice)
+	require.NoError(t, err)
+	require.Empty(t, roles)
+	role, err := s.GetUserRoles(l.NewTransaction(bob), alice)
+	require.NoError(t, err)
+	require.Empty(t, role)
+	require.Equal(t, []string{intialgasfeesadmin}, listRoleMembers(t, l, s, gasFeesAdminRole))
+
+	// Assigning the role again without expiry makes it permanent.
+	require.NoError(t, setUserRole(l, s, kalpFoundation, alice, gasFeesAdminRole))
+	require.True(t, hasPermission(t, l, s, alice, PermissionSetGasFees))
+}
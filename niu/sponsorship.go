@@ -0,0 +1,460 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const SponsorshipDocType = "Sponsorship"
+const SponsoredAddressDocType = "SponsoredAddress"
+
+// sponsorWhitelistPrefix indexes the addresses whitelisted by a sponsor, for ListSponsoredAddresses.
+const sponsorWhitelistPrefix = "SponsorWhitelist"
+
+// sponsorEscrowPrefix names the account holding the deposit of a sponsor. It isn't a valid address, so
+// nobody can transfer to or from it directly.
+const sponsorEscrowPrefix = "sponsorship-"
+
+// minSponsorshipDeposit is the deposit a sponsor needs for each address it sponsors, so addresses can't
+// be held with a dust deposit.
+const minSponsorshipDeposit = "100000000000000000"
+
+// Kinds of sponsored addresses.
+const (
+	// SponsoredUser: the sponsor pays the gas fee of transfers sent by the address.
+	SponsoredUser = "user"
+	// SponsoredReceiver: the sponsor pays the gas fee of transfers sent to the address.
+	SponsoredReceiver = "receiver"
+)
+
+// Sponsorship is the usage of a sponsor's deposit, which is held by the escrow account of the sponsor.
+// Only deposits and withdrawals are stored. Balance is the balance of the escrow account and FeesPaid
+// what the deposits lost besides withdrawals, so paying a sponsored fee only spends from the escrow
+// account. Addresses is the number of addresses the sponsor sponsors.
+type Sponsorship struct {
+	Sponsor   string `json:"sponsor"`
+	DocType   string `json:"docType"`
+	Balance   string `json:"balance,omitempty"`
+	Deposited string `json:"deposited"`
+	Withdrawn string `json:"withdrawn"`
+	FeesPaid  string `json:"feesPaid,omitempty"`
+	Addresses int    `json:"addresses"`
+}
+
+// SponsoredAddress is an address whose gas fees a sponsor pays, as a sender or as a receiver depending on
+// Kind. An address has at most one sponsor of each kind.
+type SponsoredAddress struct {
+	Address string `json:"address"`
+	DocType string `json:"docType"`
+	Kind    string `json:"kind"`
+	Sponsor string `json:"sponsor"`
+}
+
+func sponsorEscrowAccount(sponsor string) string {
+	return sponsorEscrowPrefix + sponsor
+}
+
+// checkSponsorEscrowReceiver rejects the escrow account of a sponsor as the receiver of a transfer. Its
+// balance only changes through the sponsorship functions, which keep the sponsorship record in step.
+func checkSponsorEscrowReceiver(receiver string) error {
+	if strings.HasPrefix(receiver, sponsorEscrowPrefix) {
+		return fmt.Errorf("error with status code %v, can not transfer to the sponsorship deposit %s", http.StatusForbidden, receiver)
+	}
+	return nil
+}
+
+// requiredSponsorshipDeposit returns the deposit a sponsor needs to sponsor addresses addresses.
+func requiredSponsorshipDeposit(addresses int) *big.Int {
+	required, _ := big.NewInt(0).SetString(minSponsorshipDeposit, 10)
+	return required.Mul(required, big.NewInt(int64(addresses)))
+}
+
+// sponsorshipFunded reports whether the deposit of sponsorship covers the addresses it sponsors.
+func sponsorshipFunded(sponsorship *Sponsorship) bool {
+	balance, ok := big.NewInt(0).SetString(sponsorship.Balance, 10)
+	return ok && balance.Sign() > 0 && balance.Cmp(requiredSponsorshipDeposit(sponsorship.Addresses)) >= 0
+}
+
+// countSponsoredAddresses adds delta to the number of addresses sponsor sponsors.
+func countSponsoredAddresses(sdk kalpsdk.TransactionContextInterface, sponsor string, delta int) error {
+	sponsorship, err := readSponsorship(sdk, sponsor)
+	if err != nil {
+		return err
+	}
+	sponsorship.Addresses += delta
+	return writeSponsorship(sdk, sponsorship)
+}
+
+func sponsorshipKey(sdk kalpsdk.TransactionContextInterface, sponsor string) (string, error) {
+	key, err := sdk.CreateCompositeKey(SponsorshipDocType, []string{sponsor})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for sponsorship of %s: %v", sponsor, err)
+	}
+	return key, nil
+}
+
+// sponsorshipBalance returns the balance of the escrow account of sponsor.
+func sponsorshipBalance(sdk kalpsdk.TransactionContextInterface, sponsor string) (*big.Int, error) {
+	balance, err := GetBalance(sdk, sponsorEscrowAccount(sponsor))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get sponsorship balance of %s: %v", sponsor, err)
+	}
+	value, ok := big.NewInt(0).SetString(balance, 10)
+	if !ok {
+		return nil, fmt.Errorf("invalid sponsorship balance %s of %s", balance, sponsor)
+	}
+	return value, nil
+}
+
+func readSponsorship(sdk kalpsdk.TransactionContextInterface, sponsor string) (*Sponsorship, error) {
+	key, err := sponsorshipKey(sdk, sponsor)
+	if err != nil {
+		return nil, err
+	}
+	sponsorshipJSON, err := sdk.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sponsorship of %s: %v", sponsor, err)
+	}
+	sponsorship := &Sponsorship{Sponsor: sponsor, DocType: SponsorshipDocType, Deposited: "0", Withdrawn: "0"}
+	if sponsorshipJSON != nil {
+		if err := json.Unmarshal(sponsorshipJSON, sponsorship); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal sponsorship of %s: %v", sponsor, err)
+		}
+	}
+	balance, err := sponsorshipBalance(sdk, sponsor)
+	if err != nil {
+		return nil, err
+	}
+	sponsorship.Balance = balance.String()
+	deposited, _ := big.NewInt(0).SetString(sponsorship.Deposited, 10)
+	withdrawn, _ := big.NewInt(0).SetString(sponsorship.Withdrawn, 10)
+	if deposited == nil || withdrawn == nil {
+		return nil, fmt.Errorf("invalid sponsorship of %s", sponsor)
+	}
+	sponsorship.FeesPaid = deposited.Sub(deposited, withdrawn).Sub(deposited, balance).String()
+	return sponsorship, nil
+}
+
+func writeSponsorship(sdk kalpsdk.TransactionContextInterface, sponsorship *Sponsorship) error {
+	key, err := sponsorshipKey(sdk, sponsorship.Sponsor)
+	if err != nil {
+		return err
+	}
+	stored := *sponsorship
+	stored.Balance, stored.FeesPaid = "", ""
+	sponsorshipJSON, err := json.Marshal(stored)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := sdk.PutStateWithoutKYC(key, sponsorshipJSON); err != nil {
+		return fmt.Errorf("failed to write sponsorship of %s: %v", sponsorship.Sponsor, err)
+	}
+	return nil
+}
+
+// addAmount adds delta to the decimal amount a.
+func addAmount(a string, delta *big.Int) string {
+	sum, ok := big.NewInt(0).SetString(a, 10)
+	if !ok {
+		sum = big.NewInt(0)
+	}
+	return sum.Add(sum, delta).String()
+}
+
+func sponsoredAddressKey(sdk kalpsdk.TransactionContextInterface, kind string, address string) (string, error) {
+	key, err := sdk.CreateCompositeKey(SponsoredAddressDocType, []string{kind, address})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for sponsored address %s: %v", address, err)
+	}
+	return key, nil
+}
+
+func readSponsoredAddress(sdk kalpsdk.TransactionContextInterface, kind string, address string) (*SponsoredAddress, error) {
+	key, err := sponsoredAddressKey(sdk, kind, address)
+	if err != nil {
+		return nil, err
+	}
+	sponsoredJSON, err := sdk.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read sponsored address %s: %v", address, err)
+	}
+	if sponsoredJSON == nil {
+		return nil, nil
+	}
+	var sponsored SponsoredAddress
+	if err := json.Unmarshal(sponsoredJSON, &sponsored); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal sponsored address %s: %v", address, err)
+	}
+	return &sponsored, nil
+}
+
+// findSponsor returns the sponsor that pays fee for a transfer from sender to receiver: the sponsor of
+// the sender, or else of the receiver. A sponsor whose deposit can't cover the fee doesn't pay, and the
+// sender pays as usual. It returns "" if nobody sponsors the transfer.
+func findSponsor(sdk kalpsdk.TransactionContextInterface, sender string, receiver string, fee *big.Int) (string, error) {
+	for _, candidate := range []struct{ kind, address string }{{SponsoredUser, sender}, {SponsoredReceiver, receiver}} {
+		sponsored, err := readSponsoredAddress(sdk, candidate.kind, candidate.address)
+		if err != nil {
+			return "", err
+		}
+		if sponsored == nil {
+			continue
+		}
+		balance, err := sponsorshipBalance(sdk, sponsored.Sponsor)
+		if err != nil {
+			return "", err
+		}
+		if balance.Cmp(fee) >= 0 {
+			return sponsored.Sponsor, nil
+		}
+	}
+	return "", nil
+}
+
+// chargeSponsor takes fee out of the deposit of sponsor. The caller distributes the fee.
+func chargeSponsor(sdk kalpsdk.TransactionContextInterface, sponsor string, fee *big.Int) error {
+	if err := RemoveUtxo(sdk, sponsorEscrowAccount(sponsor), fee); err != nil {
+		return fmt.Errorf("error with status code %v, error:error while charging sponsor %s: %v", http.StatusBadRequest, sponsor, err)
+	}
+	return nil
+}
+
+func parseSponsorshipAmount(amount string) (*big.Int, error) {
+	value, ok := big.NewInt(0).SetString(amount, 10)
+	if !ok || value.Sign() <= 0 {
+		return nil, fmt.Errorf("error with status code %v, invalid Amount %v", http.StatusBadRequest, amount)
+	}
+	return value, nil
+}
+
+// DepositSponsorship is a smart contract function which moves amount from the caller into their
+// sponsorship deposit, which pays the gas fees of the addresses they sponsor.
+func (s *SmartContract) DepositSponsorship(ctx kalpsdk.TransactionContextInterface, amount string) (*Sponsorship, error) {
+	ctx = NewUnitOfWork(ctx)
+	sponsor, err := GetUserId(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
+	}
+	value, err := parseSponsorshipAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+	// Every debit of the foundation goes through the multisig transfer threshold.
+	if err := checkFoundationTransfer(ctx, sponsor, value); err != nil {
+		return nil, err
+	}
+	sponsorship, err := readSponsorship(ctx, sponsor)
+	if err != nil {
+		return nil, err
+	}
+	if err := RemoveUtxo(ctx, sponsor, value); err != nil {
+		return nil, fmt.Errorf("error with status code %v, error:error while reducing balance %v", http.StatusBadRequest, err)
+	}
+	if err := AddUtxo(ctx, sponsorEscrowAccount(sponsor), value); err != nil {
+		return nil, fmt.Errorf("error with status code %v, error:error while adding balance %v", http.StatusBadRequest, err)
+	}
+	sponsorship.Balance = addAmount(sponsorship.Balance, value)
+	sponsorship.Deposited = addAmount(sponsorship.Deposited, value)
+	if err := writeSponsorship(ctx, sponsorship); err != nil {
+		return nil, err
+	}
+	return sponsorship, nil
+}
+
+// WithdrawSponsorship is a smart contract function which returns amount from the caller's sponsorship
+// deposit to them.
+func (s *SmartContract) WithdrawSponsorship(ctx kalpsdk.TransactionContextInterface, amount string) (*Sponsorship, error) {
+	ctx = NewUnitOfWork(ctx)
+	sponsor, err := GetUserId(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
+	}
+	value, err := parseSponsorshipAmount(amount)
+	if err != nil {
+		return nil, err
+	}
+	sponsorship, err := readSponsorship(ctx, sponsor)
+	if err != nil {
+		return nil, err
+	}
+	balance, _ := big.NewInt(0).SetString(sponsorship.Balance, 10)
+	if balance == nil || balance.Cmp(value) < 0 {
+		return nil, fmt.Errorf("error with status code %v, sponsorship deposit of %s is %v, can't withdraw %v", http.StatusBadRequest, sponsor, sponsorship.Balance, value)
+	}
+	if err := RemoveUtxo(ctx, sponsorEscrowAccount(sponsor), value); err != nil {
+		return nil, fmt.Errorf("error with status code %v, error:error while reducing balance %v", http.StatusBadRequest, err)
+	}
+	if err := AddUtxo(ctx, sponsor, value); err != nil {
+		return nil, fmt.Errorf("error with status code %v, error:error while adding balance %v", http.StatusBadRequest, err)
+	}
+	sponsorship.Balance = addAmount(sponsorship.Balance, big.NewInt(0).Neg(value))
+	sponsorship.Withdrawn = addAmount(sponsorship.Withdrawn, value)
+	if err := writeSponsorship(ctx, sponsorship); err != nil {
+		return nil, err
+	}
+	return sponsorship, nil
+}
+
+func validateSponsoredAddress(address string, kind string) error {
+	if kind != SponsoredUser && kind != SponsoredReceiver {
+		return fmt.Errorf("error with status code %v, kind must be %q or %q", http.StatusBadRequest, SponsoredUser, SponsoredReceiver)
+	}
+	if len(address) != 40 {
+		return fmt.Errorf("address must be 40 characters long")
+	}
+	if strings.ContainsAny(address, "`~!@#$%^&*()-_+=[]{}\\|;':\",./<>? ") {
+		return fmt.Errorf("invalid address")
+	}
+	return nil
+}
+
+// writeSponsoredAddress stores sponsored and its entry in the whitelist of its sponsor, and counts it for
+// the sponsor.
+func writeSponsoredAddress(sdk kalpsdk.TransactionContextInterface, sponsored SponsoredAddress) error {
+	sponsored.DocType = SponsoredAddressDocType
+	sponsoredJSON, err := json.Marshal(sponsored)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	key, err := sponsoredAddressKey(sdk, sponsored.Kind, sponsored.Address)
+	if err != nil {
+		return err
+	}
+	if err := sdk.PutStateWithoutKYC(key, sponsoredJSON); err != nil {
+		return fmt.Errorf("failed to add sponsored address: %v", err)
+	}
+	whitelistKey, err := sdk.CreateCompositeKey(sponsorWhitelistPrefix, []string{sponsored.Sponsor, sponsored.Kind, sponsored.Address})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for sponsored address %s: %v", sponsored.Address, err)
+	}
+	if err := sdk.PutStateWithoutKYC(whitelistKey, sponsoredJSON); err != nil {
+		return fmt.Errorf("failed to add sponsored address: %v", err)
+	}
+	return countSponsoredAddresses(sdk, sponsored.Sponsor, 1)
+}
+
+// deleteSponsoredAddress removes sponsored and its entry in the whitelist of its sponsor, and stops
+// counting it for the sponsor.
+func deleteSponsoredAddress(sdk kalpsdk.TransactionContextInterface, sponsored *SponsoredAddress) error {
+	key, err := sponsoredAddressKey(sdk, sponsored.Kind, sponsored.Address)
+	if err != nil {
+		return err
+	}
+	if err := sdk.DelStateWithoutKYC(key); err != nil {
+		return fmt.Errorf("failed to remove sponsored address: %v", err)
+	}
+	whitelistKey, err := sdk.CreateCompositeKey(sponsorWhitelistPrefix, []string{sponsored.Sponsor, sponsored.Kind, sponsored.Address})
+	if err != nil {
+		return fmt.Errorf("failed to create the composite key for sponsored address %s: %v", sponsored.Address, err)
+	}
+	if err := sdk.DelStateWithoutKYC(whitelistKey); err != nil {
+		return fmt.Errorf("failed to remove sponsored address: %v", err)
+	}
+	return countSponsoredAddresses(sdk, sponsored.Sponsor, -1)
+}
+
+// AddSponsoredAddress is a smart contract function which lets the caller sponsor the gas fees of
+// transfers sent by address, for kind "user", or sent to address, for kind "receiver". The caller's
+// sponsorship deposit must hold minSponsorshipDeposit for each address it sponsors, including this one.
+// An address whose sponsor's deposit no longer covers its addresses can be taken over by another sponsor.
+func (s *SmartContract) AddSponsoredAddress(ctx kalpsdk.TransactionContextInterface, address string, kind string) error {
+	ctx = NewUnitOfWork(ctx)
+	sponsor, err := GetUserId(ctx)
+	if err != nil {
+		return fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
+	}
+	address = strings.Trim(address, " ")
+	if err := validateSponsoredAddress(address, kind); err != nil {
+		return err
+	}
+	sponsorship, err := readSponsorship(ctx, sponsor)
+	if err != nil {
+		return err
+	}
+	balance, _ := big.NewInt(0).SetString(sponsorship.Balance, 10)
+	if required := requiredSponsorshipDeposit(sponsorship.Addresses + 1); balance == nil || balance.Cmp(required) < 0 {
+		return fmt.Errorf("error with status code %v, sponsorship deposit of %s is %v, sponsoring %d addresses requires %v", http.StatusBadRequest, sponsor, sponsorship.Balance, sponsorship.Addresses+1, required)
+	}
+	existing, err := readSponsoredAddress(ctx, kind, address)
+	if err != nil {
+		return err
+	}
+	if existing != nil {
+		if existing.Sponsor == sponsor {
+			return fmt.Errorf("error with status code %v, %s is already sponsored as %s by %s", http.StatusBadRequest, address, kind, sponsor)
+		}
+		current, err := readSponsorship(ctx, existing.Sponsor)
+		if err != nil {
+			return err
+		}
+		if sponsorshipFunded(current) {
+			return fmt.Errorf("error with status code %v, %s is already sponsored as %s by %s", http.StatusBadRequest, address, kind, existing.Sponsor)
+		}
+		if err := deleteSponsoredAddress(ctx, existing); err != nil {
+			return err
+		}
+	}
+	return writeSponsoredAddress(ctx, SponsoredAddress{Address: address, Kind: kind, Sponsor: sponsor})
+}
+
+// RemoveSponsoredAddress is a smart contract function which stops the sponsoring of address. It can be
+// called by the sponsor or by the sponsored address.
+func (s *SmartContract) RemoveSponsoredAddress(ctx kalpsdk.TransactionContextInterface, address string, kind string) error {
+	ctx = NewUnitOfWork(ctx)
+	operator, err := GetUserId(ctx)
+	if err != nil {
+		return fmt.Errorf("error with status code %v, failed to get client id: %v", http.StatusBadRequest, err)
+	}
+	address = strings.Trim(address, " ")
+	existing, err := readSponsoredAddress(ctx, kind, address)
+	if err != nil {
+		return err
+	}
+	if existing == nil || (existing.Sponsor != operator && existing.Address != operator) {
+		return fmt.Errorf("error with status code %v, %s is not sponsored as %s by %s", http.StatusBadRequest, address, kind, operator)
+	}
+	return deleteSponsoredAddress(ctx, existing)
+}
+
+// GetSponsorship is a smart contract function which returns the deposit balance of a sponsor and how
+// much of it has been used.
+func (s *SmartContract) GetSponsorship(ctx kalpsdk.TransactionContextInterface, sponsor string) (*Sponsorship, error) {
+	ctx = NewQueryContext(ctx)
+	sponsor = strings.Trim(sponsor, " ")
+	if sponsor == "" {
+		return nil, fmt.Errorf("invalid input sponsor is required")
+	}
+	return readSponsorship(ctx, sponsor)
+}
+
+// ListSponsoredAddresses is a smart contract function which returns the addresses a sponsor sponsors.
+func (s *SmartContract) ListSponsoredAddresses(ctx kalpsdk.TransactionContextInterface, sponsor string) ([]SponsoredAddress, error) {
+	ctx = NewQueryContext(ctx)
+	sponsor = strings.Trim(sponsor, " ")
+	if sponsor == "" {
+		return nil, fmt.Errorf("invalid input sponsor is required")
+	}
+	resultsIterator, err := scanPartialCompositeKey(ctx, sponsorWhitelistPrefix, []string{sponsor})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer resultsIterator.Close()
+	addresses := []SponsoredAddress{}
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var sponsored SponsoredAddress
+		if err := json.Unmarshal(queryResult.Value, &sponsored); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal value %v", err)
+		}
+		addresses = append(addresses, sponsored)
+	}
+	return addresses, nil
+}
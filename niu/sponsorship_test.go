@@ -0,0 +1,163 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+const dapp = "da99000000000000000000000000000000000004"
+
+func getSponsorship(t *testing.T, l *fakeledger.Ledger, s *SmartContract, sponsor string) *Sponsorship {
+	t.Helper()
+	sponsorship, err := s.GetSponsorship(l.NewTransaction(alice), sponsor)
+	require.NoError(t, err)
+	return sponsorship
+}
+
+func sponsor(l *fakeledger.Ledger, s *SmartContract, address, kind string) error {
+	return l.Submit(dapp, func(ctx *fakeledger.TransactionContext) error {
+		return s.AddSponsoredAddress(ctx, address, kind)
+	})
+}
+
+func TestSponsoredTransfers(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	require.NoError(t, transfer(l, s, kalpFoundation, dapp, "1000000000000000000"))
+	require.NoError(t, l.Submit(dapp, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.DepositSponsorship(ctx, "100500000000000000")
+		return err
+	}))
+	require.Equal(t, "899500000000000000", balanceOf(t, l, s, dapp))
+	require.Equal(t, "100500000000000000", getSponsorship(t, l, s, dapp).Balance)
+
+	require.Error(t, l.Submit(bob, func(ctx *fakeledger.TransactionContext) error {
+		return s.AddSponsoredAddress(ctx, alice, SponsoredUser)
+	}), "sponsors need a deposit")
+	require.NoError(t, sponsor(l, s, alice, SponsoredUser))
+	require.Error(t, sponsor(l, s, alice, SponsoredUser), "already sponsored")
+	require.Error(t, sponsor(l, s, alice, "sender"))
+	require.Error(t, l.Submit(bob, func(ctx *fakeledger.TransactionContext) error {
+		return s.AddSponsoredAddress(ctx, alice, SponsoredUser)
+	}), "an address has one sponsor of each kind")
+	require.Error(t, sponsor(l, s, carol, SponsoredReceiver), "every sponsored address needs its own minimum deposit")
+	require.Equal(t, 1, getSponsorship(t, l, s, dapp).Addresses)
+
+	plan := estimate(t, l, s, alice, bob, "1000000000000000000")
+	require.Equal(t, dapp, plan.Sponsor)
+	require.Equal(t, "1000000000000000000", plan.NetAmount)
+	foundationBalance := balanceOf(t, l, s, kalpFoundation)
+	require.NoError(t, transfer(l, s, alice, bob, "1000000000000000000"))
+	require.Equal(t, "1000000000000000000", balanceOf(t, l, s, bob), "the receiver gets the full amount")
+	require.Equal(t, "4000000000000000000", balanceOf(t, l, s, alice))
+	require.Equal(t, sum(foundationBalance, initialGasFees), balanceOf(t, l, s, kalpFoundation))
+	var event TransferSingle
+	require.NoError(t, json.Unmarshal(lastEvent(t, l).Payload, &event))
+	require.Equal(t, dapp, event.Sponsor)
+
+	sponsorship := getSponsorship(t, l, s, dapp)
+	require.Equal(t, "99500000000000000", sponsorship.Balance)
+	require.Equal(t, initialGasFees, sponsorship.FeesPaid)
+
+	// Once the deposit can't cover the fee the sender pays it.
+	require.NoError(t, l.Submit(dapp, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.WithdrawSponsorship(ctx, "99000000000000000")
+		return err
+	}))
+	require.NoError(t, transfer(l, s, alice, carol, "1000000000000000000"))
+	require.Equal(t, "999000000000000000", balanceOf(t, l, s, carol))
+
+	require.NoError(t, l.Submit(dapp, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.DepositSponsorship(ctx, "200000000000000000")
+		return err
+	}))
+	require.NoError(t, sponsor(l, s, carol, SponsoredReceiver))
+	require.NoError(t, transfer(l, s, bob, carol, "1000"))
+	require.Equal(t, "999000000000001000", balanceOf(t, l, s, carol))
+	addresses, err := s.ListSponsoredAddresses(l.NewTransaction(dapp), dapp)
+	require.NoError(t, err)
+	require.Len(t, addresses, 2)
+	require.Equal(t, 2, getSponsorship(t, l, s, dapp).Addresses)
+
+	// The deposit only moves through the sponsorship functions.
+	require.ErrorContains(t, transfer(l, s, alice, sponsorEscrowAccount(dapp), "1000"), "sponsorship deposit")
+	require.ErrorContains(t, l.Submit(bob, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.TransferFrom(ctx, alice, sponsorEscrowAccount(dapp), "1000")
+		return err
+	}), "sponsorship deposit")
+
+	require.NoError(t, l.Submit(dapp, func(ctx *fakeledger.TransactionContext) error {
+		return s.RemoveSponsoredAddress(ctx, carol, SponsoredReceiver)
+	}))
+	require.Equal(t, 1, getSponsorship(t, l, s, dapp).Addresses)
+	require.Error(t, l.Submit(dapp, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.WithdrawSponsorship(ctx, "199600000000000000")
+		return err
+	}))
+	require.NoError(t, l.Submit(dapp, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.WithdrawSponsorship(ctx, "199500000000000000")
+		return err
+	}))
+	sponsorship = getSponsorship(t, l, s, dapp)
+	require.Equal(t, "0", sponsorship.Balance)
+	require.Equal(t, "298500000000000000", sponsorship.Withdrawn)
+	require.Equal(t, "998000000000000000", balanceOf(t, l, s, dapp))
+}
+
+func TestSponsoredAddressTakeover(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	deposit := func(sponsor, amount string) error {
+		return l.Submit(sponsor, func(ctx *fakeledger.TransactionContext) error {
+			_, err := s.DepositSponsorship(ctx, amount)
+			return err
+		})
+	}
+	withdraw := func(sponsor, amount string) error {
+		return l.Submit(sponsor, func(ctx *fakeledger.TransactionContext) error {
+			_, err := s.WithdrawSponsorship(ctx, amount)
+			return err
+		})
+	}
+	require.NoError(t, transfer(l, s, kalpFoundation, dapp, "1000000000000000000"))
+	require.NoError(t, transfer(l, s, kalpFoundation, bob, "1000000000000000000"))
+	require.NoError(t, deposit(dapp, "1000"))
+	require.Error(t, sponsor(l, s, alice, SponsoredUser), "a dust deposit can't hold an address")
+	require.NoError(t, deposit(dapp, minSponsorshipDeposit))
+	require.NoError(t, deposit(bob, minSponsorshipDeposit))
+	require.NoError(t, sponsor(l, s, alice, SponsoredUser))
+
+	// A funded sponsor keeps the address; one whose deposit no longer covers its addresses loses it to a
+	// funded one.
+	takeOver := func() error {
+		return l.Submit(bob, func(ctx *fakeledger.TransactionContext) error {
+			return s.AddSponsoredAddress(ctx, alice, SponsoredUser)
+		})
+	}
+	require.Error(t, takeOver())
+	require.NoError(t, withdraw(dapp, "1001"))
+	require.NoError(t, takeOver())
+	require.Equal(t, 0, getSponsorship(t, l, s, dapp).Addresses)
+	require.Equal(t, 1, getSponsorship(t, l, s, bob).Addresses)
+	addresses, err := s.ListSponsoredAddresses(l.NewTransaction(dapp), dapp)
+	require.NoError(t, err)
+	require.Empty(t, addresses)
+	addresses, err = s.ListSponsoredAddresses(l.NewTransaction(bob), bob)
+	require.NoError(t, err)
+	require.Equal(t, []SponsoredAddress{{Address: alice, DocType: SponsoredAddressDocType, Kind: SponsoredUser, Sponsor: bob}}, addresses)
+
+	// The sponsored address can drop its sponsor, other addresses can't.
+	remove := func(operator string) error {
+		return l.Submit(operator, func(ctx *fakeledger.TransactionContext) error {
+			return s.RemoveSponsoredAddress(ctx, alice, SponsoredUser)
+		})
+	}
+	require.Error(t, remove(carol))
+	require.NoError(t, remove(alice))
+	addresses, err = s.ListSponsoredAddresses(l.NewTransaction(bob), bob)
+	require.NoError(t, err)
+	require.Empty(t, addresses)
+}
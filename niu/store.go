@@ -0,0 +1,83 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const richQueryKey = "richQueryBalances"
+
+// UtxoStore lists the unspent outputs of an account.
+type UtxoStore interface {
+	Utxos(sdk kalpsdk.TransactionContextInterface, account string) (kalpsdk.StateQueryIteratorInterface, error)
+}
+
+// RangeUtxoStore scans the UTXO composite keys of an account. It works on both LevelDB and CouchDB
+// and every key it returns is re-validated at commit time, so it is the only store used for spending.
+type RangeUtxoStore struct{}
+
+func (RangeUtxoStore) Utxos(sdk kalpsdk.TransactionContextInterface, account string) (kalpsdk.StateQueryIteratorInterface, error) {
+	return scanPartialCompositeKey(sdk, UTXO, []string{account})
+}
+
+// RichQueryUtxoStore selects the UTXOs of an account with a CouchDB rich query. Rich query results are
+// not re-validated at commit time, so it must only be used for reads that don't lead to writes.
+type RichQueryUtxoStore struct{}
+
+func (RichQueryUtxoStore) Utxos(sdk kalpsdk.TransactionContextInterface, account string) (kalpsdk.StateQueryIteratorInterface, error) {
+	query, err := json.Marshal(map[string]interface{}{
+		"selector":  map[string]string{"docType": UTXO, "account": account},
+		"use_index": []string{"_design/indexUtxoAccountDoc", "indexUtxoAccount"},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to build utxo query: %v", err)
+	}
+	return scanQueryResult(sdk, string(query))
+}
+
+// fallbackUtxoStore tries the rich query store and falls back to the range store when the state
+// database does not support rich queries, e.g. on a LevelDB peer.
+type fallbackUtxoStore struct{}
+
+func (fallbackUtxoStore) Utxos(sdk kalpsdk.TransactionContextInterface, account string) (kalpsdk.StateQueryIteratorInterface, error) {
+	it, err := RichQueryUtxoStore{}.Utxos(sdk, account)
+	if err != nil {
+		return RangeUtxoStore{}.Utxos(sdk, account)
+	}
+	return it, nil
+}
+
+// balanceStore returns the store used to read balances. Range scans are the default; rich queries are
+// used only when they have been enabled with SetRichQueryBalances.
+func balanceStore(sdk kalpsdk.TransactionContextInterface) (UtxoStore, error) {
+	enabled, err := sdk.GetState(richQueryKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read storage options: %v", err)
+	}
+	if string(enabled) == "true" {
+		return fallbackUtxoStore{}, nil
+	}
+	return RangeUtxoStore{}, nil
+}
+
+// SetRichQueryBalances is a smart contract function which lets the foundation read balances with
+// CouchDB rich queries instead of composite key range scans. Spending always uses range scans.
+func (s *SmartContract) SetRichQueryBalances(ctx kalpsdk.TransactionContextInterface, enabled bool) error {
+	ctx = NewUnitOfWork(ctx)
+	userValid, err := s.HasPermission(ctx, PermissionSetRichQueryBalances)
+	if err != nil {
+		return fmt.Errorf("error in validating the role %v", err)
+	}
+	if !userValid {
+		return fmt.Errorf("only %s can change storage options", kalpFoundationRole)
+	}
+	if err := auditKeyChange(ctx, "SetRichQueryBalances", []string{fmt.Sprint(enabled)}, richQueryKey); err != nil {
+		return err
+	}
+	if err := ctx.PutStateWithoutKYC(richQueryKey, []byte(fmt.Sprint(enabled))); err != nil {
+		return fmt.Errorf("failed to set storage options: %v", err)
+	}
+	return nil
+}
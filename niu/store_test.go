@@ -0,0 +1,49 @@
+package kalpAccounting
+
+import (
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestContractOnLevelDB(t *testing.T) {
+	ldb := fakeledger.New()
+	ldb.SetStateDatabase(fakeledger.LevelDB)
+	l, s := initializeLedger(t, ldb)
+
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	require.NoError(t, transfer(l, s, alice, bob, "2000000000000000000"))
+	require.Equal(t, "3000000000000000000", balanceOf(t, l, s, alice))
+	require.Equal(t, "1999000000000000000", balanceOf(t, l, s, bob))
+
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.Approve(ctx, bob, "1000")
+		return err
+	}))
+	allowance, err := s.Allowance(l.NewTransaction(bob), alice, bob)
+	require.NoError(t, err)
+	require.Equal(t, "1000", allowance)
+}
+
+func TestRichQueryBalances(t *testing.T) {
+	for _, db := range []fakeledger.StateDatabase{fakeledger.CouchDB, fakeledger.LevelDB} {
+		ledger := fakeledger.New()
+		ledger.SetStateDatabase(db)
+		l, s := initializeLedger(t, ledger)
+		require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+
+		err := l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+			return s.SetRichQueryBalances(ctx, true)
+		})
+		require.Error(t, err, "only the foundation can change storage options")
+		require.NoError(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+			return s.SetRichQueryBalances(ctx, true)
+		}))
+
+		require.Equal(t, "5000000000000000000", balanceOf(t, l, s, alice), db)
+		require.NoError(t, transfer(l, s, alice, bob, "2000000000000000000"))
+		require.Equal(t, "3000000000000000000", balanceOf(t, l, s, alice), db)
+	}
+}
@@ -0,0 +1,240 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+// Paths a Transfer can take.
+const (
+	// GatewayPath: the gateway admin collects a fee from the sender named in the address, which is split
+	// like gas fees. Deprecated: gateways call CollectGatewayFee.
+	GatewayPath = "gateway"
+	// BridgeToFoundationPath: the foundation withdraws from the bridge contract to itself, without gas fees.
+	BridgeToFoundationPath = "bridgeToFoundation"
+	// BridgePath: the bridge contract pays out to a user, less gas fees.
+	BridgePath = "bridge"
+	// FoundationToFoundationPath: the foundation sends to itself and nothing moves.
+	FoundationToFoundationPath = "foundationToFoundation"
+	// ExemptSenderPath: a fee exempt sender, such as the foundation, sends without gas fees.
+	ExemptSenderPath = "exemptSender"
+	// ExemptReceiverPath: a user sends to a fee exempt receiver, such as the foundation, without gas fees.
+	ExemptReceiverPath = "exemptReceiver"
+	// UserPath: a user sends to another user, who receives the amount less gas fees.
+	UserPath = "user"
+)
+
+// TransferPlan is how a Transfer moves funds: Amount is debited from From, NetAmount is credited to To
+// and Fee is split between the fee recipients. The fee is paid out of Amount, or by Sponsor from their
+// deposit. Nothing moves when From and To are the same account.
+type TransferPlan struct {
+	Path      string `json:"path"`
+	From      string `json:"from"`
+	To        string `json:"to"`
+	Amount    string `json:"amount"`
+	Fee       string `json:"fee"`
+	NetAmount string `json:"netAmount"`
+	Sponsor   string `json:"sponsor,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// planTransfer routes a transfer of amount by sender to address. viaGateway is set when sender collects
+// gateway fees, and viaBridge when the transfer is invoked by the bridge contract. It returns the error
+// Transfer would fail with.
+func planTransfer(ctx kalpsdk.TransactionContextInterface, sender string, address string, amount string, viaGateway bool, viaBridge bool) (*TransferPlan, error) {
+	logger := kalpsdk.NewLogger()
+	address = strings.Trim(address, " ")
+	if address == "" {
+		return nil, fmt.Errorf("invalid input address")
+	}
+	if err := checkSponsorEscrowReceiver(address); err != nil {
+		return nil, err
+	}
+	if len(address) != 40 && !viaGateway {
+		return nil, fmt.Errorf("address must be 40 characters long")
+	}
+	if strings.ContainsAny(address, "`~!@#$%^&*()-_+=[]{}\\|;':\",./<>? ") && !viaGateway {
+		return nil, fmt.Errorf("invalid address")
+	}
+	gasFeePolicy, err := getGasFeePolicy(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get gas gee: %v", err)
+	}
+	transferAmount, su := big.NewInt(0).SetString(amount, 10)
+	if !su {
+		logger.Infof("Amount can't be converted to string")
+		return nil, fmt.Errorf("error with status code %v, invalid Amount %v", http.StatusBadRequest, amount)
+	}
+	if transferAmount.Sign() <= 0 {
+		return nil, fmt.Errorf("error with status code %v, invalid Amount %v", http.StatusBadRequest, amount)
+	}
+	gasFeesAmount, err := gasFeePolicy.Fee(transferAmount)
+	if err != nil {
+		return nil, err
+	}
+	plan := &TransferPlan{From: sender, To: address, Amount: transferAmount.String(), Fee: "0", NetAmount: transferAmount.String()}
+	withFee := func() error {
+		if transferAmount.Cmp(gasFeesAmount) <= 0 {
+			return fmt.Errorf("error with status code %v, error:transfer amount can not be less than equal to gas fee", http.StatusBadRequest)
+		}
+		plan.Fee = gasFeesAmount.String()
+		plan.NetAmount = big.NewInt(0).Sub(transferAmount, gasFeesAmount).String()
+		return nil
+	}
+	logger.Infof("viaGateway: %v, viaBridge: %v\n", viaGateway, viaBridge)
+	foundation, err := foundationAddress(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var senderExempt, receiverExempt bool
+	if !viaGateway {
+		if senderExempt, err = isFeeExempt(ctx, sender); err != nil {
+			return nil, err
+		}
+		if receiverExempt, err = isFeeExempt(ctx, address); err != nil {
+			return nil, err
+		}
+	}
+	switch {
+	// Covers below 2 scenarios where gateway deducts gas fees and transfers to kalp foundation:
+	// 1. when Dapp/users sends non-GINI transactions via gateway
+	// 2. when HandleBridgeToken from bridge contract is called by Bridge Admin
+	case viaGateway:
+		var send Sender
+		if err := json.Unmarshal([]byte(address), &send); err != nil {
+			logger.Info("internal error: error in parsing sender data")
+			return nil, fmt.Errorf("internal error: error in parsing sender data")
+		}
+		if len(send.Sender) != 40 {
+			return nil, fmt.Errorf("address must be 40 characters long")
+		}
+		if strings.ContainsAny(send.Sender, "`~!@#$%^&*()-_+=[]{}\\|;':\",./<>? ") {
+			return nil, fmt.Errorf("invalid address")
+		}
+		plan.Path, plan.From, plan.To = GatewayPath, send.Sender, foundation
+		plan.Fee, plan.NetAmount = plan.Amount, "0"
+	// In this scenario transfer function is invoked fron Withdraw token funtion from bridge contract address.
+	// When the sender is kalp foundation it is bridging from WithdrawToken, and the amount is credited to
+	// kalp foundation without gas fees.
+	case viaBridge && sender == foundation:
+		plan.Path, plan.From, plan.To = BridgeToFoundationPath, BridgeContractAddress, foundation
+	// Otherwise gas fees are credited to kalp foundation and the receiver gets the amount after gas fees.
+	// A fee exempt receiver is credited the full amount.
+	case viaBridge:
+		plan.Path, plan.From = BridgePath, BridgeContractAddress
+		if receiverExempt {
+			break
+		}
+		if transferAmount.Cmp(gasFeesAmount) <= 0 {
+			return nil, fmt.Errorf("error with status code %v, error:bridge amount can not be less than equal to gas fee", http.StatusBadRequest)
+		}
+		if err := withFee(); err != nil {
+			return nil, err
+		}
+	case sender == foundation && address == foundation:
+		plan.Path = FoundationToFoundationPath
+	case sender == address:
+		return nil, fmt.Errorf("transfer to self not alllowed")
+	case senderExempt:
+		plan.Path = ExemptSenderPath
+	case receiverExempt:
+		plan.Path = ExemptReceiverPath
+	default:
+		// This is normal scenario where amount will be deducted from sender and amount-gas fess will credited
+		// to address and gas fees will be credited to kalp foundation
+		plan.Path = UserPath
+		sponsor, err := findSponsor(ctx, sender, address, gasFeesAmount)
+		if err != nil {
+			return nil, err
+		}
+		if sponsor != "" {
+			plan.Sponsor, plan.Fee = sponsor, gasFeesAmount.String()
+			break
+		}
+		if err := withFee(); err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+// executeTransfer moves the funds of plan.
+func executeTransfer(ctx kalpsdk.TransactionContextInterface, plan *TransferPlan) error {
+	if plan.From == plan.To {
+		return nil
+	}
+	amount, _ := big.NewInt(0).SetString(plan.Amount, 10)
+	netAmount, _ := big.NewInt(0).SetString(plan.NetAmount, 10)
+	fee, _ := big.NewInt(0).SetString(plan.Fee, 10)
+	if err := RemoveUtxo(ctx, plan.From, amount); err != nil {
+		return fmt.Errorf("error with status code %v, error:error while reducing balance %v", http.StatusBadRequest, err)
+	}
+	if plan.Sponsor != "" && fee.Sign() > 0 {
+		if err := chargeSponsor(ctx, plan.Sponsor, fee); err != nil {
+			return err
+		}
+	}
+	if netAmount.Sign() > 0 {
+		if err := AddUtxo(ctx, plan.To, netAmount); err != nil {
+			return fmt.Errorf("error with status code %v, error:error while adding balance %v", http.StatusBadRequest, err)
+		}
+	}
+	if fee.Sign() > 0 {
+		if _, err := distributeFee(ctx, fee); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EstimateTransfer is a smart contract function which routes a transfer of amount submitted by sender to
+// receiver the way Transfer would, without writing anything. It returns the path, the gas fee and the
+// amount credited to the receiver, with the error Transfer would fail with, if any. viaBridge estimates
+// the transfer as invoked through the bridge contract, which Transfer detects from the signed proposal.
+func (s *SmartContract) EstimateTransfer(ctx kalpsdk.TransactionContextInterface, sender string, receiver string, amount string, viaBridge bool) (*TransferPlan, error) {
+	ctx = NewQueryContext(ctx)
+	sender = strings.Trim(sender, " ")
+	if sender == "" {
+		return nil, fmt.Errorf("invalid input sender is required")
+	}
+	receiver = strings.Trim(receiver, " ")
+	// As in Transfer, a gateway admin always collects gateway fees, even through the bridge.
+	viaGateway, err := s.hasPermission(ctx, sender, PermissionCollectGatewayFee)
+	if err != nil {
+		return nil, fmt.Errorf("error checking user's role:: %v", err)
+	}
+	viaBridge = viaBridge && !viaGateway
+	plan, err := planTransfer(ctx, sender, receiver, amount, viaGateway, viaBridge)
+	if err != nil {
+		return &TransferPlan{From: sender, To: receiver, Amount: amount, Error: err.Error()}, nil
+	}
+	if plan.From == plan.To {
+		return plan, nil
+	}
+	required, _ := big.NewInt(0).SetString(plan.Amount, 10)
+	if err := checkFoundationTransfer(ctx, plan.From, required); err != nil {
+		plan.Error = err.Error()
+		return plan, nil
+	}
+	if plan.Path == GatewayPath {
+		// Transfer collects the fee under its own transaction ID, which has no receipt yet.
+		if err := checkGatewayFee(ctx, plan.From, required, legacyGatewayDappID, ctx.GetTxID()); err != nil {
+			plan.Error = err.Error()
+		}
+		return plan, nil
+	}
+	balance, err := GetBalance(ctx, plan.From)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get balance %v", err)
+	}
+	available, _ := big.NewInt(0).SetString(balance, 10)
+	if available == nil || available.Cmp(required) < 0 {
+		plan.Error = fmt.Sprintf("account %v has insufficient balance for token %v, required balance: %v, available balance: %v", plan.From, GINI, required, balance)
+	}
+	return plan, nil
+}
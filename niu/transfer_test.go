@@ -0,0 +1,130 @@
+package kalpAccounting
+
+import (
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func estimate(t *testing.T, l *fakeledger.Ledger, s *SmartContract, sender, receiver, amount string) *TransferPlan {
+	t.Helper()
+	plan, err := s.EstimateTransfer(l.NewTransaction(alice), sender, receiver, amount, false)
+	require.NoError(t, err)
+	return plan
+}
+
+func estimateViaBridge(t *testing.T, l *fakeledger.Ledger, s *SmartContract, sender, receiver, amount string) *TransferPlan {
+	t.Helper()
+	plan, err := s.EstimateTransfer(l.NewTransaction(alice), sender, receiver, amount, true)
+	require.NoError(t, err)
+	return plan
+}
+
+// requireTransferMatchesEstimate estimates a transfer, submits it as sender and checks that it fails
+// when the estimate has an error, and otherwise moves what the estimate says.
+func requireTransferMatchesEstimate(t *testing.T, l *fakeledger.Ledger, s *SmartContract, sender, receiver, amount string, viaBridge bool) *TransferPlan {
+	t.Helper()
+	plan, err := s.EstimateTransfer(l.NewTransaction(alice), sender, receiver, amount, viaBridge)
+	require.NoError(t, err)
+	expected := map[string]string{}
+	for _, account := range []string{plan.From, plan.To, kalpFoundation} {
+		expected[account] = balanceOf(t, l, s, account)
+	}
+	if plan.Error == "" && plan.From != plan.To {
+		expected[plan.From] = sum(expected[plan.From], "-"+plan.Amount)
+		expected[plan.To] = sum(expected[plan.To], plan.NetAmount)
+		expected[kalpFoundation] = sum(expected[kalpFoundation], plan.Fee)
+	}
+	err = l.Submit(sender, func(ctx *fakeledger.TransactionContext) error {
+		if viaBridge {
+			ctx.SetCallingChaincode(BridgeContractAddress)
+		}
+		_, err := s.Transfer(ctx, receiver, amount)
+		return err
+	})
+	if plan.Error != "" {
+		require.Error(t, err, plan.Path)
+	} else {
+		require.NoError(t, err, plan.Path)
+	}
+	for account, balance := range expected {
+		require.Equal(t, balance, balanceOf(t, l, s, account), "balance of %s on path %s", account, plan.Path)
+	}
+	return plan
+}
+
+func TestEstimateTransfer(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+	height := l.Height()
+
+	plan := estimate(t, l, s, alice, bob, "2000000000000000000")
+	require.Equal(t, &TransferPlan{Path: UserPath, From: alice, To: bob, Amount: "2000000000000000000", Fee: initialGasFees, NetAmount: "1999000000000000000"}, plan)
+	require.Equal(t, ExemptSenderPath, estimate(t, l, s, kalpFoundation, bob, "10").Path)
+	require.Equal(t, FoundationToFoundationPath, estimate(t, l, s, kalpFoundation, kalpFoundation, "10").Path)
+	plan = estimate(t, l, s, alice, kalpFoundation, "10")
+	require.Equal(t, ExemptReceiverPath, plan.Path)
+	require.Equal(t, "10", plan.NetAmount)
+
+	plan = estimate(t, l, s, intialkalpGateWayadmin, `{"sender":"`+alice+`"}`, "300")
+	require.Equal(t, GatewayPath, plan.Path)
+	require.Equal(t, alice, plan.From)
+	require.Equal(t, kalpFoundation, plan.To)
+	plan = estimateViaBridge(t, l, s, alice, bob, "2000000000000000000")
+	require.Equal(t, BridgePath, plan.Path)
+	require.Equal(t, BridgeContractAddress, plan.From)
+	require.Equal(t, "1999000000000000000", plan.NetAmount)
+	require.Equal(t, BridgeToFoundationPath, estimateViaBridge(t, l, s, kalpFoundation, kalpFoundation, "10").Path)
+	require.Equal(t, GatewayPath, estimateViaBridge(t, l, s, intialkalpGateWayadmin, `{"sender":"`+alice+`"}`, "300").Path)
+
+	require.Contains(t, estimate(t, l, s, alice, bob, "9000000000000000000").Error, "insufficient balance")
+	require.Contains(t, estimate(t, l, s, alice, alice, "10").Error, "transfer to self")
+	require.Contains(t, estimate(t, l, s, alice, bob, initialGasFees).Error, "gas fee")
+	require.Contains(t, estimate(t, l, s, alice, "bob", "10").Error, "40 characters")
+	require.Contains(t, estimate(t, l, s, alice, bob, "-1").Error, "invalid Amount")
+	require.Equal(t, height, l.Height(), "estimates don't write")
+}
+
+func TestTransferMatchesEstimate(t *testing.T) {
+	l, s := newMultisigLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+
+	for _, c := range []struct {
+		sender, receiver, amount string
+		viaBridge                bool
+		path                     string
+	}{
+		{alice, bob, "2000000000000000000", false, UserPath},
+		{kalpFoundation, bob, "1000", false, ExemptSenderPath},
+		{alice, kalpFoundation, "1000", false, ExemptReceiverPath},
+		{kalpFoundation, kalpFoundation, "1000", false, FoundationToFoundationPath},
+		{intialkalpGateWayadmin, `{"sender":"` + alice + `"}`, "300", false, GatewayPath},
+		{intialkalpGateWayadmin, `{"sender":"` + alice + `"}`, "300", true, GatewayPath},
+		{intialkalpGateWayadmin, `{"sender":"` + kalpFoundation + `"}`, "300", false, GatewayPath},
+		{alice, bob, "2000000000000000000", true, BridgePath},
+		{alice, kalpFoundation, "2000000000000000000", true, BridgePath},
+		// The foundation withdraws from the bridge whatever address it names.
+		{kalpFoundation, kalpFoundation, "1000", true, BridgeToFoundationPath},
+		{kalpFoundation, bob, "1000", true, BridgeToFoundationPath},
+	} {
+		plan := requireTransferMatchesEstimate(t, l, s, c.sender, c.receiver, c.amount, c.viaBridge)
+		require.Equal(t, c.path, plan.Path, "%s to %s", c.sender, c.receiver)
+		require.Empty(t, plan.Error)
+	}
+
+	for _, c := range []struct {
+		sender, receiver, amount string
+		viaBridge                bool
+		err                      string
+	}{
+		{alice, bob, "9000000000000000000", false, "insufficient balance"},
+		{bob, alice, "1000", false, "gas fee"},
+		{kalpFoundation, bob, "2000000000000000000000", false, "multisig proposal"},
+		{intialkalpGateWayadmin, `{"sender":"` + carol + `"}`, "300", false, "insufficient balance"},
+	} {
+		plan := requireTransferMatchesEstimate(t, l, s, c.sender, c.receiver, c.amount, c.viaBridge)
+		require.Contains(t, plan.Error, c.err)
+	}
+}
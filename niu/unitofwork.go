@@ -0,0 +1,228 @@
+package kalpAccounting
+
+import (
+	"fmt"
+	"sort"
+	"unicode/utf8"
+
+	"github.com/hyperledger/fabric-protos-go/ledger/queryresult"
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+// UnitOfWork wraps a transaction context and merges the writes made earlier in the transaction into
+// its reads. Fabric reads only return committed state, so without it a second RemoveUtxo for the same
+// account would spend UTXOs that were already deleted, and a balance read after AddUtxo would miss the
+// new output. Writes are passed straight through to the wrapped context.
+type UnitOfWork struct {
+	kalpsdk.TransactionContextInterface
+	pending map[string]pendingWrite
+	// consolidations are the UTXO merges made automatically during the transaction.
+	consolidations []UtxoConsolidation
+	// feeShares are the gas fees distributed during the transaction.
+	feeShares []FeeShare
+	// outputs is the number of UTXOs created during the transaction, and the index of the next one.
+	outputs int
+	// gasFeeChange is the scheduled gas fee change applied during the transaction.
+	gasFeeChange *GasFeeRecord
+	// audits is the number of admin audit records written during the transaction.
+	audits int
+}
+
+type pendingWrite struct {
+	value   []byte
+	deleted bool
+}
+
+// NewUnitOfWork wraps ctx. Wrapping a UnitOfWork returns it unchanged, so every function of one
+// invocation shares the same pending writes.
+func NewUnitOfWork(ctx kalpsdk.TransactionContextInterface) *UnitOfWork {
+	if uow, ok := ctx.(*UnitOfWork); ok {
+		return uow
+	}
+	return &UnitOfWork{TransactionContextInterface: ctx, pending: map[string]pendingWrite{}}
+}
+
+// requireUnitOfWork returns sdk as a UnitOfWork. Functions that count the outputs of the transaction or
+// read its earlier writes fail on a bare context, where every call would start over from committed state.
+func requireUnitOfWork(sdk kalpsdk.TransactionContextInterface, function string) (*UnitOfWork, error) {
+	uow, ok := sdk.(*UnitOfWork)
+	if !ok {
+		return nil, fmt.Errorf("%s must be called in a unit of work", function)
+	}
+	return uow, nil
+}
+
+// nextOutput returns the index of the next UTXO created in the transaction. Every output gets its own
+// key even when the same account is credited more than once, and simulating the same proposal again
+// starts from index 0 and produces the same keys.
+func (u *UnitOfWork) nextOutput() int {
+	index := u.outputs
+	u.outputs++
+	return index
+}
+
+// nextAudit returns the sequence number of the next admin audit record written in the transaction, so
+// that a transaction making several privileged calls records each of them.
+func (u *UnitOfWork) nextAudit() int {
+	sequence := u.audits
+	u.audits++
+	return sequence
+}
+
+func (u *UnitOfWork) PutStateWithKYC(key string, value []byte) error {
+	if err := u.TransactionContextInterface.PutStateWithKYC(key, value); err != nil {
+		return err
+	}
+	u.record(key, value)
+	return nil
+}
+
+func (u *UnitOfWork) PutStateWithoutKYC(key string, value []byte) error {
+	if err := u.TransactionContextInterface.PutStateWithoutKYC(key, value); err != nil {
+		return err
+	}
+	u.record(key, value)
+	return nil
+}
+
+func (u *UnitOfWork) DelStateWithKYC(key string) error {
+	if err := u.TransactionContextInterface.DelStateWithKYC(key); err != nil {
+		return err
+	}
+	u.pending[key] = pendingWrite{deleted: true}
+	return nil
+}
+
+func (u *UnitOfWork) DelStateWithoutKYC(key string) error {
+	if err := u.TransactionContextInterface.DelStateWithoutKYC(key); err != nil {
+		return err
+	}
+	u.pending[key] = pendingWrite{deleted: true}
+	return nil
+}
+
+func (u *UnitOfWork) record(key string, value []byte) {
+	if value == nil {
+		// A nil put is recorded by Fabric as a delete.
+		u.pending[key] = pendingWrite{deleted: true}
+		return
+	}
+	u.pending[key] = pendingWrite{value: append([]byte{}, value...)}
+}
+
+// HasPendingWrites reports whether anything has been written through the unit of work.
+func (u *UnitOfWork) HasPendingWrites() bool {
+	return len(u.pending) > 0
+}
+
+// GetState returns the pending value of key if the transaction wrote it, and the committed value otherwise.
+func (u *UnitOfWork) GetState(key string) ([]byte, error) {
+	if w, ok := u.pending[key]; ok {
+		if w.deleted {
+			return nil, nil
+		}
+		return append([]byte{}, w.value...), nil
+	}
+	return u.TransactionContextInterface.GetState(key)
+}
+
+// GetStateByPartialCompositeKey merges pending writes into the committed results. The underlying
+// query is still executed, so the range is part of the read set.
+func (u *UnitOfWork) GetStateByPartialCompositeKey(objectType string, keys []string) (kalpsdk.StateQueryIteratorInterface, error) {
+	startKey, err := u.CreateCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	base, err := u.TransactionContextInterface.GetStateByPartialCompositeKey(objectType, keys)
+	if err != nil {
+		return nil, err
+	}
+	return u.merge(base, startKey, startKey+string(utf8.MaxRune)), nil
+}
+
+// GetStateByRange merges pending writes into the committed results.
+func (u *UnitOfWork) GetStateByRange(startKey string, endKey string) (kalpsdk.StateQueryIteratorInterface, error) {
+	base, err := u.TransactionContextInterface.GetStateByRange(startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	if startKey == "" {
+		startKey = "\x01"
+	}
+	return u.merge(base, startKey, endKey), nil
+}
+
+// GetQueryResult refuses rich queries once the transaction has written anything: the selector can't be
+// evaluated against pending writes, and a result that ignores them would be wrong.
+func (u *UnitOfWork) GetQueryResult(query string) (kalpsdk.StateQueryIteratorInterface, error) {
+	if u.HasPendingWrites() {
+		return nil, fmt.Errorf("rich queries are not supported after writes in the same transaction")
+	}
+	return u.TransactionContextInterface.GetQueryResult(query)
+}
+
+func (u *UnitOfWork) merge(base kalpsdk.StateQueryIteratorInterface, startKey, endKey string) *mergedIterator {
+	// The iterator works on a snapshot of the pending writes, so writes made while iterating don't change it.
+	it := &mergedIterator{base: base, pending: make(map[string]pendingWrite, len(u.pending))}
+	for key, w := range u.pending {
+		it.pending[key] = w
+		if !w.deleted && key >= startKey && (endKey == "" || key < endKey) {
+			it.puts = append(it.puts, &queryresult.KV{Key: key, Value: append([]byte{}, w.value...)})
+		}
+	}
+	sort.Slice(it.puts, func(i, j int) bool { return it.puts[i].Key < it.puts[j].Key })
+	return it
+}
+
+// mergedIterator yields committed results that the transaction has not written, interleaved in key order
+// with the values it has put. Committed results are pulled lazily, so stopping early keeps the read set
+// as small as it would be without the unit of work.
+type mergedIterator struct {
+	base    kalpsdk.StateQueryIteratorInterface
+	pending map[string]pendingWrite
+	puts    []*queryresult.KV
+	next    *queryresult.KV
+	err     error
+}
+
+func (it *mergedIterator) fill() {
+	for it.next == nil && it.err == nil && it.base.HasNext() {
+		kv, err := it.base.Next()
+		if err != nil {
+			it.err = err
+			return
+		}
+		if _, written := it.pending[kv.Key]; !written {
+			it.next = kv
+		}
+	}
+}
+
+func (it *mergedIterator) HasNext() bool {
+	it.fill()
+	return it.err != nil || it.next != nil || len(it.puts) > 0
+}
+
+func (it *mergedIterator) Next() (*queryresult.KV, error) {
+	it.fill()
+	if it.err != nil {
+		err := it.err
+		it.err = nil
+		return nil, err
+	}
+	if len(it.puts) > 0 && (it.next == nil || it.puts[0].Key < it.next.Key) {
+		kv := it.puts[0]
+		it.puts = it.puts[1:]
+		return kv, nil
+	}
+	if it.next == nil {
+		return nil, fmt.Errorf("no more results")
+	}
+	kv := it.next
+	it.next = nil
+	return kv, nil
+}
+
+func (it *mergedIterator) Close() error {
+	return it.base.Close()
+}
@@ -0,0 +1,73 @@
+package kalpAccounting
+
+import (
+	"math/big"
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestUnitOfWorkReadsPendingWrites(t *testing.T) {
+	l := fakeledger.New()
+	l.PutState("committed", []byte("old"))
+	ctx := l.NewTransaction(alice)
+	uow := NewUnitOfWork(ctx)
+	require.Same(t, uow, NewUnitOfWork(uow))
+
+	require.NoError(t, uow.PutStateWithoutKYC("committed", []byte("new")))
+	require.NoError(t, uow.PutStateWithoutKYC("fresh", []byte("v")))
+	v, err := uow.GetState("committed")
+	require.NoError(t, err)
+	require.Equal(t, []byte("new"), v)
+	require.NoError(t, uow.DelStateWithoutKYC("fresh"))
+	v, err = uow.GetState("fresh")
+	require.NoError(t, err)
+	require.Nil(t, v)
+
+	_, err = uow.GetQueryResult(`{"selector":{}}`)
+	require.Error(t, err)
+
+	require.NoError(t, AddUtxo(uow, alice, big.NewInt(7)))
+	total, err := GetTotalUTXO(uow, alice)
+	require.NoError(t, err)
+	require.Equal(t, "7", total)
+
+	require.NoError(t, ctx.Commit())
+	require.Equal(t, []byte("new"), l.GetState("committed"))
+	require.Nil(t, l.GetState("fresh"))
+}
+
+func TestRemoveUtxoTwiceInOneTransaction(t *testing.T) {
+	l := fakeledger.New()
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return AddUtxo(NewUnitOfWork(ctx), alice, big.NewInt(10))
+	}))
+
+	err := l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		uow := NewUnitOfWork(ctx)
+		if err := RemoveUtxo(uow, alice, big.NewInt(6)); err != nil {
+			return err
+		}
+		return RemoveUtxo(uow, alice, big.NewInt(6))
+	})
+	require.ErrorContains(t, err, "insufficient balance", "the second spend must see the first one")
+
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		uow := NewUnitOfWork(ctx)
+		if err := RemoveUtxo(uow, alice, big.NewInt(6)); err != nil {
+			return err
+		}
+		if err := RemoveUtxo(uow, alice, big.NewInt(3)); err != nil {
+			return err
+		}
+		return AddUtxo(uow, bob, big.NewInt(9))
+	}))
+	total, err := GetTotalUTXO(l.NewTransaction(alice), alice)
+	require.NoError(t, err)
+	require.Equal(t, "1", total)
+	total, err = GetTotalUTXO(l.NewTransaction(bob), bob)
+	require.NoError(t, err)
+	require.Equal(t, "9", total)
+}
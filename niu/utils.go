@@ -5,8 +5,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"math/big"
+	"net/http"
 	"reflect"
-
+	"strconv"
 	"strings"
 
 	"github.com/golang/protobuf/proto"
@@ -23,6 +24,8 @@ type Utxo struct {
 	Account string `json:"account"`
 	DocType string `json:"docType"`
 	Amount  string `json:"amount"`
+	// CreatedAt is the unix time of the transaction that created the UTXO. It is 0 for older UTXOs.
+	CreatedAt int64 `json:"createdAt,omitempty"`
 }
 
 type Allow struct {
@@ -38,6 +41,14 @@ type TransferSingle struct {
 	To       string      `json:"to"`
 	ID       string      `json:"id"`
 	Value    interface{} `json:"value"`
+	// Consolidations lists the UTXO merges that ran automatically during the transaction.
+	Consolidations []UtxoConsolidation `json:"consolidations,omitempty"`
+	// FeeSplit lists how the gas fee of the transfer was distributed.
+	FeeSplit []FeeShare `json:"feeSplit,omitempty"`
+	// Sponsor paid the gas fee in place of the sender.
+	Sponsor string `json:"sponsor,omitempty"`
+	// GasFeeChange is the scheduled gas fee change that took effect with the transfer.
+	GasFeeChange *GasFeeRecord `json:"gasFeeChange,omitempty"`
 }
 
 func CustomBigIntConvertor(value interface{}) (*big.Int, error) {
@@ -77,17 +88,67 @@ func MintUtxoHelperWithoutKYC(sdk kalpsdk.TransactionContextInterface, account s
 	if err != nil {
 		return err
 	}
-	err = AddUtxo(sdk, kalpFoundation, kalpFoundationAmount)
+	foundation, err := foundationAddress(sdk)
+	if err != nil {
+		return err
+	}
+	err = AddUtxo(sdk, foundation, kalpFoundationAmount)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
+// txTime returns the unix time of the current transaction.
+func txTime(sdk kalpsdk.TransactionContextInterface) (int64, error) {
+	timestamp, err := sdk.GetTxTimestamp()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get transaction timestamp: %v", err)
+	}
+	return timestamp.GetSeconds(), nil
+}
+
+// newUtxoKey returns the key of the next output of the current transaction: UTXO~account~txID~index.
+// The index is counted by the UnitOfWork, so functions that create several outputs in one transaction
+// must share one.
+func newUtxoKey(sdk kalpsdk.TransactionContextInterface, account string) (string, error) {
+	uow, err := requireUnitOfWork(sdk, "newUtxoKey")
+	if err != nil {
+		return "", err
+	}
+	index := uow.nextOutput()
+	utxoKey, err := sdk.CreateCompositeKey(UTXO, []string{account, sdk.GetTxID(), strconv.Itoa(index)})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for owner %s: %v", account, err)
+	}
+	return utxoKey, nil
+}
+
+// splitUtxoKey returns the account, creating transaction and output index of a UTXO key. Keys
+// written before outputs were indexed have no index and an empty string is returned for it.
+func splitUtxoKey(sdk kalpsdk.TransactionContextInterface, utxoKey string) (string, string, string, error) {
+	objectType, attributes, err := sdk.SplitCompositeKey(utxoKey)
+	if err != nil {
+		return "", "", "", fmt.Errorf("failed to split utxo key %s: %v", utxoKey, err)
+	}
+	if objectType != UTXO || len(attributes) < 2 || len(attributes) > 3 {
+		return "", "", "", fmt.Errorf("%s is not a utxo key", utxoKey)
+	}
+	if len(attributes) == 2 {
+		return attributes[0], attributes[1], "", nil
+	}
+	return attributes[0], attributes[1], attributes[2], nil
+}
+
+// AddUtxo creates a UTXO of amount for account. It must be called with the UnitOfWork of the
+// transaction, which numbers its outputs.
 func AddUtxo(sdk kalpsdk.TransactionContextInterface, account string, iamount interface{}) error {
-	utxoKey, err := sdk.CreateCompositeKey(UTXO, []string{account, sdk.GetTxID()})
+	if _, err := requireUnitOfWork(sdk, "AddUtxo"); err != nil {
+		return err
+	}
+	utxoKey, err := newUtxoKey(sdk, account)
 	if err != nil {
-		return fmt.Errorf("failed to create the composite key for owner %s: %v", account, err)
+		return err
 	}
 	amount, err := CustomBigIntConvertor(iamount)
 	if err != nil {
@@ -95,10 +156,15 @@ func AddUtxo(sdk kalpsdk.TransactionContextInterface, account string, iamount in
 	}
 	fmt.Printf("add amount: %v\n", amount)
 	fmt.Printf("utxoKey: %v\n", utxoKey)
+	createdAt, err := txTime(sdk)
+	if err != nil {
+		return err
+	}
 	utxo := Utxo{
-		DocType: UTXO,
-		Account: account,
-		Amount:  amount.String(),
+		DocType:   UTXO,
+		Account:   account,
+		Amount:    amount.String(),
+		CreatedAt: createdAt,
 	}
 
 	utxoJSON, err := json.Marshal(utxo)
@@ -107,6 +173,9 @@ func AddUtxo(sdk kalpsdk.TransactionContextInterface, account string, iamount in
 	}
 	fmt.Printf("utxoJSON: %s\n", utxoJSON)
 
+	if err := adjustBalance(sdk, account, amount, 1); err != nil {
+		return err
+	}
 	err = sdk.PutStateWithoutKYC(utxoKey, utxoJSON)
 	if err != nil {
 		return fmt.Errorf("failed to put owner with ID %s and account address %s to world state: %v", GINI, account, err)
@@ -114,23 +183,68 @@ func AddUtxo(sdk kalpsdk.TransactionContextInterface, account string, iamount in
 	}
 	return nil
 }
-func RemoveUtxo(sdk kalpsdk.TransactionContextInterface, account string, iamount interface{}) error {
 
-	utxoKey, err := sdk.CreateCompositeKey(UTXO, []string{account, sdk.GetTxID()})
+// migrateUtxoKeys rewrites the UTXOs of account that still use the UTXO~account~txID key to
+// UTXO~account~txID~0. Such keys held the only output of their transaction for the account.
+func migrateUtxoKeys(sdk kalpsdk.TransactionContextInterface, account string) (int, error) {
+	sdk = NewUnitOfWork(sdk)
+	resultsIterator, err := RangeUtxoStore{}.Utxos(sdk, account)
 	if err != nil {
-		return fmt.Errorf("failed to create the composite key for owner %s: %v", account, err)
+		return 0, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer resultsIterator.Close()
+	migrated := 0
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return migrated, err
+		}
+		_, txID, index, err := splitUtxoKey(sdk, queryResult.Key)
+		if err != nil {
+			return migrated, err
+		}
+		if index != "" {
+			continue
+		}
+		utxoKey, err := sdk.CreateCompositeKey(UTXO, []string{account, txID, "0"})
+		if err != nil {
+			return migrated, fmt.Errorf("failed to create the composite key for owner %s: %v", account, err)
+		}
+		if err := sdk.PutStateWithoutKYC(utxoKey, queryResult.Value); err != nil {
+			return migrated, fmt.Errorf("failed to put utxo %s to world state: %v", utxoKey, err)
+		}
+		if err := sdk.DelStateWithoutKYC(queryResult.Key); err != nil {
+			return migrated, fmt.Errorf("failed to delete utxo %s from world state: %v", queryResult.Key, err)
+		}
+		migrated++
+	}
+	return migrated, nil
+}
+
+// RemoveUtxo spends UTXOs of account covering amount and returns the change to it. It must be called with
+// the UnitOfWork of the transaction, so it doesn't spend UTXOs removed earlier in the transaction.
+func RemoveUtxo(sdk kalpsdk.TransactionContextInterface, account string, iamount interface{}) error {
+	if _, err := requireUnitOfWork(sdk, "RemoveUtxo"); err != nil {
+		return err
 	}
-	queryString := `{"selector":{"account":"` + account + `","docType":"` + UTXO + `"},"use_index": "indexIdDocType"}`
 	amount, err := CustomBigIntConvertor(iamount)
 	if err != nil {
 		return fmt.Errorf("error in CustomBigInt %v", err)
 	}
-	fmt.Printf("queryString: %s\n", queryString)
-	resultsIterator, err := sdk.GetQueryResult(queryString)
+	selector, err := coinSelector(sdk)
+	if err != nil {
+		return err
+	}
+	// UTXOs are selected through a partial composite key range rather than a rich query, so the
+	// spent keys end up in the read set and a concurrent spend of the same UTXOs fails MVCC validation.
+	resultsIterator, err := RangeUtxoStore{}.Utxos(sdk, account)
 	if err != nil {
 		return fmt.Errorf("failed to read from world state: %v", err)
 	}
-	var utxo []Utxo
+	defer resultsIterator.Close()
+	// Key order only needs the first UTXOs that cover the amount; the other strategies look at all of them.
+	_, keyOrder := selector.(KeyOrderSelector)
+	var coins []Coin
 	amt := big.NewInt(0)
 	for resultsIterator.HasNext() {
 		var u Utxo
@@ -150,53 +264,62 @@ func RemoveUtxo(sdk kalpsdk.TransactionContextInterface, account string, iamount
 			return fmt.Errorf("failed to set string")
 		}
 		amt.Add(amt, am)
-		utxo = append(utxo, u)
-		if amt.Cmp(amount) == 0 || amt.Cmp(amount) == 1 { // >= amount {
+		coins = append(coins, Coin{Utxo: u, Value: am})
+		if keyOrder && amt.Cmp(amount) >= 0 {
 			break
 		}
 	}
 	fmt.Printf("amount: %v\n", amount)
 	fmt.Printf("total balance: %v\n", amt)
-	if amount.Cmp(amt) == 1 {
+	spent, ok := selector.Select(coins, amount)
+	if !ok {
 		return fmt.Errorf("account %v has insufficient balance for token %v, required balance: %v, available balance: %v", account, GINI, amount, amt)
 	}
-
-	for i := 0; i < len(utxo); i++ {
-		am, s := big.NewInt(0).SetString(utxo[i].Amount, 10)
-		if !s {
-			return fmt.Errorf("failed to set string")
+	spentAmount := big.NewInt(0)
+	for _, c := range spent {
+		spentAmount.Add(spentAmount, c.Value)
+	}
+	change := spentAmount.Sub(spentAmount, amount)
+	// The spent UTXOs are deleted and replaced by a single change output if they cover more than the amount.
+	utxoCount := -len(spent)
+	if change.Sign() > 0 {
+		utxoCount++
+	}
+	if err := adjustBalance(sdk, account, big.NewInt(0).Neg(amount), utxoCount); err != nil {
+		return err
+	}
+	for _, c := range spent {
+		if err := sdk.DelStateWithoutKYC(c.Key); err != nil {
+			return fmt.Errorf("%v", err)
 		}
-		if amount.Cmp(am) == 0 || amount.Cmp(am) == 1 { // >= utxo[i].Amount {
-			fmt.Printf("amount> delete: %s\n", utxo[i].Amount)
-			amount = amount.Sub(amount, am)
-			if err := sdk.DelStateWithoutKYC(utxo[i].Key); err != nil {
-				return fmt.Errorf("%v", err)
-			}
-		} else if amount.Cmp(am) == -1 { // < utxo[i].Amount {
-			fmt.Printf("amount<: %s\n", utxo[i].Amount)
-			if err := sdk.DelStateWithoutKYC(utxo[i].Key); err != nil {
-				return fmt.Errorf("%v", err)
-			}
-			// Create a new utxo object
-			utxo := Utxo{
-				DocType: UTXO,
-				Account: account,
-				Amount:  am.Sub(am, amount).String(),
-			}
-			utxoJSON, err := json.Marshal(utxo)
-			if err != nil {
-				return fmt.Errorf("failed to marshal owner with  and account address %s to JSON: %v", account, err)
-			}
-
-			err = sdk.PutStateWithoutKYC(utxoKey, utxoJSON)
-			if err != nil {
-				return fmt.Errorf("failed to put owner with  and account address %s to world state: %v", account, err)
-			}
-
+	}
+	if change.Sign() > 0 {
+		createdAt, err := txTime(sdk)
+		if err != nil {
+			return err
+		}
+		// Create a new utxo object
+		utxo := Utxo{
+			DocType:   UTXO,
+			Account:   account,
+			Amount:    change.String(),
+			CreatedAt: createdAt,
+		}
+		utxoJSON, err := json.Marshal(utxo)
+		if err != nil {
+			return fmt.Errorf("failed to marshal owner with  and account address %s to JSON: %v", account, err)
+		}
+		utxoKey, err := newUtxoKey(sdk, account)
+		if err != nil {
+			return err
+		}
+		err = sdk.PutStateWithoutKYC(utxoKey, utxoJSON)
+		if err != nil {
+			return fmt.Errorf("failed to put owner with  and account address %s to world state: %v", account, err)
 		}
 	}
-
-	return nil
+	// Only the spender's own UTXOs are merged, so credits never touch the UTXOs of the account they pay.
+	return autoConsolidateUtxos(sdk, account)
 }
 
 // Function to get extract the userId from ca identity.  It is required to for checking the minter
@@ -217,6 +340,12 @@ func GetUserId(sdk kalpsdk.TransactionContextInterface) (string, error) {
 }
 
 func EmitTransferSingle(sdk kalpsdk.TransactionContextInterface, transferSingleEvent TransferSingle) error {
+	// A transaction has a single event, so automatic consolidations are reported in the transfer event.
+	if uow, ok := sdk.(*UnitOfWork); ok {
+		transferSingleEvent.Consolidations = uow.consolidations
+		transferSingleEvent.FeeSplit = uow.feeShares
+		transferSingleEvent.GasFeeChange = uow.gasFeeChange
+	}
 	transferSingleEventJSON, err := json.Marshal(transferSingleEvent)
 	if err != nil {
 		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
@@ -267,12 +396,15 @@ func IsCallerKalpBridge(sdk kalpsdk.TransactionContextInterface, KalpBridgeContr
 
 func GetTotalUTXO(sdk kalpsdk.TransactionContextInterface, account string) (string, error) {
 	logger := kalpsdk.NewLogger()
-	queryString := `{"selector":{"account":"` + account + `","docType":"` + UTXO + `"}}`
-	logger.Infof("queryString: %s\n", queryString)
-	resultsIterator, err := sdk.GetQueryResult(queryString)
+	store, err := balanceStore(sdk)
+	if err != nil {
+		return "", err
+	}
+	resultsIterator, err := store.Utxos(sdk, account)
 	if err != nil {
 		return "", fmt.Errorf("failed to read from world state: %v", err)
 	}
+	defer resultsIterator.Close()
 	amt := big.NewInt(0)
 	for resultsIterator.HasNext() {
 		var u map[string]interface{}
@@ -301,6 +433,7 @@ func GetTotalUTXO(sdk kalpsdk.TransactionContextInterface, account string) (stri
 }
 
 func Approve(sdk kalpsdk.TransactionContextInterface, owner string, spender string, amount string) error {
+	sdk = NewUnitOfWork(sdk)
 	// Emit the Approval event
 	operator, err := GetUserId(sdk)
 	if err != nil {
@@ -318,7 +451,7 @@ func Approve(sdk kalpsdk.TransactionContextInterface, owner string, spender stri
 
 	fmt.Println("owner->", owner)
 	// Get the current balance of the owner
-	balance, err := GetTotalUTXO(sdk, owner)
+	balance, err := GetBalance(sdk, owner)
 	if err != nil {
 		return fmt.Errorf("failed to get balance %v", err)
 	}
@@ -464,6 +597,9 @@ func TransferUTXOFrom(sdk kalpsdk.TransactionContextInterface, owner []string, s
 	if spender[0] == owner[0] {
 		return fmt.Errorf("owner and spender can not be same account")
 	}
+	if err := checkFoundationTransfer(sdk, owner[0], amount); err != nil {
+		return err
+	}
 	fmt.Printf("spender check")
 
 	err = RemoveUtxo(sdk, owner[0], amount)
@@ -490,29 +626,128 @@ func TransferUTXOFrom(sdk kalpsdk.TransactionContextInterface, owner []string, s
 	return EmitTransferSingle(sdk, transferSingleEvent)
 }
 
-func InitializeRoles(ctx kalpsdk.TransactionContextInterface, id string, role string) (bool, error) {
-	userRole := UserRole{
-		Id:      id,
-		Role:    role,
-		DocType: UserRoleMap,
+// validRoles are the roles that can be assigned.
+var validRoles = []string{kalpFoundationRole, gasFeesAdminRole, kalpGateWayAdmin}
+
+// userRoleKey is the key of the assignment of role to id. Before identities could have several roles,
+// the only role of id was stored under ID~UserRoleMap~id~UserRoleMap.
+func userRoleKey(ctx kalpsdk.TransactionContextInterface, id string, role string) (string, error) {
+	key, err := ctx.CreateCompositeKey(userRolePrefix, []string{id, role})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the composite key for prefix %s: %v", userRolePrefix, err)
 	}
-	roleJson, err := json.Marshal(userRole)
+	return key, nil
+}
+
+// roleMemberKey is the key of the index of role assignments by role, Role~ID~role~id.
+func roleMemberKey(ctx kalpsdk.TransactionContextInterface, role string, id string) (string, error) {
+	key, err := ctx.CreateCompositeKey(roleMemberPrefix, []string{role, id})
 	if err != nil {
-		fmt.Println("Error marshaling struct:", err)
-		return false, fmt.Errorf("error marsheling user role")
+		return "", fmt.Errorf("failed to create the composite key for prefix %s: %v", roleMemberPrefix, err)
 	}
-	key, err := ctx.CreateCompositeKey(userRolePrefix, []string{userRole.Id, UserRoleMap})
+	return key, nil
+}
+
+// putUserRole stores the assignment of a role and indexes it by role.
+func putUserRole(ctx kalpsdk.TransactionContextInterface, userRole UserRole) error {
+	userRole.DocType = UserRoleMap
+	key, err := userRoleKey(ctx, userRole.Id, userRole.Role)
+	if err != nil {
+		return err
+	}
+	memberKey, err := roleMemberKey(ctx, userRole.Role, userRole.Id)
+	if err != nil {
+		return err
+	}
+	usrRoleJSON, err := json.Marshal(userRole)
 	if err != nil {
-		return false, fmt.Errorf("failed to create the composite key for prefix %s: %v", userRolePrefix, err)
+		return fmt.Errorf("unable to Marshal userRole struct : %v", err)
 	}
-	if err := ctx.PutStateWithoutKYC(key, roleJson); err != nil {
-		return false, fmt.Errorf("unable to put user role struct in statedb: %v", err)
+	if err := ctx.PutStateWithoutKYC(key, usrRoleJSON); err != nil {
+		return fmt.Errorf("unable to put user role struct in statedb: %v", err)
+	}
+	if err := ctx.PutStateWithoutKYC(memberKey, []byte{0x00}); err != nil {
+		return fmt.Errorf("unable to put role member index in statedb: %v", err)
+	}
+	return nil
+}
+
+// readUserRole returns the assignment stored under key, or nil if there is none.
+func readUserRole(ctx kalpsdk.TransactionContextInterface, key string) (*UserRole, error) {
+	userJSON, err := ctx.GetState(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	if userJSON == nil {
+		return nil, nil
+	}
+	var userRole UserRole
+	if err := json.Unmarshal(userJSON, &userRole); err != nil {
+		return nil, fmt.Errorf("unable to unmarshal user role struct : %v", err)
+	}
+	return &userRole, nil
+}
+
+// expired reports whether the role is no longer granted at the unix time now.
+func (userRole *UserRole) expired(now int64) bool {
+	return userRole.ExpiresAt != 0 && userRole.ExpiresAt <= now
+}
+
+// deleteUserRole removes the assignment of role to id, including a legacy assignment, and reports
+// whether there was one.
+func deleteUserRole(ctx kalpsdk.TransactionContextInterface, id string, role string) (bool, error) {
+	deleted := false
+	key, err := userRoleKey(ctx, id, role)
+	if err != nil {
+		return false, err
+	}
+	userRole, err := readUserRole(ctx, key)
+	if err != nil {
+		return false, err
+	}
+	if userRole != nil {
+		memberKey, err := roleMemberKey(ctx, role, id)
+		if err != nil {
+			return false, err
+		}
+		if err := ctx.DelStateWithoutKYC(key); err != nil {
+			return false, fmt.Errorf("unable to delete user role: %v", err)
+		}
+		if err := ctx.DelStateWithoutKYC(memberKey); err != nil {
+			return false, fmt.Errorf("unable to delete role member index: %v", err)
+		}
+		deleted = true
+	}
+	legacyKey, err := userRoleKey(ctx, id, UserRoleMap)
+	if err != nil {
+		return false, err
+	}
+	legacy, err := readUserRole(ctx, legacyKey)
+	if err != nil {
+		return false, err
+	}
+	if legacy != nil && legacy.Role == role {
+		if err := ctx.DelStateWithoutKYC(legacyKey); err != nil {
+			return false, fmt.Errorf("unable to delete user role: %v", err)
+		}
+		deleted = true
+	}
+	return deleted, nil
+}
+
+func InitializeRoles(ctx kalpsdk.TransactionContextInterface, id string, role string) (bool, error) {
+	if err := putUserRole(ctx, UserRole{Id: id, Role: role}); err != nil {
+		return false, err
 	}
 	return true, nil
 }
 
-// SetUserRoles is a smart contract function which is used to setup a role for user.
+// SetUserRoles is a smart contract function which is used to assign a role to a user, in addition to
+// the roles they already have. The role can be granted until an optional expiresAt, e.g.
+// {"User":"<id>","Role":"KalpGatewayAdmin","expiresAt":1767225600}. Assigning a role again replaces its
+// expiry.
 func (s *SmartContract) SetUserRoles(ctx kalpsdk.TransactionContextInterface, data string) (string, error) {
+	ctx = NewUnitOfWork(ctx)
 	//check if contract has been intilized first
 
 	fmt.Println("SetUserRoles", data)
@@ -524,45 +759,152 @@ func (s *SmartContract) SetUserRoles(ctx kalpsdk.TransactionContextInterface, da
 		return "", fmt.Errorf("failed to parse data: %v", errs)
 	}
 
-	userValid, err := s.ValidateUserRole(ctx, kalpFoundationRole)
+	userValid, err := s.HasPermission(ctx, PermissionSetUserRoles)
 	if err != nil {
 		return "", fmt.Errorf("error in validating the role %v", err)
 	}
 	if !userValid {
 		return "", fmt.Errorf("error in setting role %s, only %s can set the roles", userRole.Role, kalpFoundationRole)
 	}
+	if err := requireMultisigProposal(ctx, ActionSetUserRoles); err != nil {
+		return "", err
+	}
+	if err := assignUserRole(ctx, userRole); err != nil {
+		return "", err
+	}
+	return s.GetTransactionTimestamp(ctx)
 
+}
+
+// assignUserRole validates and stores the assignment of a role.
+func assignUserRole(ctx kalpsdk.TransactionContextInterface, userRole UserRole) error {
 	// Validate input data.
 	if userRole.Id == "" {
-		return "", fmt.Errorf("user Id can not be null")
+		return fmt.Errorf("user Id can not be null")
 	}
 
 	if userRole.Role == "" {
-		return "", fmt.Errorf("role can not be null")
+		return fmt.Errorf("role can not be null")
 	}
 
-	ValidRoles := []string{kalpFoundationRole, gasFeesAdminRole, kalpGateWayAdmin}
-	if !slices.Contains(ValidRoles, userRole.Role) {
-		return "", fmt.Errorf("invalid input role")
+	if !slices.Contains(validRoles, userRole.Role) {
+		return fmt.Errorf("invalid input role")
+	}
+	if userRole.ExpiresAt != 0 {
+		now, err := txTime(ctx)
+		if err != nil {
+			return err
+		}
+		if userRole.ExpiresAt <= now {
+			return fmt.Errorf("error with status code %v, expiresAt %d is not in the future", http.StatusBadRequest, userRole.ExpiresAt)
+		}
 	}
+	key, err := userRoleKey(ctx, userRole.Id, userRole.Role)
+	if err != nil {
+		return err
+	}
+	args, err := json.Marshal(userRole)
+	if err != nil {
+		return fmt.Errorf("unable to Marshal userRole struct : %v", err)
+	}
+	if err := auditKeyChange(ctx, "SetUserRoles", []string{string(args)}, key); err != nil {
+		return err
+	}
+	return putUserRole(ctx, userRole)
+}
+
+// RevokeUserRole is a smart contract function which removes a role from a user, e.g. the gateway admin
+// role from a compromised gateway key. The foundation role of the foundation address only moves when the
+// foundation is rotated.
+func (s *SmartContract) RevokeUserRole(ctx kalpsdk.TransactionContextInterface, id string, role string) error {
+	ctx = NewUnitOfWork(ctx)
+	if _, err := s.requirePermission(ctx, PermissionSetUserRoles); err != nil {
+		return err
+	}
+	if err := requireMultisigProposal(ctx, ActionRevokeUserRole); err != nil {
+		return err
+	}
+	return revokeRole(ctx, id, role)
+}
 
-	key, err := ctx.CreateCompositeKey(userRolePrefix, []string{userRole.Id, UserRoleMap})
+func revokeRole(ctx kalpsdk.TransactionContextInterface, id string, role string) error {
+	foundation, err := foundationAddress(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to create the composite key for prefix %s: %v", userRolePrefix, err)
+		return err
 	}
-	// Generate JSON representation of Role struct.
-	usrRoleJSON, err := json.Marshal(userRole)
+	if id == foundation && role == kalpFoundationRole {
+		return fmt.Errorf("error with status code %v, the foundation can not lose the %s role", http.StatusBadRequest, kalpFoundationRole)
+	}
+	if !slices.Contains(validRoles, role) {
+		return fmt.Errorf("invalid input role")
+	}
+	roles, err := getUserRoles(ctx, id)
 	if err != nil {
-		return "", fmt.Errorf("unable to Marshal userRole struct : %v", err)
+		return err
 	}
-	// Store the Role struct in the state database
-	if err := ctx.PutStateWithoutKYC(key, usrRoleJSON); err != nil {
-		return "", fmt.Errorf("unable to put user role struct in statedb: %v", err)
+	previous, err := json.Marshal(roles)
+	if err != nil {
+		return fmt.Errorf("failed to obtain JSON encoding: %v", err)
 	}
-	return s.GetTransactionTimestamp(ctx)
+	if err := recordAdminAudit(ctx, "RevokeUserRole", []string{id, role}, previous); err != nil {
+		return err
+	}
+	revoked, err := deleteUserRole(ctx, id, role)
+	if err != nil {
+		return err
+	}
+	if !revoked {
+		return fmt.Errorf("error with status code %v, %s does not have the role %s", http.StatusNotFound, id, role)
+	}
+	return nil
+}
 
+// ListRoleMembers is a smart contract function which returns the users holding a role and when it
+// expires for them. Expired assignments are left out, and so are roles assigned before identities could
+// have several roles until they are assigned again.
+func (s *SmartContract) ListRoleMembers(ctx kalpsdk.TransactionContextInterface, role string) ([]UserRole, error) {
+	ctx = NewQueryContext(ctx)
+	if !slices.Contains(validRoles, role) {
+		return nil, fmt.Errorf("error with status code %v, invalid role %s", http.StatusBadRequest, role)
+	}
+	now, err := txTime(ctx)
+	if err != nil {
+		return nil, err
+	}
+	resultsIterator, err := scanPartialCompositeKey(ctx, roleMemberPrefix, []string{role})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer resultsIterator.Close()
+	members := []UserRole{}
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		_, parts, err := ctx.SplitCompositeKey(queryResult.Key)
+		if err != nil || len(parts) != 2 {
+			return nil, fmt.Errorf("invalid role member key %s: %v", queryResult.Key, err)
+		}
+		key, err := userRoleKey(ctx, parts[1], role)
+		if err != nil {
+			return nil, err
+		}
+		userRole, err := readUserRole(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if userRole == nil || userRole.expired(now) {
+			continue
+		}
+		members = append(members, *userRole)
+	}
+	return members, nil
 }
 
+// ValidateUserRole reports whether the caller has Role.
+//
+// Deprecated: entrypoints check permissions with HasPermission.
 func (s *SmartContract) ValidateUserRole(ctx kalpsdk.TransactionContextInterface, Role string) (bool, error) {
 
 	// Check if operator is authorized to create Role.
@@ -572,39 +914,71 @@ func (s *SmartContract) ValidateUserRole(ctx kalpsdk.TransactionContextInterface
 	}
 
 	fmt.Println("operator---------------", operator)
-	userRole, err1 := s.GetUserRoles(ctx, operator)
+	userRoles, err1 := getUserRoles(ctx, operator)
 	if err1 != nil {
 		return false, fmt.Errorf("error: %v", err1)
 	}
 
-	if userRole != Role {
+	if !slices.Contains(userRoles, Role) {
 		return false, fmt.Errorf("this transaction can be performed by %v only", Role)
 	}
 	return true, nil
 }
 
-// GetUserRoles is a smart contract function which is used to get a role of a user.
+// GetUserRoles is a smart contract function which is used to get a role of a user. A user with several
+// roles gets the highest of them, in the order of validRoles, and a user without roles an empty string.
+//
+// Deprecated: ListUserRoles returns all the roles of a user.
 func (s *SmartContract) GetUserRoles(ctx kalpsdk.TransactionContextInterface, id string) (string, error) {
-	// Get the asset from the ledger using id & check if asset exists
-	key, err := ctx.CreateCompositeKey(userRolePrefix, []string{id, UserRoleMap})
-	if err != nil {
-		return "", fmt.Errorf("failed to create the composite key for prefix %s: %v", userRolePrefix, err)
+	roles, err := getUserRoles(ctx, id)
+	if err != nil || len(roles) == 0 {
+		return "", err
 	}
+	for _, role := range validRoles {
+		if slices.Contains(roles, role) {
+			return role, nil
+		}
+	}
+	return roles[0], nil
+}
 
-	userJSON, err := ctx.GetState(key)
+// ListUserRoles is a smart contract function which is used to get the roles of a user. Roles that have
+// expired by the time of the transaction are left out.
+func (s *SmartContract) ListUserRoles(ctx kalpsdk.TransactionContextInterface, id string) ([]string, error) {
+	return getUserRoles(ctx, id)
+}
+
+func getUserRoles(ctx kalpsdk.TransactionContextInterface, id string) ([]string, error) {
+	now, err := txTime(ctx)
 	if err != nil {
-		return "", fmt.Errorf("failed to read from world state: %v", err)
+		return nil, err
 	}
-	if userJSON == nil {
-		return "", nil
+	roles := []string{}
+	for _, role := range validRoles {
+		key, err := userRoleKey(ctx, id, role)
+		if err != nil {
+			return nil, err
+		}
+		userRole, err := readUserRole(ctx, key)
+		if err != nil {
+			return nil, err
+		}
+		if userRole != nil && !userRole.expired(now) {
+			roles = append(roles, role)
+		}
 	}
 
-	// Unmarshal asset from JSON to struct
-	var userRole UserRole
-	err = json.Unmarshal(userJSON, &userRole)
+	// The role assigned before identities could have several roles.
+	key, err := userRoleKey(ctx, id, UserRoleMap)
 	if err != nil {
-		return "", fmt.Errorf("unable to unmarshal user role struct : %v", err)
+		return nil, err
 	}
-
-	return userRole.Role, nil
+	userRole, err := readUserRole(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	if userRole != nil && userRole.Role != "" && !slices.Contains(roles, userRole.Role) {
+		roles = append(roles, userRole.Role)
+	}
+	return roles, nil
 }
@@ -0,0 +1,136 @@
+package kalpAccounting
+
+import (
+	"errors"
+	"math/big"
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcurrentSpendsOfSameUtxosConflict(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	require.NoError(t, transfer(l, s, kalpFoundation, alice, "5000000000000000000"))
+
+	// Both transfers are endorsed against the same state before either is committed.
+	first := l.NewTransaction(alice)
+	_, err := s.Transfer(first, bob, "3000000000000000000")
+	require.NoError(t, err)
+	second := l.NewTransaction(alice)
+	_, err = s.Transfer(second, carol, "3000000000000000000")
+	require.NoError(t, err)
+
+	require.NoError(t, first.Commit())
+	// The second transfer read both the spent UTXOs and the balance record of alice.
+	err = second.Commit()
+	require.True(t, errors.Is(err, fakeledger.ErrPhantomReadConflict) || errors.Is(err, fakeledger.ErrMVCCReadConflict), "got %v", err)
+
+	require.Equal(t, "2000000000000000000", balanceOf(t, l, s, alice))
+	require.Equal(t, "2999000000000000000", balanceOf(t, l, s, bob))
+	require.Equal(t, "0", balanceOf(t, l, s, carol))
+}
+
+func TestPhantomUtxoDetected(t *testing.T) {
+	l := fakeledger.New()
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return AddUtxo(NewUnitOfWork(ctx), alice, big.NewInt(10))
+	}))
+
+	// The balance read covers the whole UTXO range of the account, so a UTXO
+	// created concurrently invalidates it.
+	reader := l.NewTransaction(alice)
+	total, err := GetTotalUTXO(NewUnitOfWork(reader), alice)
+	require.NoError(t, err)
+	require.Equal(t, "10", total)
+	require.NoError(t, reader.PutStateWithoutKYC("snapshot", []byte(total)))
+
+	require.NoError(t, l.Submit(bob, func(ctx *fakeledger.TransactionContext) error {
+		return AddUtxo(NewUnitOfWork(ctx), alice, big.NewInt(5))
+	}))
+	require.ErrorIs(t, reader.Commit(), fakeledger.ErrPhantomReadConflict)
+}
+
+func TestSpendsOfDifferentAccountsDoNotConflict(t *testing.T) {
+	l := fakeledger.New()
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		if err := AddUtxo(NewUnitOfWork(ctx), alice, big.NewInt(10)); err != nil {
+			return err
+		}
+		return AddUtxo(NewUnitOfWork(ctx), bob, big.NewInt(10))
+	}))
+
+	first := l.NewTransaction(alice)
+	require.NoError(t, RemoveUtxo(NewUnitOfWork(first), alice, big.NewInt(4)))
+	second := l.NewTransaction(bob)
+	require.NoError(t, RemoveUtxo(NewUnitOfWork(second), bob, big.NewInt(4)))
+
+	require.NoError(t, first.Commit())
+	require.NoError(t, second.Commit())
+}
+
+func TestSameAccountCreditedTwiceInOneTransaction(t *testing.T) {
+	l := fakeledger.New()
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		uow := NewUnitOfWork(ctx)
+		if err := AddUtxo(uow, alice, big.NewInt(10)); err != nil {
+			return err
+		}
+		return AddUtxo(uow, alice, big.NewInt(5))
+	}))
+	total, err := GetTotalUTXO(l.NewTransaction(alice), alice)
+	require.NoError(t, err)
+	require.Equal(t, "15", total)
+
+	// The change output of a spend and a credit to the same account must not collide either.
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		uow := NewUnitOfWork(ctx)
+		if err := RemoveUtxo(uow, alice, big.NewInt(3)); err != nil {
+			return err
+		}
+		return AddUtxo(uow, alice, big.NewInt(3))
+	}))
+	total, err = GetTotalUTXO(l.NewTransaction(alice), alice)
+	require.NoError(t, err)
+	require.Equal(t, "15", total)
+
+	// Without a shared UnitOfWork both outputs would be numbered 0.
+	err = l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return AddUtxo(ctx, alice, big.NewInt(1))
+	})
+	require.ErrorContains(t, err, "unit of work")
+	err = l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		return RemoveUtxo(ctx, alice, big.NewInt(1))
+	})
+	require.ErrorContains(t, err, "unit of work")
+	total, err = GetTotalUTXO(l.NewTransaction(alice), alice)
+	require.NoError(t, err)
+	require.Equal(t, "15", total)
+}
+
+func TestMigrateUtxoKeys(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	ctx := l.NewTransaction(alice)
+	legacyKey, err := ctx.CreateCompositeKey(UTXO, []string{alice, "legacytx"})
+	require.NoError(t, err)
+	l.PutState(legacyKey, []byte(`{"account":"`+alice+`","docType":"UTXO","amount":"70"}`))
+	require.Equal(t, "70", balanceOf(t, l, s, alice))
+
+	err = l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.MigrateUtxoKeys(ctx, alice)
+		return err
+	})
+	require.Error(t, err, "only the foundation can migrate")
+
+	var migrated int
+	require.NoError(t, l.Submit(kalpFoundation, func(ctx *fakeledger.TransactionContext) error {
+		migrated, err = s.MigrateUtxoKeys(ctx, alice)
+		return err
+	}))
+	require.Equal(t, 1, migrated)
+	require.Nil(t, l.GetState(legacyKey))
+	newKey, _ := ctx.CreateCompositeKey(UTXO, []string{alice, "legacytx", "0"})
+	require.NotNil(t, l.GetState(newKey))
+	require.Equal(t, "70", balanceOf(t, l, s, alice))
+}
@@ -0,0 +1,245 @@
+package kalpAccounting
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+
+	"github.com/p2eengineering/kalp-sdk-public/kalpsdk"
+)
+
+const maxUtxoPageSize = 200
+
+// UtxoInfo describes an unspent output for ListUtxos.
+type UtxoInfo struct {
+	Key       string `json:"key"`
+	Account   string `json:"account"`
+	TxID      string `json:"txId"`
+	Index     string `json:"index"`
+	Amount    string `json:"amount"`
+	CreatedAt int64  `json:"createdAt,omitempty"`
+}
+
+// UtxoPage is a page of ListUtxos results. Bookmark is passed to the next call to get the next page
+// and is empty once the last page has been returned.
+type UtxoPage struct {
+	Utxos    []UtxoInfo `json:"utxos"`
+	Bookmark string     `json:"bookmark"`
+}
+
+// UtxoOutput is an output created by TransferUtxos.
+type UtxoOutput struct {
+	Account string `json:"account"`
+	Amount  string `json:"amount"`
+}
+
+// UtxoTransfer is the result and event of TransferUtxos.
+type UtxoTransfer struct {
+	Operator       string              `json:"operator"`
+	Inputs         []string            `json:"inputs"`
+	Outputs        []UtxoOutput        `json:"outputs"`
+	Fee            string              `json:"fee"`
+	Change         string              `json:"change"`
+	Consolidations []UtxoConsolidation `json:"consolidations,omitempty"`
+	FeeSplit       []FeeShare          `json:"feeSplit,omitempty"`
+	GasFeeChange   *GasFeeRecord       `json:"gasFeeChange,omitempty"`
+}
+
+// ListUtxos is a smart contract function which returns the unspent outputs of an account in key
+// order, pageSize at a time. The bookmark is the Bookmark of the previous page. It must be evaluated as
+// a query, as it uses a paginated query.
+func (s *SmartContract) ListUtxos(ctx kalpsdk.TransactionContextInterface, account string, pageSize int, bookmark string) (*UtxoPage, error) {
+	ctx = NewQueryContext(ctx)
+	account = strings.Trim(account, " ")
+	if account == "" {
+		return nil, fmt.Errorf("invalid input account is required")
+	}
+	if pageSize <= 0 || pageSize > maxUtxoPageSize {
+		return nil, fmt.Errorf("error with status code %v, page size must be between 1 and %d", http.StatusBadRequest, maxUtxoPageSize)
+	}
+	querier, ok := paginatedQuerier(ctx)
+	if !ok {
+		return nil, fmt.Errorf("error with status code %v, utxos can only be listed in a read-only transaction", http.StatusBadRequest)
+	}
+	// The query starts at the bookmark, so each page only reads its own UTXOs.
+	resultsIterator, metadata, err := querier.GetStateByPartialCompositeKeyWithPagination(UTXO, []string{account}, int32(pageSize), bookmark)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read from world state: %v", err)
+	}
+	defer resultsIterator.Close()
+	page := &UtxoPage{Utxos: []UtxoInfo{}, Bookmark: metadata.GetBookmark()}
+	for resultsIterator.HasNext() {
+		queryResult, err := resultsIterator.Next()
+		if err != nil {
+			return nil, err
+		}
+		var u Utxo
+		if err := json.Unmarshal(queryResult.Value, &u); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal value %v", err)
+		}
+		_, txID, index, err := splitUtxoKey(ctx, queryResult.Key)
+		if err != nil {
+			return nil, err
+		}
+		page.Utxos = append(page.Utxos, UtxoInfo{
+			Key:       queryResult.Key,
+			Account:   u.Account,
+			TxID:      txID,
+			Index:     index,
+			Amount:    u.Amount,
+			CreatedAt: u.CreatedAt,
+		})
+	}
+	return page, nil
+}
+
+// TransferUtxos is a smart contract function which spends the named UTXOs of the caller and creates
+// the given outputs. The inputs must cover the outputs plus the gas fee on their total; anything left
+// over is returned to the caller as a change output. Fee exempt senders pay no gas fee, and outputs to
+// fee exempt accounts aren't charged.
+func (s *SmartContract) TransferUtxos(ctx kalpsdk.TransactionContextInterface, inputs []string, outputs []UtxoOutput) (*UtxoTransfer, error) {
+	logger := kalpsdk.NewLogger()
+	logger.Info("TransferUtxos---->")
+	ctx = NewUnitOfWork(ctx)
+	sender, err := ctx.GetUserID()
+	if err != nil {
+		return nil, fmt.Errorf("error in getting user id: %v", err)
+	}
+	if len(inputs) == 0 {
+		return nil, fmt.Errorf("error with status code %v, at least one input is required", http.StatusBadRequest)
+	}
+	if len(outputs) == 0 {
+		return nil, fmt.Errorf("error with status code %v, at least one output is required", http.StatusBadRequest)
+	}
+
+	inputAmount := big.NewInt(0)
+	spent := map[string]bool{}
+	for _, key := range inputs {
+		if spent[key] {
+			return nil, fmt.Errorf("error with status code %v, utxo %q is spent twice", http.StatusBadRequest, key)
+		}
+		spent[key] = true
+		account, _, _, err := splitUtxoKey(ctx, key)
+		if err != nil {
+			return nil, fmt.Errorf("error with status code %v, invalid input: %v", http.StatusBadRequest, err)
+		}
+		if account != sender {
+			return nil, fmt.Errorf("error with status code %v, utxo %q is not owned by %s", http.StatusBadRequest, key, sender)
+		}
+		utxoJSON, err := ctx.GetState(key)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read from world state: %v", err)
+		}
+		if utxoJSON == nil {
+			return nil, fmt.Errorf("error with status code %v, utxo %q does not exist", http.StatusBadRequest, key)
+		}
+		var u Utxo
+		if err := json.Unmarshal(utxoJSON, &u); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal value %v", err)
+		}
+		amount, ok := big.NewInt(0).SetString(u.Amount, 10)
+		if !ok {
+			return nil, fmt.Errorf("invalid amount %s in utxo %q", u.Amount, key)
+		}
+		inputAmount.Add(inputAmount, amount)
+	}
+
+	senderExempt, err := isFeeExempt(ctx, sender)
+	if err != nil {
+		return nil, err
+	}
+	outputAmount := big.NewInt(0)
+	feeableAmount := big.NewInt(0)
+	amounts := make([]*big.Int, len(outputs))
+	for i, output := range outputs {
+		output.Account = strings.Trim(output.Account, " ")
+		if len(output.Account) != 40 {
+			return nil, fmt.Errorf("address must be 40 characters long")
+		}
+		if strings.ContainsAny(output.Account, "`~!@#$%^&*()-_+=[]{}\\|;':\",./<>? ") {
+			return nil, fmt.Errorf("invalid address")
+		}
+		amount, ok := big.NewInt(0).SetString(output.Amount, 10)
+		if !ok || amount.Sign() <= 0 {
+			return nil, fmt.Errorf("error with status code %v, invalid Amount %v", http.StatusBadRequest, output.Amount)
+		}
+		outputs[i] = output
+		amounts[i] = amount
+		outputAmount.Add(outputAmount, amount)
+		receiverExempt, err := isFeeExempt(ctx, output.Account)
+		if err != nil {
+			return nil, err
+		}
+		if !senderExempt && !receiverExempt {
+			feeableAmount.Add(feeableAmount, amount)
+		}
+	}
+
+	fee := big.NewInt(0)
+	if feeableAmount.Sign() > 0 {
+		gasFeePolicy, err := getGasFeePolicy(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get gas gee: %v", err)
+		}
+		// The fee is charged on the total sent to receivers that aren't fee exempt, as it would be for a
+		// single transfer.
+		if fee, err = gasFeePolicy.Fee(feeableAmount); err != nil {
+			return nil, err
+		}
+	}
+	change := big.NewInt(0).Sub(inputAmount, outputAmount)
+	change.Sub(change, fee)
+	if change.Sign() < 0 {
+		return nil, fmt.Errorf("error with status code %v, inputs of %v don't cover outputs of %v plus gas fee of %v", http.StatusBadRequest, inputAmount, outputAmount, fee)
+	}
+
+	if err := checkFoundationTransfer(ctx, sender, big.NewInt(0).Sub(inputAmount, change)); err != nil {
+		return nil, err
+	}
+	if err := adjustBalance(ctx, sender, big.NewInt(0).Neg(inputAmount), -len(inputs)); err != nil {
+		return nil, err
+	}
+	for _, key := range inputs {
+		if err := ctx.DelStateWithoutKYC(key); err != nil {
+			return nil, fmt.Errorf("failed to delete utxo %q from world state: %v", key, err)
+		}
+	}
+	for i, output := range outputs {
+		if err := AddUtxo(ctx, output.Account, amounts[i]); err != nil {
+			return nil, fmt.Errorf("error with status code %v, error:error while adding balance %v", http.StatusBadRequest, err)
+		}
+	}
+	if change.Sign() > 0 {
+		if err := AddUtxo(ctx, sender, change); err != nil {
+			return nil, fmt.Errorf("error with status code %v, error:error while adding balance %v", http.StatusBadRequest, err)
+		}
+	}
+	var feeSplit []FeeShare
+	if fee.Sign() > 0 {
+		if feeSplit, err = distributeFee(ctx, fee); err != nil {
+			return nil, err
+		}
+	}
+
+	transfer := &UtxoTransfer{
+		Operator: sender,
+		Inputs:   inputs,
+		Outputs:  outputs,
+		Fee:      fee.String(),
+		Change:   change.String(),
+		FeeSplit: feeSplit,
+	}
+	if uow, ok := ctx.(*UnitOfWork); ok {
+		transfer.Consolidations, transfer.GasFeeChange = uow.consolidations, uow.gasFeeChange
+	}
+	transferJSON, err := json.Marshal(transfer)
+	if err != nil {
+		return nil, fmt.Errorf("failed to obtain JSON encoding: %v", err)
+	}
+	if err := ctx.SetEvent("TransferUtxos", transferJSON); err != nil {
+		return nil, fmt.Errorf("failed to set event: %v", err)
+	}
+	return transfer, nil
+}
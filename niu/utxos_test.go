@@ -0,0 +1,97 @@
+package kalpAccounting
+
+import (
+	"testing"
+
+	"KAPS-NIU/fakeledger"
+
+	"github.com/stretchr/testify/require"
+)
+
+func listUtxos(t *testing.T, l *fakeledger.Ledger, s *SmartContract, account string, pageSize int, bookmark string) *UtxoPage {
+	t.Helper()
+	page, err := s.ListUtxos(l.NewTransaction(account), account, pageSize, bookmark)
+	require.NoError(t, err)
+	return page
+}
+
+func TestListUtxos(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	for _, amount := range []string{"10", "20", "30"} {
+		require.NoError(t, transfer(l, s, kalpFoundation, alice, amount))
+	}
+
+	first := listUtxos(t, l, s, alice, 2, "")
+	require.Len(t, first.Utxos, 2)
+	require.NotEmpty(t, first.Bookmark)
+	second := listUtxos(t, l, s, alice, 2, first.Bookmark)
+	require.Len(t, second.Utxos, 1)
+	require.Empty(t, second.Bookmark)
+	require.Equal(t, first.Bookmark, second.Utxos[0].Key, "the next page starts at the bookmark")
+
+	total := "0"
+	for _, u := range append(first.Utxos, second.Utxos...) {
+		require.Equal(t, alice, u.Account)
+		require.NotEmpty(t, u.TxID)
+		require.NotEmpty(t, u.Index)
+		total = sum(total, u.Amount)
+	}
+	require.Equal(t, "60", total)
+
+	_, err := s.ListUtxos(l.NewTransaction(alice), alice, 0, "")
+	require.Error(t, err)
+	_, err = s.ListUtxos(l.NewTransaction(bob), bob, 2, first.Bookmark)
+	require.Error(t, err, "the bookmark of another account is rejected")
+}
+
+func TestTransferUtxos(t *testing.T) {
+	l, s := newInitializedLedger(t)
+	for _, amount := range []string{"3000000000000000", "5000000000000000"} {
+		require.NoError(t, transfer(l, s, kalpFoundation, alice, amount))
+	}
+	var inputs []string
+	for _, u := range listUtxos(t, l, s, alice, 10, "").Utxos {
+		inputs = append(inputs, u.Key)
+	}
+	outputs := []UtxoOutput{{Account: bob, Amount: "4000000000000000"}, {Account: carol, Amount: "2000000000000000"}}
+	foundationBefore := balanceOf(t, l, s, kalpFoundation)
+
+	err := l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.TransferUtxos(ctx, inputs, []UtxoOutput{{Account: bob, Amount: "7500000000000000"}})
+		return err
+	})
+	require.Error(t, err, "inputs must cover outputs plus the gas fee")
+	err = l.Submit(bob, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.TransferUtxos(ctx, inputs, outputs)
+		return err
+	})
+	require.Error(t, err, "only the owner can spend the inputs")
+	err = l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.TransferUtxos(ctx, []string{inputs[0], inputs[0]}, outputs)
+		return err
+	})
+	require.Error(t, err)
+
+	var result *UtxoTransfer
+	require.NoError(t, l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		result, err = s.TransferUtxos(ctx, inputs, outputs)
+		return err
+	}))
+	require.Equal(t, initialGasFees, result.Fee)
+	require.Equal(t, "1000000000000000", result.Change)
+	require.Equal(t, "TransferUtxos", lastEvent(t, l).Name)
+
+	require.Equal(t, "1000000000000000", balanceOf(t, l, s, alice))
+	require.Equal(t, "4000000000000000", balanceOf(t, l, s, bob))
+	require.Equal(t, "2000000000000000", balanceOf(t, l, s, carol))
+	require.Equal(t, sum(foundationBefore, initialGasFees), balanceOf(t, l, s, kalpFoundation))
+	for _, account := range []string{alice, bob, carol, kalpFoundation} {
+		require.True(t, verifyBalance(t, l, s, account).Consistent, account)
+	}
+
+	err = l.Submit(alice, func(ctx *fakeledger.TransactionContext) error {
+		_, err := s.TransferUtxos(ctx, inputs[:1], outputs[:1])
+		return err
+	})
+	require.Error(t, err, "spent utxos can't be spent again")
+}